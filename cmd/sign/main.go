@@ -0,0 +1,47 @@
+// Command sign prints the signed request path of a media path, like
+//
+//	sign -secret mysecret 'image.jpg?rotate=90'
+//	/<signature>/media/image.jpg?rotate=90
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/blesswinsamuel/media-proxy/signature"
+)
+
+func main() {
+	secret := flag.String("secret", os.Getenv("SECRET"), "Secret used to sign the path (defaults to $SECRET)")
+	algorithm := flag.String("algorithm", "sha1", "Signature algorithm (sha1 or sha256)")
+	requestType := flag.String("type", "media", "Request type (media or metadata)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <media path>[?query]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *secret == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *algorithm != "sha1" && *algorithm != "sha256" {
+		fmt.Fprintf(os.Stderr, "invalid algorithm: %s\n", *algorithm)
+		os.Exit(2)
+	}
+	if *requestType != "media" && *requestType != "metadata" {
+		fmt.Fprintf(os.Stderr, "invalid request type: %s\n", *requestType)
+		os.Exit(2)
+	}
+
+	mediaPath, rawQuery, _ := strings.Cut(flag.Arg(0), "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid query: %v\n", err)
+		os.Exit(2)
+	}
+	fmt.Println(signature.SignPathWithAlgorithm(*algorithm, *secret, *requestType, mediaPath, query))
+}
@@ -1,35 +1,176 @@
 package cache
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
+var (
+	cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "media_proxy_cache_hits_total",
+		Help: "Number of cache hits",
+	}, []string{"cache"})
+	cacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "media_proxy_cache_misses_total",
+		Help: "Number of cache misses",
+	}, []string{"cache"})
+)
+
+var tracer = otel.Tracer("github.com/blesswinsamuel/media-proxy/internal/cache")
+
 type Cache interface {
 	Get(key string) ([]byte, error)
 	Put(key string, data []byte) error
 	Exists(key string) (bool, error)
+	// Stat describes the entry for key without reading it. Like Get and
+	// Exists, a missing (or expired) entry isn't an error.
+	Stat(key string) (CacheEntryInfo, error)
+}
+
+// CacheEntryInfo describes a cache entry, for logic depending on its age or size
+type CacheEntryInfo struct {
+	// Found is false when there's no entry for the key, and the other fields are zero
+	Found bool
+	// Size is the size in bytes of the entry
+	Size int64
+	// ModTime is when the entry was put into the cache
+	ModTime time.Time
+}
+
+// StaleCache is implemented by caches whose entries expire, to read expired
+// entries so that they can be revalidated with the upstream
+type StaleCache interface {
+	// GetStale gets the entry for key, even when it has expired
+	GetStale(key string) ([]byte, error)
+}
+
+// fetchGroups holds a singleflight group per cache, so that the same key in
+// different caches doesn't share a fetch.
+var fetchGroups sync.Map
+
+// FetchStatus tells how GetCachedOrFetch got the data, for logging
+type FetchStatus string
+
+const (
+	// FetchHit is data read from the cache
+	FetchHit FetchStatus = "hit"
+	// FetchMiss is data fetched by the call
+	FetchMiss FetchStatus = "miss"
+	// FetchRevalidated is an expired entry the fetch returned to cache it again
+	FetchRevalidated FetchStatus = "revalidated"
+	// FetchShared is data fetched (or revalidated) by a concurrent call for the same key
+	FetchShared FetchStatus = "shared"
+)
+
+// GetCachedOrFetch returns the cached data for key, calling fetch and caching
+// its result on a miss. Concurrent calls for the same key share a single fetch.
+// name identifies the cache in metrics and traces.
+//
+// The shared fetch isn't canceled with the context of the call that started
+// it, so fetch must use the context it's called with, which keeps ctx's values
+// and deadline. ctx only limits the time each call waits for the fetch.
+func GetCachedOrFetch(ctx context.Context, cache Cache, name string, key string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, FetchStatus, error) {
+	return GetCachedOrRevalidate(ctx, cache, name, key, func(ctx context.Context, stale []byte) ([]byte, error) {
+		return fetch(ctx)
+	})
 }
 
-func GetCachedOrFetch(cache Cache, key string, fetch func() ([]byte, error)) ([]byte, error) {
+// GetCachedOrRevalidate is like GetCachedOrFetch, passing the expired entry
+// for key to fetch on a miss, or nil when there's none (or the cache doesn't
+// implement StaleCache). fetch can return the expired entry to cache it again.
+func GetCachedOrRevalidate(ctx context.Context, cache Cache, name string, key string, fetch func(ctx context.Context, stale []byte) ([]byte, error)) ([]byte, FetchStatus, error) {
+	ctx, span := tracer.Start(ctx, "cache.GetCachedOrFetch", trace.WithAttributes(attribute.String("cache.name", name)))
+	defer span.End()
 	keyHashed := Sha256Hash(key)
+	group, _ := fetchGroups.LoadOrStore(cache, &singleflight.Group{})
+	// only the call starting the fetch runs this function, and its write is
+	// visible once the result is received
+	started := false
+	results := group.(*singleflight.Group).DoChan(keyHashed, func() (interface{}, error) {
+		started = true
+		fetchCtx, cancel := detachContext(ctx)
+		defer cancel()
+		return getCachedOrFetch(fetchCtx, cache, name, key, keyHashed, fetch)
+	})
+	var result singleflight.Result
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		span.RecordError(ctx.Err())
+		return nil, "", ctx.Err()
+	}
+	span.SetAttributes(attribute.Bool("cache.shared", result.Shared))
+	if result.Err != nil {
+		span.RecordError(result.Err)
+		return nil, "", result.Err
+	}
+	fetched := result.Val.(fetchResult)
+	if !started && fetched.status != FetchHit {
+		return fetched.data, FetchShared, nil
+	}
+	return fetched.data, fetched.status, nil
+}
+
+// fetchResult is the result of a fetch shared by the calls for a key
+type fetchResult struct {
+	data   []byte
+	status FetchStatus
+}
+
+// detachContext returns a context with the values and deadline of ctx, which
+// isn't canceled when ctx is, for work shared with other callers
+func detachContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return detached, func() {}
+}
+
+func getCachedOrFetch(ctx context.Context, cache Cache, name string, key string, keyHashed string, fetch func(ctx context.Context, stale []byte) ([]byte, error)) (fetchResult, error) {
+	span := trace.SpanFromContext(ctx)
 	if cachedImage, err := cache.Get(keyHashed); err != nil {
-		return nil, fmt.Errorf("failed to fetch from cache: %w", err)
+		return fetchResult{}, fmt.Errorf("failed to fetch from cache: %w", err)
 	} else if cachedImage != nil {
+		cacheHits.WithLabelValues(name).Inc()
+		span.SetAttributes(attribute.Bool("cache.hit", true))
 		log.Debug().Str("key", key).Str("keyHashed", keyHashed).Int("size", len(cachedImage)).Msgf("Cache hit")
-		return cachedImage, nil
+		return fetchResult{cachedImage, FetchHit}, nil
 	}
+	cacheMisses.WithLabelValues(name).Inc()
+	span.SetAttributes(attribute.Bool("cache.hit", false))
 	log.Debug().Str("key", key).Str("keyHashed", keyHashed).Msgf("Cache miss")
-	img, err := fetch()
+	var stale []byte
+	if staleCache, ok := cache.(StaleCache); ok {
+		var err error
+		if stale, err = staleCache.GetStale(keyHashed); err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("failed to get expired cache entry")
+		}
+	}
+	img, err := fetch(ctx, stale)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch from upstream: %w", err)
+		return fetchResult{}, fmt.Errorf("failed to fetch from upstream: %w", err)
 	}
 	if err := cache.Put(keyHashed, img); err != nil {
-		return nil, fmt.Errorf("failed to put to cache: %w", err)
+		return fetchResult{}, fmt.Errorf("failed to put to cache: %w", err)
+	}
+	status := FetchMiss
+	// the expired entry returned as is
+	if len(img) > 0 && len(img) == len(stale) && &img[0] == &stale[0] {
+		status = FetchRevalidated
 	}
-	return img, nil
+	return fetchResult{img, status}, nil
 }
 
 func Sha256Hash(data string) string {
@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type countingCache struct {
+	Cache
+	puts atomic.Int32
+}
+
+func (c *countingCache) Put(key string, data []byte) error {
+	c.puts.Add(1)
+	return c.Cache.Put(key, data)
+}
+
+// waitForFetchWaiters waits until n calls of GetCachedOrRevalidate wait for
+// their fetch to finish. Joining a shared fetch isn't observable otherwise, so
+// the goroutines blocked in it are counted from their stacks.
+func waitForFetchWaiters(t *testing.T, n int) {
+	t.Helper()
+	buf := make([]byte, 1<<20)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		waiters := 0
+		for _, stack := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+			if strings.Contains(stack, " [select") && strings.Contains(stack, "cache.GetCachedOrRevalidate(") {
+				waiters++
+			}
+		}
+		if waiters >= n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d calls to wait for their fetch", n)
+}
+
+func TestGetCachedOrFetchDeduplicatesConcurrentFetches(t *testing.T) {
+	c := &countingCache{Cache: NewMemoryCache(100)}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) ([]byte, error) {
+		fetches.Add(1)
+		<-release
+		return []byte("data"), nil
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := map[FetchStatus]int{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, status, err := GetCachedOrFetch(context.Background(), c, "test", "key", fetch)
+			if err != nil || string(data) != "data" {
+				t.Errorf("GetCachedOrFetch returned %q, %v, expected %q", data, err, "data")
+			}
+			mu.Lock()
+			statuses[status]++
+			mu.Unlock()
+		}()
+	}
+	waitForFetchWaiters(t, 10)
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetch called %d times, expected 1", n)
+	}
+	if expected := map[FetchStatus]int{FetchMiss: 1, FetchShared: 9}; !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("GetCachedOrFetch returned statuses %v, expected %v", statuses, expected)
+	}
+	if n := c.puts.Load(); n != 1 {
+		t.Errorf("Put called %d times, expected 1", n)
+	}
+}
+
+func TestGetCachedOrFetchDetachesSharedFetch(t *testing.T) {
+	c := NewMemoryCache(100)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return []byte("data"), nil
+	}
+
+	// the caller that started the fetch gives up on it
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := GetCachedOrFetch(ctx, c, "test", "key", fetch)
+		done <- err
+	}()
+	<-started
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled GetCachedOrFetch returned error %v, expected %v", err, context.Canceled)
+	}
+
+	// the fetch goes on for the other callers
+	result := make(chan []byte)
+	go func() {
+		data, _, err := GetCachedOrFetch(context.Background(), c, "test", "key", fetch)
+		if err != nil {
+			t.Errorf("GetCachedOrFetch returned error: %v", err)
+		}
+		result <- data
+	}()
+	close(release)
+	if data := <-result; string(data) != "data" {
+		t.Errorf("GetCachedOrFetch returned %q, expected %q", data, "data")
+	}
+}
+
+func TestGetCachedOrFetchPropagatesErrors(t *testing.T) {
+	c := NewMemoryCache(100)
+	fetchErr := errors.New("upstream down")
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) ([]byte, error) {
+		fetches.Add(1)
+		<-release
+		return nil, fetchErr
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := GetCachedOrFetch(context.Background(), c, "test", "key", fetch); !errors.Is(err, fetchErr) {
+				t.Errorf("GetCachedOrFetch returned error %v, expected %v", err, fetchErr)
+			}
+		}()
+	}
+	waitForFetchWaiters(t, 5)
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetch called %d times, expected 1", n)
+	}
+	if exists, _ := c.Exists(Sha256Hash("key")); exists {
+		t.Errorf("failed fetch result was cached")
+	}
+}
+
+func TestGetCachedOrRevalidatePassesExpiredEntries(t *testing.T) {
+	c := NewFsCacheWithTTL(t.TempDir(), time.Hour).(*FsCache)
+	keyHashed := Sha256Hash("key")
+	if err := c.Put(keyHashed, []byte("old")); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(c.filePath(keyHashed), old, old); err != nil {
+		t.Fatalf("failed to age cache entry: %v", err)
+	}
+
+	var received []byte
+	data, status, err := GetCachedOrRevalidate(context.Background(), c, "test", "key", func(ctx context.Context, stale []byte) ([]byte, error) {
+		received = stale
+		return stale, nil
+	})
+	if err != nil || string(data) != "old" {
+		t.Fatalf("GetCachedOrRevalidate returned %q, %v, expected %q", data, err, "old")
+	}
+	if status != FetchRevalidated {
+		t.Errorf("GetCachedOrRevalidate returned status %q, expected %q", status, FetchRevalidated)
+	}
+	if string(received) != "old" {
+		t.Errorf("fetch received expired entry %q, expected %q", received, "old")
+	}
+	// caching the expired entry again refreshes its TTL
+	if data, err := c.Get(keyHashed); err != nil || string(data) != "old" {
+		t.Errorf("Get after revalidation = %q, %v, expected %q", data, err, "old")
+	}
+
+	received = []byte("unset")
+	if _, _, err := GetCachedOrRevalidate(context.Background(), NewMemoryCache(100), "test", "key", func(ctx context.Context, stale []byte) ([]byte, error) {
+		received = stale
+		return []byte("new"), nil
+	}); err != nil {
+		t.Fatalf("GetCachedOrRevalidate returned error: %v", err)
+	}
+	if received != nil {
+		t.Errorf("fetch received expired entry %q from a cache without expired entries, expected nil", received)
+	}
+}
+
+func TestGetCachedOrFetchCountsHitsAndMisses(t *testing.T) {
+	c := NewMemoryCache(100)
+	fetch := func(ctx context.Context) ([]byte, error) { return []byte("data"), nil }
+	hits, misses := testutil.ToFloat64(cacheHits.WithLabelValues("counting")), testutil.ToFloat64(cacheMisses.WithLabelValues("counting"))
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := GetCachedOrFetch(context.Background(), c, "counting", "key", fetch); err != nil {
+			t.Fatalf("GetCachedOrFetch returned error: %v", err)
+		}
+	}
+
+	if n := testutil.ToFloat64(cacheMisses.WithLabelValues("counting")) - misses; n != 1 {
+		t.Errorf("recorded %v misses, expected 1", n)
+	}
+	if n := testutil.ToFloat64(cacheHits.WithLabelValues("counting")) - hits; n != 2 {
+		t.Errorf("recorded %v hits, expected 2", n)
+	}
+}
@@ -5,17 +5,47 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 )
 
+// evictionLowWatermark is the fraction of the max bytes a cache that exceeds
+// them is reduced to, so that it isn't evicted again on every Put
+const evictionLowWatermark = 0.9
+
+// evictionInterval is how often the size of a cache with max bytes is checked
+const evictionInterval = time.Minute
+
 type FsCache struct {
 	cachePath string
+	ttl       time.Duration
+	maxBytes  int64
+	// size is the size of the cache as of the last eviction walk, plus the
+	// bytes put since. Puts making it exceed maxBytes signal evictNow.
+	size     atomic.Int64
+	evictNow chan struct{}
 }
 
 func NewFsCache(cachePath string) Cache {
-	cache := &FsCache{cachePath: cachePath}
+	return NewFsCacheWithTTL(cachePath, 0)
+}
+
+// NewFsCacheWithTTL creates a filesystem cache whose entries expire after ttl.
+// A ttl of zero disables expiry.
+func NewFsCacheWithTTL(cachePath string, ttl time.Duration) Cache {
+	return NewFsCacheWithLimits(cachePath, ttl, 0)
+}
+
+// NewFsCacheWithLimits creates a filesystem cache whose entries expire after
+// ttl, and whose least recently accessed entries are evicted when it's larger
+// than maxBytes. Zero disables either limit.
+func NewFsCacheWithLimits(cachePath string, ttl time.Duration, maxBytes int64) Cache {
+	cache := &FsCache{cachePath: cachePath, ttl: ttl, maxBytes: maxBytes, evictNow: make(chan struct{}, 1)}
 	if err := prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Name:        "media_proxy_cache_fs_size_bytes",
 		ConstLabels: prometheus.Labels{"cache_path": cachePath},
@@ -34,12 +64,142 @@ func NewFsCache(cachePath string) Cache {
 	})); err != nil {
 		log.Warn().Err(err).Str("cache_path", cachePath).Msg("failed to register metric media_proxy_cache_fs_files_count")
 	}
+	if ttl > 0 {
+		go cache.sweepPeriodically()
+	}
+	if maxBytes > 0 {
+		go cache.evictPeriodically()
+	}
 	return cache
 }
 
+// filePath returns the path of the file for key, sharded into two levels of
+// subdirectories by the first four characters of the key (e.g. ab/cd/abcd...).
+func (c *FsCache) filePath(key string) string {
+	if len(key) < 4 {
+		return path.Join(c.cachePath, key)
+	}
+	return path.Join(c.cachePath, key[0:2], key[2:4], key)
+}
+
+func (c *FsCache) isExpired(info os.FileInfo) bool {
+	return c.ttl > 0 && time.Since(info.ModTime()) > c.ttl
+}
+
+func (c *FsCache) sweepPeriodically() {
+	interval := c.ttl / 2
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		removed, err := c.Sweep()
+		if err != nil {
+			log.Warn().Err(err).Str("cache_path", c.cachePath).Msg("failed to sweep expired cache entries")
+			continue
+		}
+		log.Debug().Str("cache_path", c.cachePath).Int("removed", removed).Msg("Swept expired cache entries")
+	}
+}
+
+// evictPeriodically evicts files on startup, every evictionInterval and when
+// a Put makes the cache exceed its max bytes
+func (c *FsCache) evictPeriodically() {
+	ticker := time.NewTicker(evictionInterval)
+	defer ticker.Stop()
+	for {
+		removed, err := c.Evict()
+		if err != nil {
+			log.Warn().Err(err).Str("cache_path", c.cachePath).Msg("failed to evict cache entries")
+		} else if removed > 0 {
+			log.Debug().Str("cache_path", c.cachePath).Int("removed", removed).Msg("Evicted least recently accessed cache entries")
+		}
+		select {
+		case <-ticker.C:
+		case <-c.evictNow:
+		}
+	}
+}
+
+// walkFiles calls fn for the files of the cache, skipping the ones removed while walking
+func (c *FsCache) walkFiles(fn func(filePath string, info os.FileInfo) error) error {
+	return filepath.Walk(c.cachePath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(filePath, info)
+	})
+}
+
+// Evict removes the least recently accessed files when the cache is larger
+// than its max bytes, until it's below the low watermark. Files being written
+// aren't removed.
+func (c *FsCache) Evict() (int, error) {
+	if c.maxBytes <= 0 {
+		return 0, nil
+	}
+	type cacheFile struct {
+		path       string
+		size       int64
+		accessTime time.Time
+	}
+	var files []cacheFile
+	var size int64
+	if err := c.walkFiles(func(filePath string, info os.FileInfo) error {
+		size += info.Size()
+		if !strings.HasPrefix(info.Name(), ".") {
+			files = append(files, cacheFile{filePath, info.Size(), accessTime(info)})
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	removed := 0
+	if size > c.maxBytes {
+		sort.Slice(files, func(i, j int) bool { return files[i].accessTime.Before(files[j].accessTime) })
+		target := int64(float64(c.maxBytes) * evictionLowWatermark)
+		for _, file := range files {
+			if size <= target {
+				break
+			}
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				c.size.Store(size)
+				return removed, err
+			}
+			size -= file.size
+			removed++
+		}
+	}
+	c.size.Store(size)
+	return removed, nil
+}
+
+// Sweep removes expired files from the filesystem cache
+func (c *FsCache) Sweep() (int, error) {
+	removed := 0
+	err := c.walkFiles(func(filePath string, info os.FileInfo) error {
+		if !c.isExpired(info) {
+			return nil
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
 // Get gets the file from local filesystem
 func (c *FsCache) Get(key string) ([]byte, error) {
-	filePath := path.Join(c.cachePath, key)
+	filePath := c.filePath(key)
 	file, err := os.Open(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -48,45 +208,96 @@ func (c *FsCache) Get(key string) ([]byte, error) {
 		return nil, err
 	}
 	defer file.Close()
+	if c.ttl > 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if c.isExpired(info) {
+			return nil, nil
+		}
+	}
 	return io.ReadAll(file)
 }
 
+// GetStale gets the file from local filesystem, even when it has expired.
+// Expired files are only kept until they're swept.
+func (c *FsCache) GetStale(key string) ([]byte, error) {
+	data, err := os.ReadFile(c.filePath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
 // Put puts a file into the filesystem cache
 func (c *FsCache) Put(key string, data []byte) error {
-	if err := os.MkdirAll(c.cachePath, 0755); err != nil {
+	filePath := c.filePath(key)
+	dir := path.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	filePath := path.Join(c.cachePath, key)
-	file, err := os.Create(filePath)
+	// Write to a temporary file and rename it into place, so that a partially
+	// written file is never visible under the key.
+	file, err := os.CreateTemp(dir, "."+key+".tmp-*")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	file.Write(data)
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return err
+	}
+	if c.maxBytes > 0 && c.size.Add(int64(len(data))) > c.maxBytes {
+		select {
+		case c.evictNow <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
 // Exists checks if a file exists in the filesystem cache
 func (c *FsCache) Exists(key string) (bool, error) {
-	filePath := path.Join(c.cachePath, key)
-	if _, err := os.Stat(filePath); err != nil {
+	filePath := c.filePath(key)
+	info, err := os.Stat(filePath)
+	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
 		}
 		return false, err
 	}
-	return true, nil
+	return !c.isExpired(info), nil
+}
+
+// Stat describes a file of the filesystem cache
+func (c *FsCache) Stat(key string) (CacheEntryInfo, error) {
+	info, err := os.Stat(c.filePath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return CacheEntryInfo{}, nil
+		}
+		return CacheEntryInfo{}, err
+	}
+	if c.isExpired(info) {
+		return CacheEntryInfo{}, nil
+	}
+	return CacheEntryInfo{Found: true, Size: info.Size(), ModTime: info.ModTime()}, nil
 }
 
 func (c *FsCache) GetCacheSize() (int64, int64, error) {
 	var size int64
 	var count int64
-	if err := filepath.Walk(c.cachePath, func(_ string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
-			size += info.Size()
-			count++
-		}
-		return err
+	if err := c.walkFiles(func(_ string, info os.FileInfo) error {
+		size += info.Size()
+		count++
+		return nil
 	}); err != nil {
 		return 0, 0, err
 	}
@@ -0,0 +1,16 @@
+package cache
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the time the file was last read, as far as the
+// filesystem records it (like with relatime), or its modification time
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	}
+	return info.ModTime()
+}
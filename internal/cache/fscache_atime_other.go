@@ -0,0 +1,14 @@
+//go:build !linux
+
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time of the file, as the access time
+// isn't read on this platform
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFsCacheTTL(t *testing.T) {
+	cachePath := t.TempDir()
+	c := NewFsCacheWithTTL(cachePath, time.Hour).(*FsCache)
+	if err := c.Put("fresh", []byte("fresh")); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := c.Put("stale", []byte("stale")); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(c.filePath("stale"), old, old); err != nil {
+		t.Fatalf("failed to age cache entry: %v", err)
+	}
+
+	if data, err := c.Get("fresh"); err != nil || string(data) != "fresh" {
+		t.Errorf("Get(%q) = %q, %v, expected %q", "fresh", data, err, "fresh")
+	}
+	if data, err := c.Get("stale"); err != nil || data != nil {
+		t.Errorf("Get(%q) = %q, %v, expected a miss", "stale", data, err)
+	}
+	if exists, err := c.Exists("stale"); err != nil || exists {
+		t.Errorf("Exists(%q) = %v, %v, expected false", "stale", exists, err)
+	}
+	if data, err := c.GetStale("stale"); err != nil || string(data) != "stale" {
+		t.Errorf("GetStale(%q) = %q, %v, expected %q", "stale", data, err, "stale")
+	}
+
+	removed, err := c.Sweep()
+	if err != nil {
+		t.Fatalf("Sweep returned error: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Sweep removed %d entries, expected 1", removed)
+	}
+	size, count, err := c.GetCacheSize()
+	if err != nil {
+		t.Fatalf("GetCacheSize returned error: %v", err)
+	}
+	if size != int64(len("fresh")) || count != 1 {
+		t.Errorf("GetCacheSize() = %d, %d, expected %d, %d", size, count, len("fresh"), 1)
+	}
+	if data, err := c.GetStale("stale"); err != nil || data != nil {
+		t.Errorf("GetStale(%q) after Sweep = %q, %v, expected a miss", "stale", data, err)
+	}
+}
+
+func TestFsCacheEvict(t *testing.T) {
+	// constructed directly, so that no eviction runs in the background
+	c := &FsCache{cachePath: t.TempDir(), maxBytes: 100, evictNow: make(chan struct{}, 1)}
+	now := time.Now()
+	// five 30 byte entries, "a" accessed the longest ago
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := c.Put(key, make([]byte, 30)); err != nil {
+			t.Fatalf("Put returned error: %v", err)
+		}
+		accessed := now.Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(c.filePath(key), accessed, accessed); err != nil {
+			t.Fatalf("failed to set the access time of cache entry: %v", err)
+		}
+	}
+	select {
+	case <-c.evictNow:
+	default:
+		t.Errorf("Put exceeding the max bytes didn't signal an eviction")
+	}
+
+	removed, err := c.Evict()
+	if err != nil {
+		t.Fatalf("Evict returned error: %v", err)
+	}
+	// 150 bytes are reduced to the low watermark of 90 bytes
+	if removed != 2 {
+		t.Errorf("Evict removed %d entries, expected 2", removed)
+	}
+	for key, expected := range map[string]bool{"a": false, "b": false, "c": true, "d": true, "e": true} {
+		if exists, err := c.Exists(key); err != nil || exists != expected {
+			t.Errorf("Exists(%q) after Evict = %v, %v, expected %v", key, exists, err, expected)
+		}
+	}
+	if size, _, err := c.GetCacheSize(); err != nil || size != 90 {
+		t.Errorf("GetCacheSize() after Evict = %d, %v, expected 90", size, err)
+	}
+
+	// a cache below its max bytes is left as is
+	if removed, err := c.Evict(); err != nil || removed != 0 {
+		t.Errorf("Evict below the max bytes = %d, %v, expected 0", removed, err)
+	}
+}
+
+func TestFsCacheStat(t *testing.T) {
+	c := NewFsCacheWithTTL(t.TempDir(), time.Hour).(*FsCache)
+	if info, err := c.Stat("missing"); err != nil || info.Found {
+		t.Errorf("Stat(%q) = %+v, %v, expected a missing entry", "missing", info, err)
+	}
+	for _, key := range []string{"fresh", "stale"} {
+		if err := c.Put(key, []byte("data")); err != nil {
+			t.Fatalf("Put returned error: %v", err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(c.filePath("stale"), old, old); err != nil {
+		t.Fatalf("failed to age cache entry: %v", err)
+	}
+	info, err := c.Stat("fresh")
+	if err != nil {
+		t.Fatalf("Stat returned error: %v", err)
+	}
+	if !info.Found || info.Size != 4 || time.Since(info.ModTime) > time.Minute {
+		t.Errorf("Stat(%q) = %+v, expected a 4 byte entry modified now", "fresh", info)
+	}
+	if info, err := c.Stat("stale"); err != nil || info.Found {
+		t.Errorf("Stat(%q) = %+v, %v, expected the expired entry to be missing", "stale", info, err)
+	}
+}
+
+func TestFsCachePutLeavesNoTemporaryFiles(t *testing.T) {
+	cachePath := t.TempDir()
+	c := NewFsCache(cachePath)
+	key := Sha256Hash("key")
+	if err := c.Put(key, []byte("data")); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := c.Put(key, []byte("updated")); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if data, err := c.Get(key); err != nil || string(data) != "updated" {
+		t.Errorf("Get(%q) = %q, %v, expected %q", key, data, err, "updated")
+	}
+	entries, err := os.ReadDir(path.Join(cachePath, key[0:2], key[2:4]))
+	if err != nil {
+		t.Fatalf("failed to read cache directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("cache directory contains %d entries, expected 1", len(entries))
+	}
+}
+
+func TestFsCacheShardsKeys(t *testing.T) {
+	cachePath := t.TempDir()
+	c := NewFsCache(cachePath).(*FsCache)
+	key := Sha256Hash("key")
+	if err := c.Put(key, []byte("data")); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	expectedPath := filepath.Join(cachePath, key[0:2], key[2:4], key)
+	if _, err := os.Stat(expectedPath); err != nil {
+		t.Errorf("expected cache file at %s: %v", expectedPath, err)
+	}
+	if exists, err := c.Exists(key); err != nil || !exists {
+		t.Errorf("Exists(%q) = %v, %v, expected true", key, exists, err)
+	}
+	size, count, err := c.GetCacheSize()
+	if err != nil {
+		t.Fatalf("GetCacheSize returned error: %v", err)
+	}
+	if size != int64(len("data")) || count != 1 {
+		t.Errorf("GetCacheSize() = %d, %d, expected %d, %d", size, count, len("data"), 1)
+	}
+}
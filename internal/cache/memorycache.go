@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type memoryCacheEntry struct {
+	key     string
+	data    []byte
+	putTime time.Time
+}
+
+// MemoryCache is an in-memory LRU cache bounded by the total size of the stored data.
+type MemoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+func NewMemoryCache(maxBytes int64) Cache {
+	return NewMemoryCacheWithTTL(maxBytes, 0)
+}
+
+// NewMemoryCacheWithTTL creates a memory cache whose entries expire after ttl.
+// A ttl of zero disables expiry.
+func NewMemoryCacheWithTTL(maxBytes int64, ttl time.Duration) Cache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// Get gets the data from memory, marking it as recently used
+func (c *MemoryCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if c.isExpired(element) {
+		c.removeElement(element)
+		return nil, nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*memoryCacheEntry).data, nil
+}
+
+// Put puts the data into memory, evicting the least recently used entries when over the size limit
+func (c *MemoryCache) Put(key string, data []byte) error {
+	return c.putAt(key, data, time.Now())
+}
+
+// putAt puts the data into memory as if it was put at putTime, which the
+// entry expires after ttl from
+func (c *MemoryCache) putAt(key string, data []byte, putTime time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+	if int64(len(data)) > c.maxBytes {
+		return nil
+	}
+	c.entries[key] = c.lru.PushFront(&memoryCacheEntry{key: key, data: data, putTime: putTime})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+	return nil
+}
+
+// Exists checks if the data exists in memory
+func (c *MemoryCache) Exists(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	return ok && !c.isExpired(element), nil
+}
+
+// Stat describes the data in memory, without marking it as recently used
+func (c *MemoryCache) Stat(key string) (CacheEntryInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok || c.isExpired(element) {
+		return CacheEntryInfo{}, nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	return CacheEntryInfo{Found: true, Size: int64(len(entry.data)), ModTime: entry.putTime}, nil
+}
+
+func (c *MemoryCache) isExpired(element *list.Element) bool {
+	return c.ttl > 0 && time.Since(element.Value.(*memoryCacheEntry).putTime) > c.ttl
+}
+
+func (c *MemoryCache) removeElement(element *list.Element) {
+	entry := c.lru.Remove(element).(*memoryCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
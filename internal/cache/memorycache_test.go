@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheEvictsOldest(t *testing.T) {
+	c := NewMemoryCache(10)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Put(key, []byte("1234")); err != nil {
+			t.Fatalf("Put(%q) returned error: %v", key, err)
+		}
+	}
+	if data, _ := c.Get("a"); data != nil {
+		t.Errorf("Get(%q) = %q, expected oldest entry to be evicted", "a", data)
+	}
+	for _, key := range []string{"b", "c"} {
+		if data, _ := c.Get(key); !bytes.Equal(data, []byte("1234")) {
+			t.Errorf("Get(%q) = %q, expected %q", key, data, "1234")
+		}
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewMemoryCache(10)
+	c.Put("a", []byte("1234"))
+	c.Put("b", []byte("1234"))
+	c.Get("a")
+	c.Put("c", []byte("1234"))
+	if exists, _ := c.Exists("b"); exists {
+		t.Errorf("Exists(%q) = true, expected least recently used entry to be evicted", "b")
+	}
+	for _, key := range []string{"a", "c"} {
+		if exists, _ := c.Exists(key); !exists {
+			t.Errorf("Exists(%q) = false, expected true", key)
+		}
+	}
+}
+
+func TestMemoryCacheStat(t *testing.T) {
+	c := NewMemoryCache(10)
+	if info, err := c.Stat("a"); err != nil || info.Found {
+		t.Errorf("Stat(%q) = %+v, %v, expected a missing entry", "a", info, err)
+	}
+	c.Put("a", []byte("1234"))
+	c.Put("b", []byte("1234"))
+	info, err := c.Stat("a")
+	if err != nil || !info.Found || info.Size != 4 || time.Since(info.ModTime) > time.Minute {
+		t.Errorf("Stat(%q) = %+v, %v, expected a 4 byte entry put now", "a", info, err)
+	}
+	// Stat doesn't mark the entry as recently used
+	c.Put("c", []byte("1234"))
+	if exists, _ := c.Exists("a"); exists {
+		t.Errorf("Exists(%q) = true, expected least recently used entry to be evicted", "a")
+	}
+}
+
+func TestMemoryCacheSkipsOversizedEntries(t *testing.T) {
+	c := NewMemoryCache(4)
+	c.Put("a", []byte("1234"))
+	c.Put("b", []byte("12345"))
+	if exists, _ := c.Exists("b"); exists {
+		t.Errorf("Exists(%q) = true, expected entry larger than the cache to be skipped", "b")
+	}
+	if exists, _ := c.Exists("a"); !exists {
+		t.Errorf("Exists(%q) = false, expected true", "a")
+	}
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	c := NewMemoryCacheWithTTL(100, time.Hour).(*MemoryCache)
+	c.Put("a", []byte("1234"))
+	c.putAt("b", []byte("1234"), time.Now().Add(-2*time.Hour))
+	if data, _ := c.Get("a"); !bytes.Equal(data, []byte("1234")) {
+		t.Errorf("Get(%q) = %q, expected %q", "a", data, "1234")
+	}
+	if data, _ := c.Get("b"); data != nil {
+		t.Errorf("Get(%q) = %q, expected the expired entry to be missing", "b", data)
+	}
+	if exists, _ := c.Exists("b"); exists {
+		t.Errorf("Exists(%q) = true, expected the expired entry to be missing", "b")
+	}
+}
+
+func TestTieredCacheExpiresCopiedEntries(t *testing.T) {
+	fast := NewMemoryCacheWithTTL(100, time.Second)
+	slow := NewFsCacheWithTTL(t.TempDir(), time.Second).(*FsCache)
+	c := NewTieredCache(fast, slow)
+	keyHashed := Sha256Hash("key")
+	if err := slow.Put(keyHashed, []byte("data")); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	// put into the slow cache shortly before it expires
+	old := time.Now().Add(-600 * time.Millisecond)
+	if err := os.Chtimes(slow.filePath(keyHashed), old, old); err != nil {
+		t.Fatalf("failed to age cache entry: %v", err)
+	}
+	if data, err := c.Get(keyHashed); err != nil || !bytes.Equal(data, []byte("data")) {
+		t.Fatalf("Get = %q, %v, expected %q", data, err, "data")
+	}
+	// the copy in the fast cache expires with the entry of the slow cache
+	time.Sleep(600 * time.Millisecond)
+	if data, err := c.Get(keyHashed); err != nil || data != nil {
+		t.Errorf("Get = %q, %v, expected the entry to be expired", data, err)
+	}
+}
+
+func TestTieredCachePopulatesFastCache(t *testing.T) {
+	fast := NewMemoryCache(100)
+	slow := NewMemoryCache(100)
+	slow.Put("a", []byte("data"))
+	c := NewTieredCache(fast, slow)
+	if data, err := c.Get("a"); err != nil || !bytes.Equal(data, []byte("data")) {
+		t.Fatalf("Get(%q) = %q, %v, expected %q", "a", data, err, "data")
+	}
+	if exists, _ := fast.Exists("a"); !exists {
+		t.Errorf("fast cache does not contain %q after a slow cache hit", "a")
+	}
+}
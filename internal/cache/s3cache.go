@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type S3Cache struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Cache(client *s3.Client, bucket string, prefix string) Cache {
+	return &S3Cache{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (c *S3Cache) objectKey(key string) string {
+	return path.Join(c.prefix, key)
+}
+
+// Get gets the object from the S3 bucket
+func (c *S3Cache) Get(key string) ([]byte, error) {
+	out, err := c.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.objectKey(key)),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// Put puts an object into the S3 bucket. Cache entries are opaque (the server
+// frames the media with its content type), so they're stored as binary data.
+func (c *S3Cache) Put(key string, data []byte) error {
+	_, err := c.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(c.bucket),
+		Key:           aws.String(c.objectKey(key)),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String("application/octet-stream"),
+	})
+	return err
+}
+
+// Exists checks if an object exists in the S3 bucket
+func (c *S3Cache) Exists(key string) (bool, error) {
+	_, err := c.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.objectKey(key)),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Stat describes an object of the S3 bucket
+func (c *S3Cache) Stat(key string) (CacheEntryInfo, error) {
+	out, err := c.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.objectKey(key)),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return CacheEntryInfo{}, nil
+		}
+		return CacheEntryInfo{}, err
+	}
+	return CacheEntryInfo{Found: true, Size: aws.ToInt64(out.ContentLength), ModTime: aws.ToTime(out.LastModified)}, nil
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// mockS3 is a minimal in-memory S3 endpoint supporting path-style GET, HEAD and PUT.
+// All objects were last modified at mockS3LastModified.
+type mockS3 struct {
+	mu           sync.Mutex
+	objects      map[string][]byte
+	contentTypes map[string]string
+}
+
+var mockS3LastModified = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		m.objects[r.URL.Path] = body
+		m.contentTypes[r.URL.Path] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		data, ok := m.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			}
+			return
+		}
+		w.Header().Set("Content-Type", m.contentTypes[r.URL.Path])
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", mockS3LastModified.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3Cache(t *testing.T) (*mockS3, Cache) {
+	mock := &mockS3{objects: map[string][]byte{}, contentTypes: map[string]string{}}
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	return mock, NewS3Cache(client, "bucket", "prefix")
+}
+
+func TestS3CacheGetMissing(t *testing.T) {
+	_, c := newTestS3Cache(t)
+	data, err := c.Get("missing")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if data != nil {
+		t.Errorf("Get(%q) = %q, expected nil", "missing", data)
+	}
+	exists, err := c.Exists("missing")
+	if err != nil {
+		t.Fatalf("Exists returned error: %v", err)
+	}
+	if exists {
+		t.Errorf("Exists(%q) = true, expected false", "missing")
+	}
+	if info, err := c.Stat("missing"); err != nil || info.Found {
+		t.Errorf("Stat(%q) = %+v, %v, expected a missing entry", "missing", info, err)
+	}
+}
+
+func TestS3CachePutGet(t *testing.T) {
+	mock, c := newTestS3Cache(t)
+	data := []byte("\x89PNG\r\n\x1a\n0000")
+	if err := c.Put("key", data); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if contentType := mock.contentTypes["/bucket/prefix/key"]; contentType != "application/octet-stream" {
+		t.Errorf("Put stored content type %q, expected %q", contentType, "application/octet-stream")
+	}
+	result, err := c.Get("key")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if !bytes.Equal(result, data) {
+		t.Errorf("Get(%q) = %q, expected %q", "key", result, data)
+	}
+	exists, err := c.Exists("key")
+	if err != nil {
+		t.Fatalf("Exists returned error: %v", err)
+	}
+	if !exists {
+		t.Errorf("Exists(%q) = false, expected true", "key")
+	}
+	info, err := c.Stat("key")
+	if err != nil {
+		t.Fatalf("Stat returned error: %v", err)
+	}
+	if expected := (CacheEntryInfo{Found: true, Size: int64(len(data)), ModTime: mockS3LastModified}); info.Found != expected.Found || info.Size != expected.Size || !info.ModTime.Equal(expected.ModTime) {
+		t.Errorf("Stat(%q) = %+v, expected %+v", "key", info, expected)
+	}
+}
+
+func TestS3CacheGetCachedOrFetch(t *testing.T) {
+	_, c := newTestS3Cache(t)
+	fetches := 0
+	fetch := func(ctx context.Context) ([]byte, error) {
+		fetches++
+		return []byte("data"), nil
+	}
+	for i := 0; i < 2; i++ {
+		data, _, err := GetCachedOrFetch(context.Background(), c, "test", "key", fetch)
+		if err != nil {
+			t.Fatalf("GetCachedOrFetch returned error: %v", err)
+		}
+		if string(data) != "data" {
+			t.Errorf("GetCachedOrFetch returned %q, expected %q", data, "data")
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetch called %d times, expected 1", fetches)
+	}
+}
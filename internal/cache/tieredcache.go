@@ -0,0 +1,72 @@
+package cache
+
+import "time"
+
+// TieredCache checks a fast cache before falling back to a slow one,
+// populating the fast cache with entries found in the slow cache.
+type TieredCache struct {
+	fast Cache
+	slow Cache
+}
+
+func NewTieredCache(fast Cache, slow Cache) Cache {
+	return &TieredCache{fast: fast, slow: slow}
+}
+
+// Get gets the data from the fast cache, or from the slow cache on a miss
+func (c *TieredCache) Get(key string) ([]byte, error) {
+	if data, err := c.fast.Get(key); err != nil {
+		return nil, err
+	} else if data != nil {
+		return data, nil
+	}
+	data, err := c.slow.Get(key)
+	if err != nil || data == nil {
+		return data, err
+	}
+	// the copy keeps the time the entry was put into the slow cache, so that
+	// it doesn't outlive the entry when the fast cache expires entries
+	if fast, ok := c.fast.(timedPutter); ok {
+		info, err := c.slow.Stat(key)
+		if err != nil {
+			return nil, err
+		}
+		if info.Found {
+			return data, fast.putAt(key, data, info.ModTime)
+		}
+	}
+	if err := c.fast.Put(key, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// timedPutter is implemented by caches that can put entries with the time they
+// were originally put, like MemoryCache
+type timedPutter interface {
+	putAt(key string, data []byte, putTime time.Time) error
+}
+
+// Put puts the data into both caches
+func (c *TieredCache) Put(key string, data []byte) error {
+	if err := c.slow.Put(key, data); err != nil {
+		return err
+	}
+	return c.fast.Put(key, data)
+}
+
+// Exists checks if the data exists in either cache
+func (c *TieredCache) Exists(key string) (bool, error) {
+	if exists, err := c.fast.Exists(key); err != nil || exists {
+		return exists, err
+	}
+	return c.slow.Exists(key)
+}
+
+// Stat describes the entry of the fast cache, or of the slow cache on a miss
+func (c *TieredCache) Stat(key string) (CacheEntryInfo, error) {
+	if info, err := c.fast.Stat(key); err != nil || info.Found {
+		return info, err
+	}
+	return c.slow.Stat(key)
+}
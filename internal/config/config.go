@@ -1,12 +1,16 @@
 package config
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/rs/zerolog/log"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/joho/godotenv"
@@ -25,25 +29,186 @@ func (b Boolean) MarshalFlag() string {
 	return strconv.FormatBool(b.Value)
 }
 
+// StringList is a list of strings set from a comma-separated flag value
+type StringList []string
+
+func (l *StringList) UnmarshalFlag(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l StringList) MarshalFlag() string {
+	return strings.Join(l, ",")
+}
+
+// HeaderMap is a map of header names to values, set from NAME=VALUE flag values
+type HeaderMap map[string]string
+
+func (m *HeaderMap) UnmarshalFlag(value string) error {
+	name, headerValue, ok := strings.Cut(value, "=")
+	if name = strings.TrimSpace(name); !ok || name == "" {
+		return fmt.Errorf("invalid header %q, expected NAME=VALUE", value)
+	}
+	if *m == nil {
+		*m = HeaderMap{}
+	}
+	(*m)[name] = strings.TrimSpace(headerValue)
+	return nil
+}
+
+func (m HeaderMap) MarshalFlag() string {
+	headers := make([]string, 0, len(m))
+	for name, value := range m {
+		headers = append(headers, name+"="+value)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ",")
+}
+
+// HexBytes is a byte slice set from a hex encoded flag value
+type HexBytes []byte
+
+func (b *HexBytes) UnmarshalFlag(value string) error {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("invalid hex value: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+func (b HexBytes) MarshalFlag() string {
+	return hex.EncodeToString(b)
+}
+
 // Config holds the runtime application config
 type Config struct {
 	Env string `long:"env" env:"GO_ENV" default:"development"`
 
 	LogLevel string `long:"log-level" env:"LOG_LEVEL" default:"info" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
 
+	OtelEndpoint string `long:"otel-endpoint" env:"OTEL_ENDPOINT" default:"" description:"OTLP HTTP endpoint to export traces to, like http://localhost:4318 (tracing is disabled when empty)"`
+
 	Config      func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
 	Host        string               `long:"host" env:"HOST" default:"localhost" description:"Host to listen on"`
 	Port        string               `long:"port" env:"PORT" default:"8080" description:"Port to listen on"`
 	MetricsPort string               `long:"metrics-port" env:"METRICS_PORT" default:"8081" description:"Metrics port to listen on"`
+	TLSCert     string               `long:"tls-cert" env:"TLS_CERT" default:"" description:"Path to the TLS certificate file (serves plain HTTP when empty)"`
+	TLSKey      string               `long:"tls-key" env:"TLS_KEY" default:"" description:"Path to the TLS private key file"`
+
+	Loader                 string        `long:"loader" env:"LOADER" default:"http" choice:"http" choice:"file" choice:"s3" description:"Loader used to fetch the original media"`
+	BaseURL                string        `long:"base-url" env:"BASE_URL" default:"" description:"Base URL"`
+	BaseURLs               StringList    `long:"base-urls" env:"BASE_URLS" default:"" description:"Comma-separated list of base URLs tried in order until one succeeds, for failover to mirrors (overrides --base-url)"`
+	AllowedUpstreamHosts   StringList    `long:"allowed-upstream-hosts" env:"ALLOWED_UPSTREAM_HOSTS" default:"" description:"Comma-separated list of upstream hostnames and CIDRs the HTTP loader may fetch from (all hosts when empty)"`
+	AllowPrivateNetworks   Boolean       `long:"allow-private-networks" env:"ALLOW_PRIVATE_NETWORKS" default:"false" description:"Allow the HTTP loader to fetch from private, loopback and link-local addresses"`
+	LoaderMaxRetries       int           `long:"loader-max-retries" env:"LOADER_MAX_RETRIES" default:"2" description:"Number of retries on upstream network errors and 5xx responses"`
+	ForwardHeaders         StringList    `long:"forward-headers" env:"FORWARD_HEADERS" default:"" description:"Comma-separated list of request headers to forward to the upstream"`
+	UpstreamUserAgent      string        `long:"upstream-user-agent" env:"UPSTREAM_USER_AGENT" default:"" description:"User-Agent of the HTTP loader's requests (overrides forwarded and static headers)"`
+	UpstreamAuthType       string        `long:"upstream-auth-type" env:"UPSTREAM_AUTH_TYPE" default:"none" choice:"none" choice:"basic" choice:"bearer" description:"Authentication of the HTTP loader's requests"`
+	UpstreamUsername       string        `long:"upstream-username" env:"UPSTREAM_USERNAME" default:"" description:"Username of the HTTP loader's basic authentication" json:"-"`
+	UpstreamPassword       string        `long:"upstream-password" env:"UPSTREAM_PASSWORD" default:"" description:"Password of the HTTP loader's basic authentication" json:"-"`
+	UpstreamToken          string        `long:"upstream-token" env:"UPSTREAM_TOKEN" default:"" description:"Token of the HTTP loader's bearer authentication" json:"-"`
+	UpstreamHeaders        HeaderMap     `long:"upstream-header" env:"UPSTREAM_HEADERS" env-delim:"\n" description:"Header set on every HTTP loader request, as NAME=VALUE (repeatable, newline-separated in the environment, overrides forwarded headers)" json:"-"`
+	FileRoot               string        `long:"file-root" env:"FILE_ROOT" default:"" description:"Root directory of the file loader"`
+	S3LoaderBucket         string        `long:"s3-loader-bucket" env:"S3_LOADER_BUCKET" default:"" description:"S3 bucket of the s3 loader"`
+	S3LoaderPrefix         string        `long:"s3-loader-prefix" env:"S3_LOADER_PREFIX" default:"" description:"Key prefix of the s3 loader"`
+	S3LoaderRegion         string        `long:"s3-loader-region" env:"S3_LOADER_REGION" default:"" description:"S3 region of the s3 loader"`
+	DataURIMaxSize         int           `long:"data-uri-max-size" env:"DATA_URI_MAX_SIZE" default:"65536" description:"Max decoded size in bytes of data: URI media paths, which are decoded instead of loaded (0 disables data URIs)"`
+	EnableLoaderCache      Boolean       `long:"enable-loader-cache" env:"ENABLE_LOADER_CACHE" default:"true" description:"Enable loader cache"`
+	EnableResultCache      Boolean       `long:"enable-result-cache" env:"ENABLE_RESULT_CACHE" default:"true" description:"Enable result cache"`
+	CacheDir               string        `long:"cache-dir" env:"CACHE_DIR" default:"/tmp/cache" description:"Cache directory"`
+	CacheTTL               time.Duration `long:"cache-ttl" env:"CACHE_TTL" default:"0" description:"Expire cache directory and in-memory result cache entries after this duration (0 disables expiry)"`
+	CacheMaxBytes          int64         `long:"cache-max-bytes" env:"CACHE_MAX_BYTES" default:"0" description:"Max size in bytes of each cache directory (original, metadata and result), evicting the least recently accessed entries down to 90% when exceeded (0 disables the limit)"`
+	NegativeCacheTTL       time.Duration `long:"negative-cache-ttl" env:"NEGATIVE_CACHE_TTL" default:"0" description:"Remember media not found upstream for this duration, responding with 404 without fetching it again (0 disables the negative cache)"`
+	MemoryCacheSize        int64         `long:"memory-cache-size" env:"MEMORY_CACHE_SIZE" default:"104857600" description:"Max size in bytes of the in-memory result cache (0 disables it)"`
+	CacheKeyIgnoreParams   StringList    `long:"cache-key-ignore-params" env:"CACHE_KEY_IGNORE_PARAMS" default:"" description:"Comma-separated list of query params (like tracking params, utm_* matches a prefix) that are ignored for the cache key and processing, but still covered by the signature"`
+	ResponseCacheControl   string        `long:"response-cache-control" env:"RESPONSE_CACHE_CONTROL" default:"public, max-age=31536000, immutable" description:"Cache-Control header of media responses, whose max-age is capped at the expiry of signed URLs (no header when empty)"`
+	MetadataCacheControl   string        `long:"metadata-cache-control" env:"METADATA_CACHE_CONTROL" default:"public, max-age=31536000, immutable" description:"Cache-Control header of metadata responses, whose max-age is capped at the expiry of signed URLs (no header when empty)"`
+	HashCacheControl       string        `long:"hash-cache-control" env:"HASH_CACHE_CONTROL" default:"public, max-age=31536000, immutable" description:"Cache-Control header of metadata responses with a blurhash or thumbhash, like no-store to keep them fresh (no header when empty)"`
+	CacheVersion           string        `long:"cache-version" env:"CACHE_VERSION" default:"" description:"Version mixed into the result and metadata cache keys and ETags; changing it reprocesses all media, leaving the old entries to expire"`
+	LoaderCacheVersion     string        `long:"loader-cache-version" env:"LOADER_CACHE_VERSION" default:"" description:"Version mixed into the loader cache keys; changing it fetches all originals again, leaving the old entries to expire"`
+	EnableUnsafe           Boolean       `long:"enable-unsafe" env:"ENABLE_UNSAFE" default:"false" description:"Enable unsafe operations"`
+	AutoAvif               Boolean       `long:"auto-avif" env:"AUTO_AVIF" default:"true" description:"Output AVIF when the client accepts it and no output format is requested"`
+	AutoWebp               Boolean       `long:"auto-webp" env:"AUTO_WEBP" default:"true" description:"Output WebP when the client accepts it and no output format is requested"`
+	Secret                 string        `long:"secret" env:"SECRET" default:"" description:"Secret"`
+	SignatureAlgorithm     string        `long:"signature-algorithm" env:"SIGNATURE_ALGORITHM" default:"sha1" choice:"sha1" choice:"sha256" description:"HMAC hash algorithm of the URL signatures"`
+	RequireSignatureExpiry Boolean       `long:"require-signature-expiry" env:"REQUIRE_SIGNATURE_EXPIRY" default:"false" description:"Reject signed URLs without an exp (unix seconds) query parameter"`
+	CORSAllowedOrigins     StringList    `long:"cors-allowed-origins" env:"CORS_ALLOWED_ORIGINS" default:"" description:"Comma-separated list of origins allowed to fetch media cross-origin, or * for all (no CORS headers when empty)"`
+	FallbackImage          string        `long:"fallback-image" env:"FALLBACK_IMAGE" default:"" description:"Path to an image served, transformed like the requested media, when fetching or processing fails (errors are responded when empty)"`
+	FallbackImageStatus    int           `long:"fallback-image-status" env:"FALLBACK_IMAGE_STATUS" default:"200" description:"Status code the fallback image is served with"`
+	DimensionHeaders       Boolean       `long:"dimension-headers" env:"DIMENSION_HEADERS" default:"false" description:"Set the X-Image-Width, X-Image-Height and X-Image-Format headers of transformed images"`
+	PassthroughUnsupported Boolean       `long:"passthrough-unsupported" env:"PASSTHROUGH_UNSUPPORTED" default:"false" description:"Serve the original media, with its detected content type, when it can't be decoded and no transform is requested"`
+
+	CompatMode   string   `long:"compat-mode" env:"COMPAT_MODE" default:"none" choice:"none" choice:"imgproxy" choice:"thumbor" description:"Also serve the URLs of another image proxy"`
+	ImgproxyKey  HexBytes `long:"imgproxy-key" env:"IMGPROXY_KEY" default:"" description:"Hex encoded key of the imgproxy URL signatures" json:"-"`
+	ImgproxySalt HexBytes `long:"imgproxy-salt" env:"IMGPROXY_SALT" default:"" description:"Hex encoded salt of the imgproxy URL signatures" json:"-"`
+	ThumborKey   string   `long:"thumbor-key" env:"THUMBOR_KEY" default:"" description:"Security key of the thumbor URL signatures" json:"-"`
 
-	BaseURL           string  `long:"base-url" env:"BASE_URL" default:"" description:"Base URL"`
-	EnableLoaderCache Boolean `long:"enable-loader-cache" env:"ENABLE_LOADER_CACHE" default:"true" description:"Enable loader cache"`
-	EnableResultCache Boolean `long:"enable-result-cache" env:"ENABLE_RESULT_CACHE" default:"true" description:"Enable result cache"`
-	CacheDir          string  `long:"cache-dir" env:"CACHE_DIR" default:"/tmp/cache" description:"Cache directory"`
-	EnableUnsafe      Boolean `long:"enable-unsafe" env:"ENABLE_UNSAFE" default:"false" description:"Enable unsafe operations"`
-	Secret            string  `long:"secret" env:"SECRET" default:"" description:"Secret"`
+	S3Bucket string `long:"s3-bucket" env:"S3_BUCKET" default:"" description:"S3 bucket to store the caches in (uses the cache directory when empty)"`
+	S3Prefix string `long:"s3-prefix" env:"S3_PREFIX" default:"" description:"Key prefix for the S3 caches"`
+	S3Region string `long:"s3-region" env:"S3_REGION" default:"" description:"S3 region"`
 
-	Concurrency int `long:"concurrency" env:"CONCURRENCY" default:"8" description:"Concurrency"`
+	Concurrency          int           `long:"concurrency" env:"CONCURRENCY" default:"8" description:"Concurrency"`
+	MaxUploadSize        int64         `long:"max-upload-size" env:"MAX_UPLOAD_SIZE" default:"10485760" description:"Max size in bytes of the images uploaded to /process (0 disables the limit)"`
+	RequestTimeout       time.Duration `long:"request-timeout" env:"REQUEST_TIMEOUT" default:"15s" description:"Max time to fetch and process the media of a request before responding with 504 (0 disables the limit)"`
+	MaxOutputWidth       int           `long:"max-output-width" env:"MAX_OUTPUT_WIDTH" default:"8192" description:"Max width of transformed images (0 disables the limit)"`
+	MaxOutputHeight      int           `long:"max-output-height" env:"MAX_OUTPUT_HEIGHT" default:"8192" description:"Max height of transformed images (0 disables the limit)"`
+	AllowedInputFormats  StringList    `long:"allowed-input-formats" env:"ALLOWED_INPUT_FORMATS" default:"" description:"Comma-separated list of source media formats that are processed: jpeg, png, gif, webp, avif, heif, svg, pdf, tiff, bmp, jp2k and magick (all when empty)"`
+	AllowedOutputFormats StringList    `long:"allowed-output-formats" env:"ALLOWED_OUTPUT_FORMATS" default:"" description:"Comma-separated list of output formats that can be requested: jpeg, png, webp, avif and gif (all when empty)"`
+	DefaultJpegQuality   int           `long:"default-jpeg-quality" env:"DEFAULT_JPEG_QUALITY" default:"0" description:"Quality of JPEG outputs when quality isn't requested (0 uses the libvips default)"`
+	DefaultWebpQuality   int           `long:"default-webp-quality" env:"DEFAULT_WEBP_QUALITY" default:"0" description:"Quality of WebP outputs when quality isn't requested (0 uses the libvips default)"`
+	DefaultAvifQuality   int           `long:"default-avif-quality" env:"DEFAULT_AVIF_QUALITY" default:"0" description:"Quality of AVIF outputs when quality isn't requested (0 uses the libvips default)"`
+	DefaultMaxDimension  int           `long:"default-max-dimension" env:"DEFAULT_MAX_DIMENSION" default:"0" description:"Downscale images whose longest side is larger when no resize is requested (0 disables it)"`
+	AutoFormatMaxColors  int           `long:"auto-format-max-colors" env:"AUTO_FORMAT_MAX_COLORS" default:"256" description:"Max number of colors of the images outputFormat=auto encodes as PNG graphics (0 treats all images as photos)"`
+	MaxDpi               int           `long:"max-dpi" env:"MAX_DPI" default:"600" description:"Max density PDFs and SVGs are rendered at with read.dpi or read.scale (0 disables the limit)"`
+	MaxMegapixels        float64       `long:"max-megapixels" env:"MAX_MEGAPIXELS" default:"100" description:"Max megapixels of the decoded images, across all their pages, rejecting larger ones with 422 (0 disables the limit)"`
+	EncodeConcurrency    int           `long:"encode-concurrency" env:"ENCODE_CONCURRENCY" default:"0" description:"Max number of images encoded at the same time, so slow encodes don't hold up cached responses (0 disables the limit)"`
+	DefaultColorProfile  string        `long:"default-colorspace" env:"DEFAULT_COLORSPACE" default:"keep" choice:"keep" choice:"srgb" description:"Color profile images are converted to when colorProfile isn't requested (keep leaves the embedded profile)"`
+
+	VipsConcurrency   int `long:"vips-concurrency" env:"VIPS_CONCURRENCY" default:"4" description:"Number of threads libvips uses per image operation"`
+	VipsMaxCacheMem   int `long:"vips-max-cache-mem" env:"VIPS_MAX_CACHE_MEM" default:"52428800" description:"Max memory in bytes of the libvips operation cache"`
+	VipsMaxCacheSize  int `long:"vips-max-cache-size" env:"VIPS_MAX_CACHE_SIZE" default:"100" description:"Max number of operations in the libvips operation cache"`
+	VipsMaxCacheFiles int `long:"vips-max-cache-files" env:"VIPS_MAX_CACHE_FILES" default:"0" description:"Max number of open files in the libvips operation cache"`
+}
+
+// dotenvKeys are the environment variables set from the .env files by the last loadDotenv
+var dotenvKeys = map[string]bool{}
+
+// loadDotenv sets the environment variables of the .env files, the earlier
+// files taking precedence. Unlike godotenv.Load, the files are re-read on
+// every call so that edits are picked up on reload, while variables of the
+// process environment still take precedence over them.
+func loadDotenv(filenames ...string) {
+	env := map[string]string{}
+	for _, filename := range filenames {
+		values, err := godotenv.Read(filename)
+		if err != nil {
+			continue
+		}
+		for key, value := range values {
+			if _, ok := env[key]; !ok {
+				env[key] = value
+			}
+		}
+	}
+	for key := range dotenvKeys {
+		if _, ok := env[key]; !ok {
+			os.Unsetenv(key)
+			delete(dotenvKeys, key)
+		}
+	}
+	for key, value := range env {
+		if _, ok := os.LookupEnv(key); ok && !dotenvKeys[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		dotenvKeys[key] = true
+	}
 }
 
 // ParseConfig parses and validates provided configuration into a config object
@@ -57,12 +222,12 @@ func ParseConfig(args []string) (*Config, error) {
 		config.Env = "development"
 	}
 
-	_ = godotenv.Load(".env." + config.Env + ".local")
+	dotenvFiles := []string{".env." + config.Env + ".local"}
 	if config.Env != "test" {
-		_ = godotenv.Load(".env.local")
+		dotenvFiles = append(dotenvFiles, ".env.local")
 	}
-	_ = godotenv.Load(".env." + config.Env)
-	_ = godotenv.Load() // The Original .env
+	dotenvFiles = append(dotenvFiles, ".env."+config.Env, ".env") // The Original .env
+	loadDotenv(dotenvFiles...)
 
 	c := &Config{}
 
@@ -71,19 +236,107 @@ func ParseConfig(args []string) (*Config, error) {
 		return c, err
 	}
 
-	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
-	if c.BaseURL != "" {
-		c.BaseURL = c.BaseURL + "/"
+	if len(c.BaseURLs) > 0 {
+		c.BaseURL = c.BaseURLs[0]
+	}
+	c.BaseURL = normalizeBaseURL(c.BaseURL)
+	for i, baseURL := range c.BaseURLs {
+		c.BaseURLs[i] = normalizeBaseURL(baseURL)
 	}
 	if !c.EnableUnsafe.Value {
 		if c.Secret == "" {
-			log.Fatal().Msg("SECRET must be set when ENABLE_UNSAFE=false")
+			return c, errors.New("SECRET must be set when ENABLE_UNSAFE=false")
 		}
 	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return c, errors.New("TLS_CERT and TLS_KEY must be set together")
+	}
+	if c.Loader == "file" && c.FileRoot == "" {
+		return c, errors.New("FILE_ROOT must be set when LOADER=file")
+	}
+	if c.Loader == "s3" && c.S3LoaderBucket == "" {
+		return c, errors.New("S3_LOADER_BUCKET must be set when LOADER=s3")
+	}
+	if c.UpstreamAuthType == "basic" && c.UpstreamUsername == "" {
+		return c, errors.New("UPSTREAM_USERNAME must be set when UPSTREAM_AUTH_TYPE=basic")
+	}
+	if c.UpstreamAuthType == "bearer" && c.UpstreamToken == "" {
+		return c, errors.New("UPSTREAM_TOKEN must be set when UPSTREAM_AUTH_TYPE=bearer")
+	}
+	if c.FallbackImageStatus < 200 || c.FallbackImageStatus > 599 {
+		return c, errors.New("FALLBACK_IMAGE_STATUS must be a status code between 200 and 599")
+	}
+	for _, format := range c.AllowedInputFormats {
+		switch format {
+		case "jpeg", "png", "gif", "webp", "avif", "heif", "svg", "pdf", "tiff", "bmp", "jp2k", "magick":
+		default:
+			return c, fmt.Errorf("ALLOWED_INPUT_FORMATS has an unsupported format: %q", format)
+		}
+	}
+	for _, format := range c.AllowedOutputFormats {
+		switch format {
+		case "jpeg", "png", "webp", "avif", "gif":
+		default:
+			return c, fmt.Errorf("ALLOWED_OUTPUT_FORMATS has an unsupported format: %q", format)
+		}
+	}
+	for name, quality := range map[string]int{"DEFAULT_JPEG_QUALITY": c.DefaultJpegQuality, "DEFAULT_WEBP_QUALITY": c.DefaultWebpQuality, "DEFAULT_AVIF_QUALITY": c.DefaultAvifQuality} {
+		if quality < 0 || quality > 100 {
+			return c, fmt.Errorf("%s must be between 1 and 100, or 0 for the libvips default", name)
+		}
+	}
+	if c.CompatMode == "imgproxy" && !c.EnableUnsafe.Value && (len(c.ImgproxyKey) == 0 || len(c.ImgproxySalt) == 0) {
+		return c, errors.New("IMGPROXY_KEY and IMGPROXY_SALT must be set when COMPAT_MODE=imgproxy and ENABLE_UNSAFE=false")
+	}
+	if c.CompatMode == "thumbor" && !c.EnableUnsafe.Value && c.ThumborKey == "" {
+		return c, errors.New("THUMBOR_KEY must be set when COMPAT_MODE=thumbor and ENABLE_UNSAFE=false")
+	}
+	if c.RequestTimeout < 0 {
+		return c, errors.New("REQUEST_TIMEOUT must not be negative")
+	}
+	if c.CacheMaxBytes < 0 {
+		return c, errors.New("CACHE_MAX_BYTES must not be negative")
+	}
+	if c.NegativeCacheTTL < 0 {
+		return c, errors.New("NEGATIVE_CACHE_TTL must not be negative")
+	}
+	if c.MaxUploadSize < 0 {
+		return c, errors.New("MAX_UPLOAD_SIZE must not be negative")
+	}
+	if c.DataURIMaxSize < 0 {
+		return c, errors.New("DATA_URI_MAX_SIZE must not be negative")
+	}
+	if c.DefaultMaxDimension < 0 {
+		return c, errors.New("DEFAULT_MAX_DIMENSION must not be negative")
+	}
+	if c.AutoFormatMaxColors < 0 {
+		return c, errors.New("AUTO_FORMAT_MAX_COLORS must not be negative")
+	}
+	if c.MaxMegapixels < 0 {
+		return c, errors.New("MAX_MEGAPIXELS must not be negative")
+	}
+	if c.EncodeConcurrency < 0 {
+		return c, errors.New("ENCODE_CONCURRENCY must not be negative")
+	}
+	if c.VipsConcurrency < 1 {
+		return c, errors.New("VIPS_CONCURRENCY must be at least 1")
+	}
+	if c.VipsMaxCacheMem < 0 || c.VipsMaxCacheSize < 0 || c.VipsMaxCacheFiles < 0 {
+		return c, errors.New("VIPS_MAX_CACHE_MEM, VIPS_MAX_CACHE_SIZE and VIPS_MAX_CACHE_FILES must not be negative")
+	}
 
 	return c, nil
 }
 
+// normalizeBaseURL returns the base URL with a single trailing slash
+func normalizeBaseURL(baseURL string) string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if baseURL != "" {
+		baseURL = baseURL + "/"
+	}
+	return baseURL
+}
+
 func (c *Config) parseFlags(args []string) error {
 	p := flags.NewParser(c, flags.Default)
 
@@ -115,6 +368,41 @@ func (c *Config) Validate() {
 	// Check for show stopper errors
 }
 
+// reloadableFields are the fields that are applied on SIGHUP, without a restart
+var reloadableFields = map[string]bool{
+	"Secret":               true,
+	"SignatureAlgorithm":   true,
+	"AllowedInputFormats":  true,
+	"AllowedOutputFormats": true,
+	"DefaultJpegQuality":   true,
+	"DefaultWebpQuality":   true,
+	"DefaultAvifQuality":   true,
+	"DefaultColorProfile":  true,
+	"MaxOutputWidth":       true,
+	"MaxOutputHeight":      true,
+	"MaxDpi":               true,
+	"MaxMegapixels":        true,
+	"DefaultMaxDimension":  true,
+	"AutoFormatMaxColors":  true,
+}
+
+// NonReloadableChanges returns the flags whose values differ in other and
+// need a restart to be applied
+func (c *Config) NonReloadableChanges(other *Config) []string {
+	current, updated := reflect.ValueOf(c).Elem(), reflect.ValueOf(other).Elem()
+	var changed []string
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		if reloadableFields[field.Name] || field.Type.Kind() == reflect.Func {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			changed = append(changed, "--"+field.Tag.Get("long"))
+		}
+	}
+	return changed
+}
+
 func (c Config) String() string {
 	jsonConf, _ := json.Marshal(c)
 	return string(jsonConf)
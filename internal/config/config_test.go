@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNonReloadableChanges(t *testing.T) {
+	current := &Config{Port: "8080", Secret: "old", DefaultJpegQuality: 80, AllowedOutputFormats: StringList{"jpeg"}}
+	updated := &Config{Port: "8080", Secret: "new", DefaultJpegQuality: 90, AllowedOutputFormats: StringList{"jpeg", "webp"}}
+	if changed := current.NonReloadableChanges(updated); len(changed) != 0 {
+		t.Errorf("NonReloadableChanges with reloadable changes returned %v, expected none", changed)
+	}
+
+	updated.Port = "9090"
+	updated.EnableUnsafe = Boolean{true}
+	expected := []string{"--port", "--enable-unsafe"}
+	if changed := current.NonReloadableChanges(updated); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("NonReloadableChanges returned %v, expected %v", changed, expected)
+	}
+}
+
+func TestParseConfigRereadsDotenv(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get the working directory: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("failed to change the working directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("GO_ENV", "test")
+	t.Setenv("DEFAULT_WEBP_QUALITY", "50")
+	t.Cleanup(func() { loadDotenv() })
+
+	for _, quality := range []int{70, 60} {
+		dotenv := fmt.Sprintf("DEFAULT_JPEG_QUALITY=%d\nDEFAULT_WEBP_QUALITY=%d\n", quality, quality)
+		if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(dotenv), 0644); err != nil {
+			t.Fatalf("failed to write .env: %v", err)
+		}
+		c, err := ParseConfig([]string{"--enable-unsafe=true"})
+		if err != nil {
+			t.Fatalf("ParseConfig returned error: %v", err)
+		}
+		if c.DefaultJpegQuality != quality {
+			t.Errorf("ParseConfig returned JPEG quality %d, expected %d from .env", c.DefaultJpegQuality, quality)
+		}
+		// the process environment takes precedence
+		if c.DefaultWebpQuality != 50 {
+			t.Errorf("ParseConfig returned WebP quality %d, expected %d from the environment", c.DefaultWebpQuality, 50)
+		}
+	}
+}
+
+func TestParseConfigFallbackImageStatus(t *testing.T) {
+	tests := []struct {
+		status      string
+		expectedErr bool
+	}{
+		{"200", false},
+		{"503", false},
+		{"99", true},
+		{"600", true},
+	}
+	for _, test := range tests {
+		_, err := ParseConfig([]string{"--enable-unsafe=true", "--fallback-image-status=" + test.status})
+		if (err != nil) != test.expectedErr {
+			t.Errorf("ParseConfig with fallback image status %s returned error %v, expected error: %v", test.status, err, test.expectedErr)
+		}
+	}
+}
+
+func TestParseConfigUpstreamHeaders(t *testing.T) {
+	c, err := ParseConfig([]string{"--enable-unsafe=true", "--upstream-header=Authorization=Bearer a=b", "--upstream-header=X-Api-Key=key"})
+	if err != nil {
+		t.Fatalf("ParseConfig returned error: %v", err)
+	}
+	expected := HeaderMap{"Authorization": "Bearer a=b", "X-Api-Key": "key"}
+	if !reflect.DeepEqual(c.UpstreamHeaders, expected) {
+		t.Errorf("ParseConfig returned upstream headers %v, expected %v", c.UpstreamHeaders, expected)
+	}
+	// header values may contain commas
+	t.Setenv("UPSTREAM_HEADERS", "Accept=image/webp, image/png\nX-Api-Key=key")
+	c, err = ParseConfig([]string{"--enable-unsafe=true"})
+	if err != nil {
+		t.Fatalf("ParseConfig returned error: %v", err)
+	}
+	expected = HeaderMap{"Accept": "image/webp, image/png", "X-Api-Key": "key"}
+	if !reflect.DeepEqual(c.UpstreamHeaders, expected) {
+		t.Errorf("ParseConfig returned upstream headers %v from the environment, expected %v", c.UpstreamHeaders, expected)
+	}
+	if _, err := ParseConfig([]string{"--enable-unsafe=true", "--upstream-header=Authorization"}); err == nil {
+		t.Errorf("ParseConfig with an upstream header without a value returned no error")
+	}
+}
@@ -0,0 +1,94 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidDataURI is returned by the DataURILoader when a data: media path
+// can't be decoded or its payload is too large.
+var ErrInvalidDataURI = errors.New("invalid data URI")
+
+// DataURILoader decodes data: media paths (RFC 2397) like
+// data:image/png;base64,iVBORw0KGgo... directly, and loads other media
+// paths with the next loader.
+type DataURILoader struct {
+	next Loader
+	// maxSize is the maximum size of the decoded payload
+	maxSize int
+}
+
+func NewDataURILoader(next Loader, maxSize int) *DataURILoader {
+	return &DataURILoader{next: next, maxSize: maxSize}
+}
+
+func (l *DataURILoader) GetMedia(ctx context.Context, mediaPath string, header http.Header) (*Media, error) {
+	if !isDataURI(mediaPath) {
+		return l.next.GetMedia(ctx, mediaPath, header)
+	}
+	data, contentType, err := l.decode(mediaPath)
+	if err != nil {
+		return nil, err
+	}
+	loaderResponseSize.Observe(float64(len(data)))
+	return &Media{Data: data, ContentType: contentType}, nil
+}
+
+func (l *DataURILoader) StreamMedia(ctx context.Context, mediaPath string, header http.Header) (*MediaStream, error) {
+	if !isDataURI(mediaPath) {
+		return l.next.StreamMedia(ctx, mediaPath, header)
+	}
+	data, contentType, err := l.decode(mediaPath)
+	if err != nil {
+		return nil, err
+	}
+	return &MediaStream{Body: io.NopCloser(bytes.NewReader(data)), ContentType: contentType, ContentLength: int64(len(data))}, nil
+}
+
+func isDataURI(mediaPath string) bool {
+	return len(mediaPath) >= 5 && strings.EqualFold(mediaPath[:5], "data:")
+}
+
+// decode returns the payload and the media type (without its parameters) of
+// the data URI. The media type is empty when the URI doesn't have one.
+func (l *DataURILoader) decode(dataURI string) ([]byte, string, error) {
+	header, payload, ok := strings.Cut(dataURI[5:], ",")
+	if !ok {
+		return nil, "", fmt.Errorf("%w: missing comma", ErrInvalidDataURI)
+	}
+	// the media path is already unescaped by the router, so percent-encoded
+	// payloads arrive decoded and must not be unescaped a second time
+	mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+	var data []byte
+	var err error
+	if isBase64 {
+		// the padding is optional, and the base64 is checked against the limit before decoding it
+		payload = strings.TrimRight(payload, "=")
+		if base64.RawStdEncoding.DecodedLen(len(payload)) > l.maxSize {
+			return nil, "", fmt.Errorf("%w: payload larger than %d bytes", ErrInvalidDataURI, l.maxSize)
+		}
+		data, err = base64.RawStdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %w", ErrInvalidDataURI, err)
+		}
+	} else {
+		if len(payload) > l.maxSize {
+			return nil, "", fmt.Errorf("%w: payload larger than %d bytes", ErrInvalidDataURI, l.maxSize)
+		}
+		data = []byte(payload)
+	}
+	if mediaType != "" {
+		mediaType, _, err = mime.ParseMediaType(mediaType)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %w", ErrInvalidDataURI, err)
+		}
+	}
+	return data, mediaType, nil
+}
@@ -0,0 +1,63 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataURILoader(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.png"), []byte("file"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	l := NewDataURILoader(NewFileLoader(root), 8)
+	tests := []struct {
+		mediaPath           string
+		expected            string
+		expectedContentType string
+	}{
+		{"data:image/png;base64,ZGF0YQ==", "data", "image/png"},
+		{"data:image/png;base64,ZGF0YQ", "data", "image/png"},
+		{"DATA:image/svg+xml;charset=utf-8;base64,ZGF0YQ==", "data", "image/svg+xml"},
+		{"data:text/plain,a b", "a b", "text/plain"},
+		{"data:,data", "data", ""},
+		{"data:text/plain,100%25", "100%25", "text/plain"},
+		{"a.png", "file", "image/png"},
+	}
+	for _, test := range tests {
+		media, err := l.GetMedia(context.Background(), test.mediaPath, nil)
+		if err != nil {
+			t.Errorf("GetMedia(%q) returned error: %v", test.mediaPath, err)
+			continue
+		}
+		if string(media.Data) != test.expected || media.ContentType != test.expectedContentType {
+			t.Errorf("GetMedia(%q) = %q (%s), expected %q (%s)", test.mediaPath, media.Data, media.ContentType, test.expected, test.expectedContentType)
+		}
+	}
+
+	for _, mediaPath := range []string{
+		"data:image/png;base64",
+		"data:image/png;base64,!!!!",
+		"data:image/png;base64,ZGF0YWRhdGFkYXRh",
+		"data:text/plain,datadatadata",
+		"data:image/png;x=\"a;base64,ZGF0YQ==",
+	} {
+		if _, err := l.GetMedia(context.Background(), mediaPath, nil); !errors.Is(err, ErrInvalidDataURI) {
+			t.Errorf("GetMedia(%q) returned error %v, expected %v", mediaPath, err, ErrInvalidDataURI)
+		}
+	}
+
+	stream, err := l.StreamMedia(context.Background(), "data:image/png;base64,ZGF0YQ==", nil)
+	if err != nil {
+		t.Fatalf("StreamMedia returned error: %v", err)
+	}
+	defer stream.Body.Close()
+	data, err := io.ReadAll(stream.Body)
+	if err != nil || string(data) != "data" || stream.ContentLength != 4 || stream.ContentType != "image/png" {
+		t.Errorf("StreamMedia = %q (%s, %d bytes), expected %q (%s, %d bytes)", data, stream.ContentType, stream.ContentLength, "data", "image/png", 4)
+	}
+}
@@ -0,0 +1,65 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type FileLoader struct {
+	root string
+}
+
+func NewFileLoader(root string) *FileLoader {
+	return &FileLoader{root: root}
+}
+
+func (l *FileLoader) GetMedia(ctx context.Context, mediaPath string, header http.Header) (*Media, error) {
+	filePath, err := l.filePath(mediaPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrUpstreamNotFound, mediaPath)
+		}
+		return nil, fmt.Errorf("failed to read media file: %w", err)
+	}
+	loaderResponseSize.Observe(float64(len(data)))
+	return &Media{Data: data, ContentType: mime.TypeByExtension(filepath.Ext(filePath))}, nil
+}
+
+func (l *FileLoader) StreamMedia(ctx context.Context, mediaPath string, header http.Header) (*MediaStream, error) {
+	filePath, err := l.filePath(mediaPath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrUpstreamNotFound, mediaPath)
+		}
+		return nil, fmt.Errorf("failed to open media file: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat media file: %w", err)
+	}
+	return &MediaStream{Body: file, ContentType: mime.TypeByExtension(filepath.Ext(filePath)), ContentLength: stat.Size()}, nil
+}
+
+// filePath returns the path of mediaPath under the root, rejecting path traversal
+func (l *FileLoader) filePath(mediaPath string) (string, error) {
+	for _, segment := range strings.Split(filepath.ToSlash(mediaPath), "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("invalid media path %q: path traversal is not allowed", mediaPath)
+		}
+	}
+	return filepath.Join(l.root, filepath.FromSlash(mediaPath)), nil
+}
@@ -0,0 +1,34 @@
+package loader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLoader(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "images"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "images", "a.png"), []byte("data"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	l := NewFileLoader(root)
+
+	media, err := l.GetMedia(context.Background(), "images/a.png", nil)
+	if err != nil {
+		t.Errorf("GetMedia(%q) returned error: %v", "images/a.png", err)
+	} else if string(media.Data) != "data" || media.ContentType != "image/png" {
+		t.Errorf("GetMedia(%q) = %q (%s), expected %q (%s)", "images/a.png", media.Data, media.ContentType, "data", "image/png")
+	}
+	if _, err := l.GetMedia(context.Background(), "images/missing.png", nil); err == nil {
+		t.Errorf("GetMedia(%q) returned no error for a missing file", "images/missing.png")
+	}
+	for _, mediaPath := range []string{"../secret", "images/../../secret", ".."} {
+		if _, err := l.GetMedia(context.Background(), mediaPath, nil); err == nil {
+			t.Errorf("GetMedia(%q) returned no error for a path traversal", mediaPath)
+		}
+	}
+}
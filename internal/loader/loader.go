@@ -2,8 +2,11 @@ package loader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -11,6 +14,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -24,61 +32,316 @@ var (
 		Help:    "Loader response size in bytes",
 		Buckets: []float64{100, 500, 1000, 5000, 10000, 50000, 100000},
 	})
+	loaderRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "media_proxy_loader_retries_total",
+		Help: "Number of retried upstream requests",
+	})
+	loaderUpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "media_proxy_loader_upstream_errors_total",
+		Help: "Number of failed fetches per upstream base URL host",
+	}, []string{"host"})
+)
+
+var tracer = otel.Tracer("github.com/blesswinsamuel/media-proxy/internal/loader")
+
+var (
+	// ErrUpstreamNotFound is returned by loaders when the requested media doesn't exist upstream.
+	ErrUpstreamNotFound = errors.New("upstream media not found")
+	// ErrUpstreamBadStatus is returned by loaders when the upstream responds with an unexpected status.
+	ErrUpstreamBadStatus = errors.New("unexpected upstream status")
+	// ErrUpstreamNotAllowed is returned by loaders when the upstream host or address is not allowed.
+	ErrUpstreamNotAllowed = errors.New("upstream not allowed")
+	// ErrNotModified is returned by loaders when a conditional request (with
+	// If-None-Match or If-Modified-Since) finds the media unchanged.
+	ErrNotModified = errors.New("upstream media not modified")
 )
 
+// Media is the original media fetched by a loader
+type Media struct {
+	Data []byte
+	// ContentType is the content type reported by the upstream, empty when unknown
+	ContentType string
+	// ETag and LastModified are the upstream's validators of the media, used to
+	// revalidate it with a conditional request. They are empty when unknown.
+	ETag         string
+	LastModified string
+}
+
+// MediaStream is original media whose data is read from the upstream while
+// it's being sent. Body must be closed by the caller.
+type MediaStream struct {
+	Body io.ReadCloser
+	// ContentType is the content type reported by the upstream, empty when unknown
+	ContentType string
+	// ContentLength is the size of the data, -1 when unknown
+	ContentLength int64
+}
+
 type Loader interface {
-	GetMedia(ctx context.Context, key string) ([]byte, error)
+	// GetMedia fetches the media at mediaPath. header holds request headers
+	// that should be forwarded upstream, where supported.
+	GetMedia(ctx context.Context, mediaPath string, header http.Header) (*Media, error)
+	// StreamMedia opens the media at mediaPath for reading, without buffering it.
+	StreamMedia(ctx context.Context, mediaPath string, header http.Header) (*MediaStream, error)
+}
+
+type HTTPLoaderConfig struct {
+	BaseURL string
+	// MirrorBaseURLs are tried in order when fetching from BaseURL fails
+	MirrorBaseURLs []string
+	// MaxRetries is the number of times a request is retried on network errors and 5xx responses
+	MaxRetries int
+	// AllowedHosts lists the hostnames and CIDRs the loader may fetch from. All hosts are allowed when empty.
+	AllowedHosts []string
+	// AllowPrivateNetworks allows fetching from private, loopback and link-local addresses
+	AllowPrivateNetworks bool
+	// UserAgent is the User-Agent of upstream requests. Go's default is used when empty.
+	UserAgent string
+	// Headers are set on every upstream request. They take precedence over the
+	// forwarded request headers, and UserAgent takes precedence over both.
+	Headers map[string]string
+	// AuthType sets the Authorization header of upstream requests: basic (with
+	// Username and Password) or bearer (with Token). It takes precedence over Headers.
+	AuthType string
+	Username string
+	Password string
+	Token    string
 }
 
 type HTTPLoader struct {
-	baseURL string
-	client  *http.Client
+	config HTTPLoaderConfig
+	client *http.Client
+	guard  *upstreamGuard
 }
 
-func NewHTTPLoader(baseURL string) *HTTPLoader {
+func NewHTTPLoader(config HTTPLoaderConfig) (*HTTPLoader, error) {
+	switch config.AuthType {
+	case "", "basic", "bearer":
+	default:
+		return nil, fmt.Errorf("invalid upstream auth type: %q", config.AuthType)
+	}
+	guard, err := newUpstreamGuard(config.AllowedHosts, config.AllowPrivateNetworks)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   guard.dialControl,
+	}
 	return &HTTPLoader{
-		baseURL: baseURL,
+		config: config,
 		client: &http.Client{
-			Timeout:   20 * time.Second,
-			Transport: &http.Transport{},
+			Timeout:       20 * time.Second,
+			Transport:     &http.Transport{DialContext: dialer.DialContext},
+			CheckRedirect: guard.checkRedirect,
 		},
+		guard: guard,
+	}, nil
+}
+
+func (l *HTTPLoader) GetMedia(ctx context.Context, mediaPath string, header http.Header) (*Media, error) {
+	ctx, span := tracer.Start(ctx, "HTTPLoader.GetMedia", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	return failover(ctx, l.baseURLs(), func(baseURL string) (*Media, error) {
+		return l.getMedia(ctx, span, baseURL, mediaPath, header)
+	})
+}
+
+func (l *HTTPLoader) getMedia(ctx context.Context, span trace.Span, baseURL string, mediaPath string, header http.Header) (*Media, error) {
+	upstreamURL, err := l.upstreamURL(baseURL, mediaPath)
+	if err != nil {
+		return nil, err
 	}
+	span.SetAttributes(attribute.String("http.url", upstreamURL.String()))
+
+	for attempt := 0; ; attempt++ {
+		media, statusCode, err := l.fetch(ctx, upstreamURL, header)
+		span.SetAttributes(attribute.Int("http.status_code", statusCode), attribute.Int("loader.attempts", attempt+1))
+		if err == nil || errors.Is(err, ErrNotModified) {
+			return media, err
+		}
+		// retry only on network errors and 5xx responses
+		retryable := statusCode >= 500 || (statusCode == 0 && ctx.Err() == nil && !errors.Is(err, ErrUpstreamNotAllowed))
+		if !retryable || attempt >= l.config.MaxRetries {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to fetch from upstream")
+			return nil, err
+		}
+		backoff := retryBackoff(attempt)
+		log.Debug().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msgf("Retrying fetch from %s", upstreamURL.String())
+		loaderRetries.Inc()
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// StreamMedia sends a single request to the upstream and returns its response
+// body without reading it. Failed requests aren't retried.
+func (l *HTTPLoader) StreamMedia(ctx context.Context, mediaPath string, header http.Header) (*MediaStream, error) {
+	ctx, span := tracer.Start(ctx, "HTTPLoader.StreamMedia", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	return failover(ctx, l.baseURLs(), func(baseURL string) (*MediaStream, error) {
+		return l.streamMedia(ctx, span, baseURL, mediaPath, header)
+	})
 }
 
-func (l *HTTPLoader) GetMedia(ctx context.Context, mediaPath string) ([]byte, error) {
-	upstreamURL, err := url.Parse(fmt.Sprintf("%s%s", l.baseURL, mediaPath))
+func (l *HTTPLoader) streamMedia(ctx context.Context, span trace.Span, baseURL string, mediaPath string, header http.Header) (*MediaStream, error) {
+	upstreamURL, err := l.upstreamURL(baseURL, mediaPath)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("http.url", upstreamURL.String()))
+	startTime := time.Now()
+	resp, statusCode, err := l.request(ctx, upstreamURL, header)
+	loaderDuration.WithLabelValues(fmt.Sprintf("%d", statusCode)).Observe(time.Since(startTime).Seconds())
+	span.SetAttributes(attribute.Int("http.status_code", statusCode))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to fetch from upstream")
+		return nil, err
+	}
+	return &MediaStream{Body: resp.Body, ContentType: resp.Header.Get("Content-Type"), ContentLength: resp.ContentLength}, nil
+}
+
+// baseURLs returns the base URLs in the order they're tried
+func (l *HTTPLoader) baseURLs() []string {
+	return append([]string{l.config.BaseURL}, l.config.MirrorBaseURLs...)
+}
+
+// failover calls fetch with each base URL in order until one succeeds. When
+// all of them fail, ErrUpstreamNotFound is returned if the media wasn't found
+// on any of them, and ErrUpstreamBadStatus otherwise.
+func failover[T any](ctx context.Context, baseURLs []string, fetch func(baseURL string) (T, error)) (T, error) {
+	var errs []error
+	for _, baseURL := range baseURLs {
+		result, err := fetch(baseURL)
+		if err == nil || errors.Is(err, ErrNotModified) {
+			return result, err
+		}
+		host := ""
+		if u, parseErr := url.Parse(baseURL); parseErr == nil {
+			host = u.Host
+		}
+		loaderUpstreamErrors.WithLabelValues(host).Inc()
+		if len(baseURLs) == 1 {
+			return result, err
+		}
+		log.Debug().Err(err).Msgf("Failed to fetch from %s", baseURL)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			// the remaining base URLs can't be tried
+			return result, err
+		}
+	}
+	var zero T
+	notFound := len(errs) == len(baseURLs)
+	for _, err := range errs {
+		notFound = notFound && errors.Is(err, ErrUpstreamNotFound)
+	}
+	if notFound {
+		return zero, fmt.Errorf("%w on all upstreams: %v", ErrUpstreamNotFound, errors.Join(errs...))
+	}
+	return zero, fmt.Errorf("%w: all upstreams failed: %v", ErrUpstreamBadStatus, errors.Join(errs...))
+}
+
+// upstreamURL returns the URL of mediaPath, checking that its host is allowed
+func (l *HTTPLoader) upstreamURL(baseURL string, mediaPath string) (*url.URL, error) {
+	upstreamURL, err := url.Parse(fmt.Sprintf("%s%s", baseURL, mediaPath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
 	}
+	if err := l.guard.checkHost(upstreamURL.Hostname()); err != nil {
+		return nil, err
+	}
+	return upstreamURL, nil
+}
 
+// retryBackoff returns an exponential backoff with full jitter for the given attempt
+func retryBackoff(attempt int) time.Duration {
+	backoff := 100 * time.Millisecond << attempt
+	if backoff > 5*time.Second || backoff <= 0 {
+		backoff = 5 * time.Second
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+func (l *HTTPLoader) fetch(ctx context.Context, upstreamURL *url.URL, header http.Header) (*Media, int, error) {
 	startTime := time.Now()
 	statusCode := 0
 	defer func() {
 		loaderDuration.WithLabelValues(fmt.Sprintf("%d", statusCode)).Observe(time.Since(startTime).Seconds())
 	}()
+	resp, statusCode, err := l.request(ctx, upstreamURL, header)
+	if err != nil {
+		return nil, statusCode, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read response body: %w", err)
+	}
+	loaderResponseSize.Observe(float64(len(bodyBytes)))
+	return &Media{
+		Data:         bodyBytes,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, statusCode, nil
+}
+
+// request sends a GET request to the upstream. The response is only returned
+// for 200 responses, and its body must be closed by the caller. 304 responses
+// to conditional requests return ErrNotModified.
+func (l *HTTPLoader) request(ctx context.Context, upstreamURL *url.URL, header http.Header) (*http.Response, int, error) {
 	log.Debug().Msgf("Fetching image from %s", upstreamURL.String())
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	for name, value := range l.config.Headers {
+		req.Header.Set(name, value)
 	}
+	switch l.config.AuthType {
+	case "basic":
+		req.SetBasicAuth(l.config.Username, l.config.Password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+l.config.Token)
+	}
+	if l.config.UserAgent != "" {
+		req.Header.Set("User-Agent", l.config.UserAgent)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	resp, err := l.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch image: %w", err)
+		return nil, 0, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	statusCode := resp.StatusCode
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, statusCode, ErrNotModified
 	}
-	defer resp.Body.Close()
-	statusCode = resp.StatusCode
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
 			body = []byte(fmt.Sprintf("failed to read response body: %s", resp.Status))
 		}
-		return nil, fmt.Errorf("failed to fetch image: %s. Body: %q", resp.Status, body)
-	}
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, statusCode, fmt.Errorf("%w: %s. Body: %q", ErrUpstreamNotFound, resp.Status, body)
+		}
+		return nil, statusCode, fmt.Errorf("%w: %s. Body: %q", ErrUpstreamBadStatus, resp.Status, body)
 	}
-	loaderResponseSize.Observe(float64(len(bodyBytes)))
-	return bodyBytes, nil
+	return resp, statusCode, nil
 }
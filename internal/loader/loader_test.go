@@ -0,0 +1,290 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPLoaderForwardsHeaders(t *testing.T) {
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+	l, err := NewHTTPLoader(HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+
+	header := http.Header{"X-Tenant": []string{"acme"}}
+	if _, err := l.GetMedia(context.Background(), "ok.png", header); err != nil {
+		t.Fatalf("GetMedia returned error: %v", err)
+	}
+	if tenant := received.Get("X-Tenant"); tenant != "acme" {
+		t.Errorf("upstream received X-Tenant %q, expected %q", tenant, "acme")
+	}
+}
+
+func TestHTTPLoaderSetsUpstreamHeaders(t *testing.T) {
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+	l, err := NewHTTPLoader(HTTPLoaderConfig{
+		BaseURL:              srv.URL + "/",
+		AllowPrivateNetworks: true,
+		UserAgent:            "media-proxy",
+		Headers:              map[string]string{"Authorization": "Bearer token", "User-Agent": "static"},
+	})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+
+	header := http.Header{"Authorization": []string{"Bearer client"}, "X-Tenant": []string{"acme"}}
+	for name, get := range map[string]func() error{
+		"GetMedia": func() error {
+			_, err := l.GetMedia(context.Background(), "ok.png", header)
+			return err
+		},
+		"StreamMedia": func() error {
+			stream, err := l.StreamMedia(context.Background(), "ok.png", header)
+			if err == nil {
+				stream.Body.Close()
+			}
+			return err
+		},
+	} {
+		if err := get(); err != nil {
+			t.Fatalf("%s returned error: %v", name, err)
+		}
+		expected := map[string]string{"User-Agent": "media-proxy", "Authorization": "Bearer token", "X-Tenant": "acme"}
+		for key, value := range expected {
+			if got := received.Values(key); len(got) != 1 || got[0] != value {
+				t.Errorf("%s sent %s %q upstream, expected %q", name, key, got, value)
+			}
+		}
+	}
+}
+
+func TestHTTPLoaderUpstreamErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("data"))
+		case "/error.png":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	l, err := NewHTTPLoader(HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+
+	if media, err := l.GetMedia(context.Background(), "ok.png", nil); err != nil {
+		t.Errorf("GetMedia(%q) returned error: %v", "ok.png", err)
+	} else if string(media.Data) != "data" || media.ContentType != "image/png" {
+		t.Errorf("GetMedia(%q) = %q (%s), expected %q (%s)", "ok.png", media.Data, media.ContentType, "data", "image/png")
+	}
+	if _, err := l.GetMedia(context.Background(), "missing.png", nil); !errors.Is(err, ErrUpstreamNotFound) {
+		t.Errorf("GetMedia(%q) returned error %v, expected %v", "missing.png", err, ErrUpstreamNotFound)
+	}
+	if _, err := l.GetMedia(context.Background(), "error.png", nil); !errors.Is(err, ErrUpstreamBadStatus) {
+		t.Errorf("GetMedia(%q) returned error %v, expected %v", "error.png", err, ErrUpstreamBadStatus)
+	}
+}
+
+func TestHTTPLoaderRetriesServerErrors(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/flaky.png" && requests < 3:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case r.URL.Path == "/flaky.png":
+			w.Write([]byte("data"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	l, err := NewHTTPLoader(HTTPLoaderConfig{BaseURL: srv.URL + "/", MaxRetries: 2, AllowPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+
+	if media, err := l.GetMedia(context.Background(), "flaky.png", nil); err != nil {
+		t.Errorf("GetMedia(%q) returned error: %v", "flaky.png", err)
+	} else if string(media.Data) != "data" {
+		t.Errorf("GetMedia(%q) = %q, expected %q", "flaky.png", media.Data, "data")
+	}
+	if requests != 3 {
+		t.Errorf("upstream received %d requests, expected 3", requests)
+	}
+
+	requests = 0
+	if _, err := l.GetMedia(context.Background(), "missing.png", nil); !errors.Is(err, ErrUpstreamNotFound) {
+		t.Errorf("GetMedia(%q) returned error %v, expected %v", "missing.png", err, ErrUpstreamNotFound)
+	}
+	if requests != 1 {
+		t.Errorf("upstream received %d requests for a 404, expected 1", requests)
+	}
+}
+
+func TestHTTPLoaderRejectsDisallowedUpstreams(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		config  HTTPLoaderConfig
+		allowed bool
+	}{
+		{HTTPLoaderConfig{BaseURL: srv.URL + "/"}, false},
+		{HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowPrivateNetworks: true}, true},
+		{HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowedHosts: []string{"127.0.0.0/8"}}, true},
+		{HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowedHosts: []string{"example.com"}, AllowPrivateNetworks: true}, false},
+		{HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowedHosts: []string{"127.0.0.1"}}, true},
+		{HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowedHosts: []string{"127.0.0.2"}}, false},
+	}
+	for _, test := range tests {
+		l, err := NewHTTPLoader(test.config)
+		if err != nil {
+			t.Fatalf("NewHTTPLoader returned error: %v", err)
+		}
+		_, err = l.GetMedia(context.Background(), "ok.png", nil)
+		if test.allowed && err != nil {
+			t.Errorf("GetMedia with %+v returned error %v, expected success", test.config, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrUpstreamNotAllowed) {
+			t.Errorf("GetMedia with %+v returned error %v, expected %v", test.config, err, ErrUpstreamNotAllowed)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("upstream received %d requests, expected 3", requests)
+	}
+}
+
+func TestHTTPLoaderRejectsRedirectsToDisallowedHosts(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	defer target.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	}))
+	defer srv.Close()
+	l, err := NewHTTPLoader(HTTPLoaderConfig{BaseURL: srv.URL + "/", AllowedHosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+
+	media, err := l.GetMedia(context.Background(), "ok.png?to="+url.QueryEscape(target.URL+"/ok.png"), nil)
+	if err != nil || string(media.Data) != "data" {
+		t.Errorf("GetMedia redirected to an allowed host returned %v, %v, expected %q", media, err, "data")
+	}
+	// the same server, under a host that isn't allowed
+	disallowed := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	if _, err := l.GetMedia(context.Background(), "ok.png?to="+url.QueryEscape(disallowed+"/ok.png"), nil); !errors.Is(err, ErrUpstreamNotAllowed) {
+		t.Errorf("GetMedia redirected to a disallowed host returned error %v, expected %v", err, ErrUpstreamNotAllowed)
+	}
+}
+
+func TestHTTPLoaderFailsOverToMirrors(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer missing.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer up.Close()
+
+	l, err := NewHTTPLoader(HTTPLoaderConfig{BaseURL: down.URL + "/", MirrorBaseURLs: []string{missing.URL + "/", up.URL + "/"}, AllowPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+	if media, err := l.GetMedia(context.Background(), "ok.png", nil); err != nil {
+		t.Errorf("GetMedia(%q) returned error: %v", "ok.png", err)
+	} else if string(media.Data) != "data" {
+		t.Errorf("GetMedia(%q) = %q, expected %q", "ok.png", media.Data, "data")
+	}
+	stream, err := l.StreamMedia(context.Background(), "ok.png", nil)
+	if err != nil {
+		t.Fatalf("StreamMedia(%q) returned error: %v", "ok.png", err)
+	}
+	stream.Body.Close()
+	if _, err := l.GetMedia(context.Background(), "missing.png", nil); !errors.Is(err, ErrUpstreamBadStatus) {
+		t.Errorf("GetMedia(%q) returned error %v, expected %v", "missing.png", err, ErrUpstreamBadStatus)
+	}
+
+	l, err = NewHTTPLoader(HTTPLoaderConfig{BaseURL: missing.URL + "/", MirrorBaseURLs: []string{up.URL + "/"}, AllowPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+	if _, err := l.GetMedia(context.Background(), "missing.png", nil); !errors.Is(err, ErrUpstreamNotFound) || errors.Is(err, ErrUpstreamBadStatus) {
+		t.Errorf("GetMedia(%q) returned error %v, expected %v", "missing.png", err, ErrUpstreamNotFound)
+	}
+}
+
+func TestHTTPLoaderUpstreamAuth(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		config   HTTPLoaderConfig
+		expected string
+	}{
+		// the forwarded header is kept without auth
+		{HTTPLoaderConfig{}, "Bearer client"},
+		// echo -n "user:pass" | base64
+		{HTTPLoaderConfig{AuthType: "basic", Username: "user", Password: "pass"}, "Basic dXNlcjpwYXNz"},
+		{HTTPLoaderConfig{AuthType: "bearer", Token: "token"}, "Bearer token"},
+		{HTTPLoaderConfig{AuthType: "bearer", Token: "token", Headers: map[string]string{"Authorization": "Bearer static"}}, "Bearer token"},
+	}
+	for _, test := range tests {
+		test.config.BaseURL = srv.URL + "/"
+		test.config.AllowPrivateNetworks = true
+		l, err := NewHTTPLoader(test.config)
+		if err != nil {
+			t.Fatalf("NewHTTPLoader returned error: %v", err)
+		}
+		authorization = ""
+		if _, err := l.GetMedia(context.Background(), "ok.png", http.Header{"Authorization": []string{"Bearer client"}}); err != nil {
+			t.Fatalf("GetMedia returned error: %v", err)
+		}
+		if authorization != test.expected {
+			t.Errorf("GetMedia with auth type %q sent Authorization %q, expected %q", test.config.AuthType, authorization, test.expected)
+		}
+	}
+
+	if _, err := NewHTTPLoader(HTTPLoaderConfig{AuthType: "digest"}); err == nil {
+		t.Errorf("NewHTTPLoader with auth type %q returned no error", "digest")
+	}
+}
@@ -0,0 +1,68 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog/log"
+)
+
+type S3Loader struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Loader(client *s3.Client, bucket string, prefix string) *S3Loader {
+	return &S3Loader{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (l *S3Loader) GetMedia(ctx context.Context, mediaPath string, header http.Header) (*Media, error) {
+	out, err := l.getObject(ctx, mediaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	bodyBytes, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	loaderResponseSize.Observe(float64(len(bodyBytes)))
+	return &Media{Data: bodyBytes, ContentType: aws.ToString(out.ContentType)}, nil
+}
+
+func (l *S3Loader) StreamMedia(ctx context.Context, mediaPath string, header http.Header) (*MediaStream, error) {
+	out, err := l.getObject(ctx, mediaPath)
+	if err != nil {
+		return nil, err
+	}
+	contentLength := int64(-1)
+	if out.ContentLength != nil {
+		contentLength = *out.ContentLength
+	}
+	return &MediaStream{Body: out.Body, ContentType: aws.ToString(out.ContentType), ContentLength: contentLength}, nil
+}
+
+func (l *S3Loader) getObject(ctx context.Context, mediaPath string) (*s3.GetObjectOutput, error) {
+	key := path.Join(l.prefix, mediaPath)
+	log.Debug().Msgf("Fetching image from s3://%s/%s", l.bucket, key)
+	out, err := l.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%w: s3://%s/%s", ErrUpstreamNotFound, l.bucket, key)
+		}
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	return out, nil
+}
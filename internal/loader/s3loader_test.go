@@ -0,0 +1,81 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// mockS3 is a minimal read-only S3 endpoint supporting path-style GET
+type mockS3 struct {
+	objects      map[string][]byte
+	contentTypes map[string]string
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, ok := m.objects[r.URL.Path]
+	if !ok {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		return
+	}
+	w.Header().Set("Content-Type", m.contentTypes[r.URL.Path])
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func newTestS3Loader(t *testing.T, mock *mockS3) *S3Loader {
+	srv := httptest.NewServer(mock)
+	t.Cleanup(srv.Close)
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	return NewS3Loader(client, "bucket", "prefix")
+}
+
+func TestS3Loader(t *testing.T) {
+	l := newTestS3Loader(t, &mockS3{
+		objects:      map[string][]byte{"/bucket/prefix/dir/a.png": []byte("data")},
+		contentTypes: map[string]string{"/bucket/prefix/dir/a.png": "image/png"},
+	})
+
+	media, err := l.GetMedia(context.Background(), "dir/a.png", nil)
+	if err != nil {
+		t.Fatalf("GetMedia returned error: %v", err)
+	}
+	if string(media.Data) != "data" || media.ContentType != "image/png" {
+		t.Errorf("GetMedia = %q (%s), expected %q (%s)", media.Data, media.ContentType, "data", "image/png")
+	}
+
+	stream, err := l.StreamMedia(context.Background(), "dir/a.png", nil)
+	if err != nil {
+		t.Fatalf("StreamMedia returned error: %v", err)
+	}
+	defer stream.Body.Close()
+	data, err := io.ReadAll(stream.Body)
+	if err != nil {
+		t.Fatalf("failed to read stream: %v", err)
+	}
+	if string(data) != "data" || stream.ContentType != "image/png" || stream.ContentLength != 4 {
+		t.Errorf("StreamMedia = %q (%s, %d bytes), expected %q (%s, %d bytes)", data, stream.ContentType, stream.ContentLength, "data", "image/png", 4)
+	}
+
+	if _, err := l.GetMedia(context.Background(), "missing.png", nil); !errors.Is(err, ErrUpstreamNotFound) {
+		t.Errorf("GetMedia(%q) returned error %v, expected %v", "missing.png", err, ErrUpstreamNotFound)
+	}
+	if _, err := l.StreamMedia(context.Background(), "missing.png", nil); !errors.Is(err, ErrUpstreamNotFound) {
+		t.Errorf("StreamMedia(%q) returned error %v, expected %v", "missing.png", err, ErrUpstreamNotFound)
+	}
+}
@@ -0,0 +1,100 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// upstreamGuard restricts the upstream hosts and addresses the HTTP loader may connect to.
+type upstreamGuard struct {
+	hosts                []string
+	networks             []*net.IPNet
+	allowPrivateNetworks bool
+}
+
+func newUpstreamGuard(allowedHosts []string, allowPrivateNetworks bool) (*upstreamGuard, error) {
+	g := &upstreamGuard{allowPrivateNetworks: allowPrivateNetworks}
+	for _, host := range allowedHosts {
+		if strings.Contains(host, "/") {
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed upstream CIDR %q: %w", host, err)
+			}
+			g.networks = append(g.networks, network)
+			continue
+		}
+		// IP literals are allowed at dial time too, even when they're private
+		if ip := net.ParseIP(host); ip != nil {
+			g.networks = append(g.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		g.hosts = append(g.hosts, strings.ToLower(host))
+	}
+	return g, nil
+}
+
+// checkHost checks the URL host against the allow-list. All hosts are allowed when the list is empty.
+func (g *upstreamGuard) checkHost(host string) error {
+	if len(g.hosts) == 0 && len(g.networks) == 0 {
+		return nil
+	}
+	host = strings.ToLower(host)
+	for _, allowedHost := range g.hosts {
+		if host == allowedHost {
+			return nil
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil && g.inAllowedNetwork(ip) {
+		return nil
+	}
+	return fmt.Errorf("%w: host %q is not in the allowed upstream hosts", ErrUpstreamNotAllowed, host)
+}
+
+// checkIP rejects private, loopback and link-local addresses unless they're explicitly allowed
+func (g *upstreamGuard) checkIP(ip net.IP) error {
+	if g.allowPrivateNetworks || g.inAllowedNetwork(ip) {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w: address %s is in a private network", ErrUpstreamNotAllowed, ip)
+	}
+	return nil
+}
+
+func (g *upstreamGuard) inAllowedNetwork(ip net.IP) bool {
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRedirects is the number of redirects followed, like the default of http.Client
+const maxRedirects = 10
+
+// checkRedirect checks the host of redirects against the allow-list, as
+// dialControl only sees their addresses
+func (g *upstreamGuard) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	return g.checkHost(req.URL.Hostname())
+}
+
+// dialControl checks the resolved address right before connecting, which also covers the addresses of redirects and DNS rebinding
+func (g *upstreamGuard) dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: invalid address %q", ErrUpstreamNotAllowed, address)
+	}
+	return g.checkIP(ip)
+}
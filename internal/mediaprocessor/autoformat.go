@@ -0,0 +1,102 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// autoFormatSampleSize is the longest side images are downscaled to before
+// counting their colors
+const autoFormatSampleSize = 64
+
+// The formats outputFormat=auto picks from, by preference, for each kind of image
+var (
+	autoPhotoFormats   = []string{"avif", "webp", "jpeg"}
+	autoGraphicFormats = []string{"png"}
+	autoAlphaFormats   = []string{"webp", "png"}
+)
+
+// autoOutputFormat picks the output format of outputFormat=auto for the
+// image. Images with alpha are encoded as webp or png, graphics with at most
+// AutoFormatMaxColors colors as png and other images as photos (avif, webp or
+// jpeg). Only jpeg, png and the accepted formats are picked, when allowed.
+func (mp *MediaProcessor) autoOutputFormat(img *vips.ImageRef, acceptedFormats []string) (string, error) {
+	candidates := autoPhotoFormats
+	if img.HasAlpha() {
+		candidates = autoAlphaFormats
+	} else if maxColors := mp.getConfig().AutoFormatMaxColors; maxColors > 0 {
+		colors, err := countImageColors(img, maxColors+1)
+		if err != nil {
+			return "", err
+		}
+		if colors <= maxColors {
+			candidates = autoGraphicFormats
+		}
+	}
+	return mp.pickAutoFormat(candidates, acceptedFormats)
+}
+
+// pickAutoFormat returns the first candidate that is accepted (jpeg and png
+// always are) and allowed
+func (mp *MediaProcessor) pickAutoFormat(candidates []string, acceptedFormats []string) (string, error) {
+	accepted := map[string]bool{"jpeg": true, "png": true}
+	for _, format := range acceptedFormats {
+		accepted[format] = true
+	}
+	for _, format := range candidates {
+		if accepted[format] && mp.OutputFormatAllowed(format) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("%w: none of the output formats %v is allowed for outputFormat=auto", ErrInvalidOption, candidates)
+}
+
+// countImageColors counts the colors of a downscaled copy of the image, up to limit
+func countImageColors(img *vips.ImageRef, limit int) (int, error) {
+	sample, err := img.Copy()
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy image: %w", err)
+	}
+	defer sample.Close()
+	// the nearest neighbour keeps the colors of the image, without blending them
+	if sample.Width() > autoFormatSampleSize || sample.Height() > autoFormatSampleSize {
+		scale := float64(autoFormatSampleSize) / float64(sample.Width())
+		if sample.Height() > sample.Width() {
+			scale = float64(autoFormatSampleSize) / float64(sample.Height())
+		}
+		if err := sample.Resize(scale, vips.KernelNearest); err != nil {
+			return 0, fmt.Errorf("failed to resize image: %w", err)
+		}
+	}
+	ep := vips.NewPngExportParams()
+	ep.StripMetadata = true
+	outputBytes, _, err := sample.ExportPng(ep)
+	if err != nil {
+		return 0, fmt.Errorf("failed to export image: %w", err)
+	}
+	gimg, err := png.Decode(bytes.NewReader(outputBytes))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return countColors(gimg, limit), nil
+}
+
+// countColors counts the distinct colors of the image, stopping at limit
+func countColors(img image.Image, limit int) int {
+	colors := map[[4]uint32]bool{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			colors[[4]uint32{r, g, b, a}] = true
+			if len(colors) >= limit {
+				return len(colors)
+			}
+		}
+	}
+	return len(colors)
+}
@@ -0,0 +1,90 @@
+package mediaprocessor
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCountColors(t *testing.T) {
+	tests := []struct {
+		img      image.Image
+		limit    int
+		expected int
+	}{
+		{quadrantsFixture(), 10, 4},
+		{quadrantsFixture(), 3, 3},
+		{image.NewRGBA(image.Rect(0, 0, 8, 8)), 10, 1},
+		{softFixture(), 100, 100},
+	}
+	for _, test := range tests {
+		if colors := countColors(test.img, test.limit); colors != test.expected {
+			t.Errorf("countColors(%v, %d) = %d, expected %d", test.img.Bounds(), test.limit, colors, test.expected)
+		}
+	}
+}
+
+func TestPickAutoFormat(t *testing.T) {
+	tests := []struct {
+		allowed    []string
+		candidates []string
+		accepted   []string
+		expected   string
+	}{
+		{nil, autoPhotoFormats, []string{"avif", "webp"}, "avif"},
+		{nil, autoPhotoFormats, []string{"webp"}, "webp"},
+		{nil, autoPhotoFormats, nil, "jpeg"},
+		{[]string{"webp", "jpeg"}, autoPhotoFormats, []string{"avif", "webp"}, "webp"},
+		{nil, autoAlphaFormats, nil, "png"},
+		{nil, autoAlphaFormats, []string{"webp"}, "webp"},
+		{nil, autoGraphicFormats, []string{"avif", "webp"}, "png"},
+	}
+	for _, test := range tests {
+		mp := NewMediaProcessor(MediaProcessorConfig{AllowedOutputFormats: test.allowed})
+		format, err := mp.pickAutoFormat(test.candidates, test.accepted)
+		if err != nil {
+			t.Errorf("pickAutoFormat(%v, %v) returned error: %v", test.candidates, test.accepted, err)
+			continue
+		}
+		if format != test.expected {
+			t.Errorf("pickAutoFormat(%v, %v) with allowed formats %v = %q, expected %q", test.candidates, test.accepted, test.allowed, format, test.expected)
+		}
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{AllowedOutputFormats: []string{"avif"}})
+	if _, err := mp.pickAutoFormat(autoGraphicFormats, []string{"avif"}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("pickAutoFormat without an allowed candidate returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestProcessTransformRequestAutoFormat(t *testing.T) {
+	// the soft fixture has over 200 colors and the quadrants fixture 4
+	mp := NewMediaProcessor(MediaProcessorConfig{AutoFormatMaxColors: 16})
+	alpha := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	alpha.Set(0, 0, color.NRGBA{255, 0, 0, 128})
+	tests := []struct {
+		name                string
+		input               image.Image
+		autoFormats         []string
+		expectedContentType string
+	}{
+		{"photo", softFixture(), []string{"webp"}, "image/webp"},
+		{"photo", softFixture(), nil, "image/jpeg"},
+		{"graphic", quadrantsFixture(), []string{"avif", "webp"}, "image/png"},
+		{"alpha", alpha, []string{"avif", "webp"}, "image/webp"},
+		{"alpha", alpha, nil, "image/png"},
+	}
+	for _, test := range tests {
+		params := NewTransformOptions()
+		params.OutputFormat = "auto"
+		params.AutoFormats = test.autoFormats
+		_, contentType, err := mp.ProcessTransformRequest(context.Background(), encodePNG(t, test.input), params)
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest of the %s image returned error: %v", test.name, err)
+		}
+		if contentType != test.expectedContentType {
+			t.Errorf("ProcessTransformRequest of the %s image with auto formats %v returned %q, expected %q", test.name, test.autoFormats, contentType, test.expectedContentType)
+		}
+	}
+}
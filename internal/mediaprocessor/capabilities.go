@@ -0,0 +1,60 @@
+package mediaprocessor
+
+import (
+	"fmt"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Capabilities are the formats the linked libvips can decode and encode
+type Capabilities struct {
+	InputFormats  map[string]bool `json:"inputFormats"`
+	OutputFormats map[string]bool `json:"outputFormats"`
+}
+
+// outputFormatProbes encode an image to each output format
+var outputFormatProbes = map[string]func(img *vips.ImageRef) ([]byte, error){
+	"jpeg": func(img *vips.ImageRef) ([]byte, error) {
+		out, _, err := img.ExportJpeg(vips.NewJpegExportParams())
+		return out, err
+	},
+	"png": func(img *vips.ImageRef) ([]byte, error) {
+		out, _, err := img.ExportPng(vips.NewPngExportParams())
+		return out, err
+	},
+	"webp": func(img *vips.ImageRef) ([]byte, error) {
+		out, _, err := img.ExportWebp(vips.NewWebpExportParams())
+		return out, err
+	},
+	"avif": func(img *vips.ImageRef) ([]byte, error) {
+		out, _, err := img.ExportAvif(vips.NewAvifExportParams())
+		return out, err
+	},
+	"gif": func(img *vips.ImageRef) ([]byte, error) {
+		out, _, err := img.ExportGIF(vips.NewGifExportParams())
+		return out, err
+	},
+}
+
+// ProbeCapabilities checks which input formats have a libvips loader, and
+// which output formats can be encoded by exporting a 1x1 image. libvips must
+// be started first.
+func ProbeCapabilities() (Capabilities, error) {
+	capabilities := Capabilities{
+		InputFormats:  map[string]bool{},
+		OutputFormats: map[string]bool{},
+	}
+	for imageType, format := range inputFormats {
+		capabilities.InputFormats[format] = vips.IsTypeSupported(imageType)
+	}
+	img, err := vips.Black(1, 1)
+	if err != nil {
+		return capabilities, fmt.Errorf("failed to create probe image: %w", err)
+	}
+	defer img.Close()
+	for format, probe := range outputFormatProbes {
+		_, err := probe(img)
+		capabilities.OutputFormats[format] = err == nil
+	}
+	return capabilities, nil
+}
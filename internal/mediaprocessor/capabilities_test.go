@@ -0,0 +1,21 @@
+package mediaprocessor
+
+import "testing"
+
+func TestProbeCapabilities(t *testing.T) {
+	capabilities, err := ProbeCapabilities()
+	if err != nil {
+		t.Fatalf("ProbeCapabilities returned error: %v", err)
+	}
+	for _, format := range []string{"jpeg", "png", "gif"} {
+		if !capabilities.InputFormats[format] {
+			t.Errorf("ProbeCapabilities reported input format %q as unsupported", format)
+		}
+		if !capabilities.OutputFormats[format] {
+			t.Errorf("ProbeCapabilities reported output format %q as unsupported", format)
+		}
+	}
+	if _, ok := capabilities.InputFormats["heif"]; !ok {
+		t.Errorf("ProbeCapabilities didn't report input format %q", "heif")
+	}
+}
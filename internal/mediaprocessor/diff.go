@@ -0,0 +1,122 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// DiffResponse compares two images pixel by pixel
+type DiffResponse struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// SameSize is false when the images have different dimensions, which
+	// aren't compared further
+	SameSize bool `json:"sameSize"`
+	// MeanDifference is the mean absolute difference of the RGBA channels,
+	// from 0 (identical) to 1, and Similarity is its complement
+	MeanDifference float64 `json:"meanDifference"`
+	Similarity     float64 `json:"similarity"`
+	// DifferentPixels is the fraction of pixels with a difference
+	DifferentPixels float64 `json:"differentPixels"`
+	// DiffImage is a PNG data URI of the absolute differences of the pixels,
+	// when requested
+	DiffImage string `json:"diffImage,omitempty"`
+}
+
+// DiffImages compares two encoded images (in any format libvips loads),
+// including an image of their differences when diffImage is set
+func (mp *MediaProcessor) DiffImages(ctx context.Context, a []byte, b []byte, diffImage bool) (*DiffResponse, error) {
+	imgA, err := decodeWithVips(a)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	imgB, err := decodeWithVips(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return diffImages(imgA, imgB, diffImage)
+}
+
+// decodeWithVips decodes an image that the Go decoders may not support (like
+// webp or avif) by converting it to PNG with libvips
+func decodeWithVips(data []byte) (image.Image, error) {
+	img, err := vips.LoadImageFromBuffer(data, vips.NewImportParams())
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load image: %v", ErrInvalidImage, err)
+	}
+	defer img.Close()
+	ep := vips.NewPngExportParams()
+	ep.StripMetadata = true
+	pngBytes, _, err := img.ExportPng(ep)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export image: %w", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return decoded, nil
+}
+
+// diffImages compares the pixels of two images of the same size
+func diffImages(a image.Image, b image.Image, diffImage bool) (*DiffResponse, error) {
+	boundsA, boundsB := a.Bounds(), b.Bounds()
+	response := &DiffResponse{Width: boundsA.Dx(), Height: boundsA.Dy()}
+	if boundsA.Dx() != boundsB.Dx() || boundsA.Dy() != boundsB.Dy() {
+		return response, nil
+	}
+	response.SameSize = true
+	var diff *image.NRGBA
+	if diffImage {
+		diff = image.NewNRGBA(image.Rect(0, 0, boundsA.Dx(), boundsA.Dy()))
+	}
+	var total float64
+	var differentPixels int
+	for y := 0; y < boundsA.Dy(); y++ {
+		for x := 0; x < boundsA.Dx(); x++ {
+			ca := color.NRGBA64Model.Convert(a.At(boundsA.Min.X+x, boundsA.Min.Y+y)).(color.NRGBA64)
+			cb := color.NRGBA64Model.Convert(b.At(boundsB.Min.X+x, boundsB.Min.Y+y)).(color.NRGBA64)
+			dr, dg, db, da := absDiff(ca.R, cb.R), absDiff(ca.G, cb.G), absDiff(ca.B, cb.B), absDiff(ca.A, cb.A)
+			total += float64(dr) + float64(dg) + float64(db) + float64(da)
+			if dr+dg+db+da > 0 {
+				differentPixels++
+			}
+			if diff != nil {
+				diff.SetNRGBA(x, y, color.NRGBA{uint8(dr >> 8), uint8(dg >> 8), uint8(db >> 8), 255})
+			}
+		}
+	}
+	if pixels := boundsA.Dx() * boundsA.Dy(); pixels > 0 {
+		response.MeanDifference = total / float64(pixels*4) / 0xffff
+		response.DifferentPixels = float64(differentPixels) / float64(pixels)
+	}
+	response.Similarity = 1 - response.MeanDifference
+	if diff != nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, diff); err != nil {
+			return nil, fmt.Errorf("failed to encode diff image: %w", err)
+		}
+		response.DiffImage = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	return response, nil
+}
+
+func absDiff(a uint16, b uint16) uint32 {
+	if a > b {
+		return uint32(a - b)
+	}
+	return uint32(b - a)
+}
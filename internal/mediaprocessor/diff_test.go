@@ -0,0 +1,65 @@
+package mediaprocessor
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	changed := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	soft := softFixture()
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			changed.Set(x, y, soft.At(x, y))
+		}
+	}
+	// a quarter of the pixels turn from their color to white or black
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			changed.Set(x, y, color.RGBA{255, 255, 255, 255})
+		}
+	}
+	black := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	white := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range white.Pix {
+		white.Pix[i] = 255
+	}
+	for i := 3; i < len(black.Pix); i += 4 {
+		black.Pix[i] = 255
+	}
+	tests := []struct {
+		name                    string
+		a, b                    image.Image
+		expectedSameSize        bool
+		expectedSimilarity      float64
+		expectedDifferentPixels float64
+	}{
+		{"identical", soft, soft, true, 1, 0},
+		// black and white differ in the 3 color channels, but not the alpha
+		{"black and white", black, white, true, 0.25, 1},
+		{"different sizes", soft, black, false, 0, 0},
+	}
+	for _, test := range tests {
+		diff, err := diffImages(test.a, test.b, false)
+		if err != nil {
+			t.Fatalf("%s: diffImages returned error: %v", test.name, err)
+		}
+		if diff.SameSize != test.expectedSameSize || math.Abs(diff.Similarity-test.expectedSimilarity) > 1e-9 || diff.DifferentPixels != test.expectedDifferentPixels {
+			t.Errorf("%s: diffImages = %+v, expected same size %v, similarity %g and different pixels %g", test.name, diff, test.expectedSameSize, test.expectedSimilarity, test.expectedDifferentPixels)
+		}
+	}
+
+	diff, err := diffImages(soft, changed, true)
+	if err != nil {
+		t.Fatalf("diffImages returned error: %v", err)
+	}
+	if diff.DifferentPixels > 0.25 || diff.DifferentPixels < 0.2 || diff.Similarity >= 1 || diff.Similarity < 0.75 {
+		t.Errorf("diffImages with a changed quarter = %+v, expected a quarter of different pixels", diff)
+	}
+	if !strings.HasPrefix(diff.DiffImage, "data:image/png;base64,") {
+		t.Errorf("diffImages returned diff image %.40q, expected a PNG data URI", diff.DiffImage)
+	}
+}
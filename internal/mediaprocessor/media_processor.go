@@ -2,21 +2,135 @@ package mediaprocessor
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/png"
+	"math"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bbrks/go-blurhash"
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/galdor/go-thumbhash"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/blesswinsamuel/media-proxy/internal/mediaprocessor")
+
+var processDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "media_proxy_process_duration_seconds",
+	Help:    "Image processing duration in seconds by stage",
+	Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 5},
+}, []string{"stage", "format"})
+
+var encodeQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "media_proxy_encode_queue_depth",
+	Help: "Number of transformed images waiting for an encode slot",
+})
+
+// observeProcessStage records the duration of a processing stage that started
+// at startTime. Unknown output formats share a label to keep the cardinality low.
+func observeProcessStage(stage string, outputFormat string, startTime time.Time) {
+	switch outputFormat {
+	case "jpeg", "png", "avif", "webp", "gif":
+	default:
+		outputFormat = "unknown"
+	}
+	processDuration.WithLabelValues(stage, outputFormat).Observe(time.Since(startTime).Seconds())
+}
+
+var (
+	// ErrInvalidOption is returned when a request option has an invalid value
+	ErrInvalidOption = errors.New("invalid option")
+	// ErrInvalidImage is returned when the source image can't be processed, like when it has no width or height
+	ErrInvalidImage = errors.New("invalid image")
+	// ErrUnsupportedInputFormat is returned when the format of the source media isn't allowed
+	ErrUnsupportedInputFormat = errors.New("unsupported input format")
+	// ErrUndecodableImage is returned when libvips can't decode the source media, like videos or unknown types
+	ErrUndecodableImage = errors.New("undecodable image")
+	// ErrImageTooLarge is returned when the decoded source image has more pixels than allowed
+	ErrImageTooLarge = errors.New("image too large")
+)
+
+// readAllPages is the read.page that loads all the pages (or frames) of the media
+const readAllPages = -1
+
 type ReadOptions struct {
-	Dpi  int `query:"dpi"`
+	Dpi int `query:"dpi"`
+	// Page loads a single page (1-based) of multi-page media, or all of them with -1
+	// (metadata only)
 	Page int `query:"page"`
+	// Scale renders vector images like SVGs and PDFs at a multiple of their
+	// size (72 dpi), as an alternative to dpi
+	Scale float64 `query:"scale"`
+}
+
+// density returns the dpi vector images are rendered at, or 0 for the default
+func (r ReadOptions) density() int {
+	if r.Scale > 0 {
+		return int(math.Round(r.Scale * 72))
+	}
+	return r.Dpi
+}
+
+// MetadataOptionsExif includes the EXIF metadata with exif=true. GPS
+// coordinates are left out for privacy unless exif.gps=true.
+type MetadataOptionsExif struct {
+	Enabled bool `query:"-"`
+	GPS     bool `query:"gps"`
+}
+
+func (e *MetadataOptionsExif) UnmarshalText(text []byte) error {
+	enabled, err := strconv.ParseBool(string(text))
+	if err != nil {
+		return fmt.Errorf("%w: invalid exif parameter: %q", ErrInvalidOption, text)
+	}
+	e.Enabled = enabled
+	return nil
+}
+
+// MetadataOptionsBlurHash includes the blurhash with blurhash=true. The number
+// of horizontal and vertical components (1 to 9, 5 by default) is set with
+// blurhash.x and blurhash.y.
+type MetadataOptionsBlurHash struct {
+	Enabled bool `query:"-"`
+	X       int  `query:"x"`
+	Y       int  `query:"y"`
+}
+
+func (b *MetadataOptionsBlurHash) UnmarshalText(text []byte) error {
+	enabled, err := strconv.ParseBool(string(text))
+	if err != nil {
+		return fmt.Errorf("%w: invalid blurhash parameter: %q", ErrInvalidOption, text)
+	}
+	b.Enabled = enabled
+	return nil
+}
+
+// components returns the number of horizontal and vertical components, defaulting to 5
+func (b *MetadataOptionsBlurHash) components() (int, int) {
+	x, y := b.X, b.Y
+	if x == 0 {
+		x = 5
+	}
+	if y == 0 {
+		y = 5
+	}
+	return x, y
 }
 
 type MetadataOptions struct {
@@ -24,8 +138,34 @@ type MetadataOptions struct {
 	// https://evanw.github.io/thumbhash/
 	ThumbHash bool `query:"thumbhash"`
 	// https://github.com/woltapp/blurhash
-	BlurHash   bool `query:"blurhash"`
-	PotatoWebp bool `query:"potatowebp"`
+	BlurHash     *MetadataOptionsBlurHash `query:"blurhash"`
+	PotatoWebp   bool                     `query:"potatowebp"`
+	AverageColor bool                     `query:"averageColor"`
+	Exif         *MetadataOptionsExif     `query:"exif"`
+	Palette      int                      `query:"palette"`
+}
+
+// includesBlurHash reports whether the blurhash is requested
+func (o *MetadataOptions) includesBlurHash() bool {
+	return o.BlurHash != nil && (o.BlurHash.Enabled || o.BlurHash.X > 0 || o.BlurHash.Y > 0)
+}
+
+// IncludesHash reports whether a blurhash or thumbhash placeholder is requested
+func (o *MetadataOptions) IncludesHash() bool {
+	return o.ThumbHash || o.includesBlurHash()
+}
+
+// Validate checks that the options are within their allowed ranges
+func (o *MetadataOptions) Validate() error {
+	if o.Palette < 0 || o.Palette > MaxPaletteColors {
+		return fmt.Errorf("%w: invalid palette parameter: %d (must be between 0 and %d)", ErrInvalidOption, o.Palette, MaxPaletteColors)
+	}
+	if o.BlurHash != nil {
+		if x, y := o.BlurHash.components(); x < 1 || x > 9 || y < 1 || y > 9 {
+			return fmt.Errorf("%w: invalid blurhash components: %dx%d (must be between 1 and 9)", ErrInvalidOption, x, y)
+		}
+	}
+	return nil
 }
 
 type TransformOptionsResize struct {
@@ -33,22 +173,884 @@ type TransformOptionsResize struct {
 	Height int    `query:"height"`
 	Crop   string `query:"crop"`
 	Size   string `query:"size"`
+	// Gravity crops the image to the target aspect ratio, keeping the given side before resizing
+	Gravity string `query:"gravity"`
+	// WidthPercent and HeightPercent set the size as a percentage of the image size (resize.width=50%)
+	WidthPercent  float64 `query:"-"`
+	HeightPercent float64 `query:"-"`
+	// Fit sets crop and size together for the common resize modes, keeping the
+	// aspect ratio: contain fits the image within the box without enlarging it,
+	// inside fits it within the box enlarging smaller images, and cover fills
+	// the box, cropping the overflow (around the gravity, or the centre). Unlike
+	// crop and size, which are passed to the vips thumbnail as they are, it
+	// can't be combined with them.
+	Fit string `query:"fit"`
+	// Focus crops the resized image around a focal point when both width and
+	// height are set, instead of the crop strategy or the cover fit centre
+	Focus *TransformOptionsFocus `query:"focus"`
 	// Method  string // fill or fit
-	// Gravity string // valid if method is fill. top, bottom, left, right, center, top right, top left, bottom right, bottom left, smart
+}
+
+// TransformOptionsFocus is a focal point, relative to the image size (from 0
+// to 1). An omitted coordinate is the centre.
+type TransformOptionsFocus struct {
+	X *float64 `query:"x"`
+	Y *float64 `query:"y"`
+}
+
+// point returns the coordinates of the focal point
+func (f *TransformOptionsFocus) point() (float64, float64) {
+	x, y := 0.5, 0.5
+	if f.X != nil {
+		x = *f.X
+	}
+	if f.Y != nil {
+		y = *f.Y
+	}
+	return x, y
+}
+
+// Validate checks the sizes and the enums of the resize, and the combinations
+// of its modes. It only depends on the params, so requests can be checked
+// before fetching the media.
+func (r *TransformOptionsResize) Validate() error {
+	if r.Width < 0 || r.Height < 0 || r.WidthPercent < 0 || r.HeightPercent < 0 {
+		return fmt.Errorf("%w: invalid resize parameter: width and height must not be negative", ErrInvalidOption)
+	}
+	if _, err := parseVipsInteresting(r.Crop); err != nil {
+		return fmt.Errorf("invalid resize.crop parameter: %w", err)
+	}
+	if _, err := parseVipsSize(r.Size); err != nil {
+		return fmt.Errorf("invalid resize.size parameter: %w", err)
+	}
+	if r.Gravity != "" {
+		if _, _, err := parseGravity(r.Gravity); err != nil {
+			return err
+		}
+		if r.Crop != "" {
+			return fmt.Errorf("%w: resize crop and gravity can't be combined", ErrInvalidOption)
+		}
+	}
+	if r.Focus != nil {
+		if x, y := r.Focus.point(); !(x >= 0 && x <= 1 && y >= 0 && y <= 1) {
+			return fmt.Errorf("%w: invalid resize focus parameter: %g,%g (must be between 0 and 1)", ErrInvalidOption, x, y)
+		}
+		if r.Crop != "" || r.Gravity != "" {
+			return fmt.Errorf("%w: resize focus can't be combined with crop or gravity", ErrInvalidOption)
+		}
+		if r.Fit != "" && r.Fit != "cover" {
+			return fmt.Errorf("%w: resize focus can only be combined with the cover fit", ErrInvalidOption)
+		}
+	}
+	if r.Fit != "" {
+		if _, ok := resizeFits[r.Fit]; !ok {
+			return fmt.Errorf("%w: invalid resize fit parameter: %q (must be contain, cover or inside)", ErrInvalidOption, r.Fit)
+		}
+		if r.Crop != "" || r.Size != "" {
+			return fmt.Errorf("%w: resize fit can't be combined with crop or size", ErrInvalidOption)
+		}
+		if r.Gravity != "" && r.Fit != "cover" {
+			return fmt.Errorf("%w: resize gravity can only be combined with the cover fit", ErrInvalidOption)
+		}
+	}
+	return nil
+}
+
+// resizeFits are the vips thumbnail crop and size of each resize fit
+var resizeFits = map[string]struct {
+	crop vips.Interesting
+	size vips.Size
+}{
+	"contain": {vips.InterestingNone, vips.SizeDown},
+	"inside":  {vips.InterestingNone, vips.SizeBoth},
+	"cover":   {vips.InterestingCentre, vips.SizeBoth},
+}
+
+// hasSize reports whether the resize sets a width or height
+func (r *TransformOptionsResize) hasSize() bool {
+	return r.Width != 0 || r.Height != 0 || r.WidthPercent != 0 || r.HeightPercent != 0
+}
+
+type TransformOptionsCropRegion struct {
+	Left   int `query:"left"`
+	Top    int `query:"top"`
+	Width  int `query:"width"`
+	Height int `query:"height"`
+}
+
+type TransformOptionsExtend struct {
+	Top        int    `query:"top"`
+	Right      int    `query:"right"`
+	Bottom     int    `query:"bottom"`
+	Left       int    `query:"left"`
+	Background string `query:"background"`
+}
+
+// TransformOptionsTrim removes the uniform border around the image. It is
+// enabled with trim=true, and the threshold (how much a pixel may differ from
+// the border color) is set with trim.threshold.
+type TransformOptionsTrim struct {
+	Enabled   bool    `query:"-"`
+	Threshold float64 `query:"threshold"`
+}
+
+func (t *TransformOptionsTrim) UnmarshalText(text []byte) error {
+	enabled, err := strconv.ParseBool(string(text))
+	if err != nil {
+		return fmt.Errorf("%w: invalid trim parameter: %q", ErrInvalidOption, text)
+	}
+	t.Enabled = enabled
+	return nil
 }
 
 type TransformOptions struct {
-	Raw          bool                    `query:"raw"`
-	Read         ReadOptions             `query:"read"`
-	Resize       *TransformOptionsResize `query:"resize"`
-	OutputFormat string                  `query:"outputFormat"`
+	Raw           bool                        `query:"raw"`
+	Read          ReadOptions                 `query:"read"`
+	Frame         int                         `query:"frame"`
+	Frames        string                      `query:"frames"`
+	AutoRotate    bool                        `query:"autorotate"`
+	Trim          *TransformOptionsTrim       `query:"trim"`
+	CropRegion    *TransformOptionsCropRegion `query:"crop"`
+	Resize        *TransformOptionsResize     `query:"resize"`
+	Dpr           float64                     `query:"dpr"`
+	Rotate        int                         `query:"rotate"`
+	FlipH         bool                        `query:"flipH"`
+	FlipV         bool                        `query:"flipV"`
+	Extend        *TransformOptionsExtend     `query:"extend"`
+	Blur          float64                     `query:"blur"`
+	Sharpen       float64                     `query:"sharpen"`
+	Brightness    float64                     `query:"brightness"`
+	Contrast      float64                     `query:"contrast"`
+	Gamma         float64                     `query:"gamma"`
+	Background    string                      `query:"background"`
+	Quality       int                         `query:"quality"`
+	Lossless      bool                        `query:"lossless"`
+	StripMetadata bool                        `query:"strip"`
+	ColorProfile  string                      `query:"colorProfile"`
+	Effort        *int                        `query:"effort"`
+	OutputFormat  string                      `query:"outputFormat"`
+
+	// NearLossless encodes webp losslessly after adjusting pixel values, by
+	// NearLosslessLevel (0 to 100, lower is smaller). Other formats ignore it.
+	NearLossless      bool `query:"nearLossless"`
+	NearLosslessLevel int  `query:"nearLosslessLevel"`
+
+	// Flatten outputs only the first frame of animated images, which are
+	// otherwise kept animated in the formats supporting it (gif and webp)
+	Flatten bool `query:"flatten"`
+
+	// TargetBytes searches the highest quality (up to the requested one) whose
+	// output fits in this many bytes, for the lossy formats (jpeg, webp and
+	// avif). The lowest quality is used when none fits. 0 disables it.
+	TargetBytes int `query:"targetBytes"`
+
+	// Pixelate replaces blocks of this many pixels with their average color
+	// after resizing, to redact the image, or the PixelateRegion of it (in
+	// the coordinates of the resized image). 0 disables it.
+	Pixelate       int                         `query:"pixelate"`
+	PixelateRegion *TransformOptionsCropRegion `query:"pixelateRegion"`
+
+	// AutoFormats are the output formats the client accepts besides jpeg and
+	// png, which outputFormat=auto can pick from. They are set from the Accept header.
+	AutoFormats []string `query:"-"`
+}
+
+// NewTransformOptions returns the transform options with their defaults set
+func NewTransformOptions() *TransformOptions {
+	return &TransformOptions{
+		AutoRotate:    true,
+		StripMetadata: true,
+		Dpr:           1,
+		Brightness:    1,
+		Contrast:      1,
+		Gamma:         1,
+	}
+}
+
+// RequiresTransform reports whether the options change the media, so that it
+// can't be served as is. The output format only does when it's requested
+// explicitly, not when it's negotiated (empty or auto).
+func (o *TransformOptions) RequiresTransform() bool {
+	if o.OutputFormat != "" && o.OutputFormat != "auto" {
+		return true
+	}
+	defaults := NewTransformOptions()
+	defaults.OutputFormat, defaults.AutoFormats = o.OutputFormat, o.AutoFormats
+	return !reflect.DeepEqual(o, defaults)
+}
+
+// frameRange returns the first and last frame (1-based, inclusive) selected
+// with frame or frames. ok is false when all frames are kept.
+func (o *TransformOptions) frameRange() (first int, last int, ok bool, err error) {
+	if o.Frame != 0 && o.Frames != "" {
+		return 0, 0, false, fmt.Errorf("%w: frame and frames can't be combined", ErrInvalidOption)
+	}
+	if o.Frame != 0 {
+		if o.Frame < 0 {
+			return 0, 0, false, fmt.Errorf("%w: invalid frame parameter: %d (must be positive)", ErrInvalidOption, o.Frame)
+		}
+		return o.Frame, o.Frame, true, nil
+	}
+	if o.Frames == "" {
+		return 0, 0, false, nil
+	}
+	firstStr, lastStr, found := strings.Cut(o.Frames, "-")
+	if !found {
+		lastStr = firstStr
+	}
+	first, firstErr := strconv.Atoi(firstStr)
+	last, lastErr := strconv.Atoi(lastStr)
+	if firstErr != nil || lastErr != nil || first < 1 || last < first {
+		return 0, 0, false, fmt.Errorf("%w: invalid frames parameter: %q (must be a range like 2-5)", ErrInvalidOption, o.Frames)
+	}
+	return first, last, true, nil
+}
+
+// Validate checks that the options are within their allowed ranges
+func (o *TransformOptions) Validate() error {
+	// the ratio is clamped when resizing, but NaN and infinity can't be
+	if o.Dpr != 0 && !(o.Dpr > 0 && o.Dpr <= math.MaxFloat64) {
+		return fmt.Errorf("%w: invalid dpr parameter: %g (must be positive)", ErrInvalidOption, o.Dpr)
+	}
+	if _, err := parseVipsAngle(o.Rotate); err != nil {
+		return err
+	}
+	if _, _, ok, err := o.frameRange(); err != nil {
+		return err
+	} else if ok && o.Read.Page > 0 {
+		return fmt.Errorf("%w: frame and read.page can't be combined", ErrInvalidOption)
+	}
+	// all the pages are only loaded for metadata, transforms select them with frames
+	if o.Read.Page == readAllPages {
+		return fmt.Errorf("%w: read.page=-1 is only supported for metadata", ErrInvalidOption)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("%w: invalid quality parameter: %d (must be between 1 and 100)", ErrInvalidOption, o.Quality)
+	}
+	if o.Blur < 0 {
+		return fmt.Errorf("%w: invalid blur parameter: %g (must not be negative)", ErrInvalidOption, o.Blur)
+	}
+	if o.Sharpen < 0 || o.Sharpen > 10 {
+		return fmt.Errorf("%w: invalid sharpen parameter: %g (must be between 0 and 10)", ErrInvalidOption, o.Sharpen)
+	}
+	for name, value := range map[string]float64{"brightness": o.Brightness, "contrast": o.Contrast, "gamma": o.Gamma} {
+		if value < 0 || value > 10 {
+			return fmt.Errorf("%w: invalid %s parameter: %g (must be between 0 and 10)", ErrInvalidOption, name, value)
+		}
+	}
+	if o.Background != "" {
+		if _, err := parseHexColor(o.Background); err != nil {
+			return fmt.Errorf("invalid background parameter: %w", err)
+		}
+	}
+	if o.Resize != nil {
+		if err := o.Resize.Validate(); err != nil {
+			return err
+		}
+	}
+	if o.Trim != nil && o.Trim.Threshold < 0 {
+		return fmt.Errorf("%w: invalid trim threshold parameter: %g (must not be negative)", ErrInvalidOption, o.Trim.Threshold)
+	}
+	if region := o.CropRegion; region != nil {
+		if region.Left < 0 || region.Top < 0 || region.Width <= 0 || region.Height <= 0 {
+			return fmt.Errorf("%w: invalid crop region: left and top must not be negative, width and height must be positive", ErrInvalidOption)
+		}
+	}
+	if o.Pixelate < 0 || o.Pixelate == 1 {
+		return fmt.Errorf("%w: invalid pixelate parameter: %d (must be greater than 1)", ErrInvalidOption, o.Pixelate)
+	}
+	if region := o.PixelateRegion; region != nil {
+		if o.Pixelate == 0 {
+			return fmt.Errorf("%w: pixelateRegion requires pixelate", ErrInvalidOption)
+		}
+		if region.Left < 0 || region.Top < 0 || region.Width <= 0 || region.Height <= 0 {
+			return fmt.Errorf("%w: invalid pixelate region: left and top must not be negative, width and height must be positive", ErrInvalidOption)
+		}
+	}
+	if extend := o.Extend; extend != nil {
+		if extend.Top < 0 || extend.Right < 0 || extend.Bottom < 0 || extend.Left < 0 {
+			return fmt.Errorf("%w: invalid extend parameter: top, right, bottom and left must not be negative", ErrInvalidOption)
+		}
+		if extend.Background != "" {
+			if _, err := parseHexColor(extend.Background); err != nil {
+				return fmt.Errorf("invalid extend background parameter: %w", err)
+			}
+		}
+	}
+	if _, ok := colorProfiles[o.ColorProfile]; !ok && o.ColorProfile != "" {
+		return fmt.Errorf("%w: invalid colorProfile parameter: %q (must be keep, srgb or p3)", ErrInvalidOption, o.ColorProfile)
+	}
+	if o.NearLosslessLevel < 0 || o.NearLosslessLevel > 100 {
+		return fmt.Errorf("%w: invalid nearLosslessLevel parameter: %d (must be between 0 and 100)", ErrInvalidOption, o.NearLosslessLevel)
+	}
+	if o.Flatten && o.Frames != "" {
+		return fmt.Errorf("%w: flatten and frames can't be combined", ErrInvalidOption)
+	}
+	if o.TargetBytes < 0 {
+		return fmt.Errorf("%w: invalid targetBytes parameter: %d (must not be negative)", ErrInvalidOption, o.TargetBytes)
+	}
+	if o.TargetBytes > 0 && (o.Lossless || o.NearLossless) {
+		return fmt.Errorf("%w: targetBytes can't be combined with lossless or nearLossless", ErrInvalidOption)
+	}
+	if o.Effort != nil {
+		maxEffort := map[string]int{"webp": 6, "avif": 9}
+		if max, ok := maxEffort[o.OutputFormat]; (ok && *o.Effort > max) || *o.Effort < 0 {
+			return fmt.Errorf("%w: invalid effort parameter: %d (must be between 0 and 6 for webp, or between 0 and 9 for avif)", ErrInvalidOption, *o.Effort)
+		}
+	}
+	return nil
+}
+
+type MediaProcessorConfig struct {
+	// MaxOutputWidth and MaxOutputHeight limit the size of transformed images. 0 means no limit.
+	MaxOutputWidth  int
+	MaxOutputHeight int
+	// MaxDpi limits the density vector images like PDFs and SVGs are rendered at. 0 means no limit.
+	MaxDpi int
+	// DefaultColorProfile is the color profile images are converted to when
+	// the request doesn't set one: keep (or empty) or srgb
+	DefaultColorProfile string
+	// AllowedOutputFormats restricts the output formats that can be requested. All formats are allowed when empty.
+	AllowedOutputFormats []string
+	// DefaultQuality is the quality per output format used when the request
+	// doesn't set one. Formats without a default use the libvips default.
+	DefaultQuality map[string]int
+	// DefaultMaxDimension downscales images whose longest side is larger, when
+	// the request doesn't resize them. 0 means no default resize.
+	DefaultMaxDimension int
+	// AllowedInputFormats restricts the formats of the media that is processed. All formats are allowed when empty.
+	AllowedInputFormats []string
+	// AutoFormatMaxColors is the max number of colors of the images
+	// outputFormat=auto encodes as graphics (png). 0 treats all images as photos.
+	AutoFormatMaxColors int
+	// MaxMegapixels limits the pixels of the decoded images (across all their
+	// pages), as small files can decode to huge images. 0 means no limit.
+	MaxMegapixels float64
+	// EncodeConcurrency limits the images encoded at the same time, so CPU
+	// bound encodes don't hold up the requests served from the caches. 0
+	// means no limit. It is applied when the processor is created.
+	EncodeConcurrency int
 }
 
 type MediaProcessor struct {
+	mu     sync.RWMutex
+	config MediaProcessorConfig
+	// encodeSlots is the semaphore of EncodeConcurrency, nil when unlimited
+	encodeSlots chan struct{}
+}
+
+func NewMediaProcessor(config MediaProcessorConfig) *MediaProcessor {
+	mp := &MediaProcessor{config: config}
+	if config.EncodeConcurrency > 0 {
+		mp.encodeSlots = make(chan struct{}, config.EncodeConcurrency)
+	}
+	return mp
+}
+
+// acquireEncodeSlot waits for an encode slot until the context is done. The
+// returned func releases the slot.
+func (mp *MediaProcessor) acquireEncodeSlot(ctx context.Context) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if mp.encodeSlots == nil {
+		return func() {}, nil
+	}
+	encodeQueueDepth.Inc()
+	defer encodeQueueDepth.Dec()
+	select {
+	case mp.encodeSlots <- struct{}{}:
+		return func() { <-mp.encodeSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// UpdateConfig replaces the config of the running media processor
+func (mp *MediaProcessor) UpdateConfig(config MediaProcessorConfig) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.config = config
+}
+
+func (mp *MediaProcessor) getConfig() MediaProcessorConfig {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	return mp.config
+}
+
+// outputQuality returns the export quality of an output format, or 0 to use
+// the libvips default
+func (mp *MediaProcessor) outputQuality(format string, quality int) int {
+	if quality > 0 {
+		return quality
+	}
+	return mp.getConfig().DefaultQuality[format]
+}
+
+// AllowedOutputFormats returns the output formats that can be requested, or
+// nil when all of them are allowed
+func (mp *MediaProcessor) AllowedOutputFormats() []string {
+	return mp.getConfig().AllowedOutputFormats
+}
+
+// OutputFormatAllowed reports whether the output format can be requested
+func (mp *MediaProcessor) OutputFormatAllowed(format string) bool {
+	allowedFormats := mp.getConfig().AllowedOutputFormats
+	if len(allowedFormats) == 0 {
+		return true
+	}
+	for _, allowed := range allowedFormats {
+		if allowed == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTransformOptions checks the transform options and their limits in
+// the config without processing an image. An empty output format (negotiated
+// later) is valid.
+func (mp *MediaProcessor) ValidateTransformOptions(params *TransformOptions) error {
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	if err := mp.checkReadOptions(params.Read); err != nil {
+		return err
+	}
+	switch params.OutputFormat {
+	case "", "auto":
+	case "jpeg", "png", "webp", "avif", "gif":
+		if !mp.OutputFormatAllowed(params.OutputFormat) {
+			return fmt.Errorf("%w: output format %q is not allowed", ErrInvalidOption, params.OutputFormat)
+		}
+	default:
+		return fmt.Errorf("%w: invalid outputFormat parameter: %q", ErrInvalidOption, params.OutputFormat)
+	}
+	if resize := params.Resize; resize != nil {
+		config := mp.getConfig()
+		if config.MaxOutputWidth > 0 && resize.Width > config.MaxOutputWidth {
+			return fmt.Errorf("%w: resize width %d exceeds the max output width %d", ErrInvalidOption, resize.Width, config.MaxOutputWidth)
+		}
+		if config.MaxOutputHeight > 0 && resize.Height > config.MaxOutputHeight {
+			return fmt.Errorf("%w: resize height %d exceeds the max output height %d", ErrInvalidOption, resize.Height, config.MaxOutputHeight)
+		}
+	}
+	return nil
+}
+
+// DefaultMaxDimension returns the max dimension images are downscaled to with
+// the transform options, or 0 when the request resizes them itself
+func (mp *MediaProcessor) DefaultMaxDimension(params *TransformOptions) int {
+	if params.Resize != nil && params.Resize.hasSize() {
+		return 0
+	}
+	return mp.getConfig().DefaultMaxDimension
+}
+
+// inputFormats are the names of the input formats detected by libvips
+var inputFormats = map[vips.ImageType]string{
+	vips.ImageTypeJPEG:   "jpeg",
+	vips.ImageTypePNG:    "png",
+	vips.ImageTypeGIF:    "gif",
+	vips.ImageTypeWEBP:   "webp",
+	vips.ImageTypeAVIF:   "avif",
+	vips.ImageTypeHEIF:   "heif",
+	vips.ImageTypeSVG:    "svg",
+	vips.ImageTypePDF:    "pdf",
+	vips.ImageTypeTIFF:   "tiff",
+	vips.ImageTypeBMP:    "bmp",
+	vips.ImageTypeJP2K:   "jp2k",
+	vips.ImageTypeMagick: "magick",
+}
+
+// checkInputFormat checks the format of the source media against the allowed
+// input formats, so that non-images (like HTML error pages) aren't decoded
+func (mp *MediaProcessor) checkInputFormat(imageBytes []byte) error {
+	allowedFormats := mp.getConfig().AllowedInputFormats
+	if len(allowedFormats) == 0 {
+		return nil
+	}
+	format := inputFormats[vips.DetermineImageType(imageBytes)]
+	if format == "" {
+		format = "unknown"
+	}
+	for _, allowed := range allowedFormats {
+		if allowed == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s (detected content type %s)", ErrUnsupportedInputFormat, format, getContentType(imageBytes))
+}
+
+// checkReadOptions checks the read options against the config, so that
+// documents aren't rasterized at huge sizes
+func (mp *MediaProcessor) checkReadOptions(read ReadOptions) error {
+	if read.Dpi < 0 || read.Page < readAllPages || read.Scale < 0 {
+		return fmt.Errorf("%w: invalid read parameter: dpi and scale must not be negative, and page must be -1 (all pages) or more", ErrInvalidOption)
+	}
+	if read.Dpi > 0 && read.Scale > 0 {
+		return fmt.Errorf("%w: read.dpi and read.scale can't be combined", ErrInvalidOption)
+	}
+	if maxDpi := mp.getConfig().MaxDpi; maxDpi > 0 && read.density() > maxDpi {
+		return fmt.Errorf("%w: invalid read parameter: %d dpi exceeds the max dpi %d", ErrInvalidOption, read.density(), maxDpi)
+	}
+	return nil
+}
+
+// checkPixels checks the pixels of the loaded image, across all its pages,
+// against the max megapixels
+func (mp *MediaProcessor) checkPixels(image *vips.ImageRef) error {
+	maxMegapixels := mp.getConfig().MaxMegapixels
+	if maxMegapixels <= 0 {
+		return nil
+	}
+	// the loaded pages are stacked vertically, but all of them count even
+	// when only one is loaded
+	pageHeight, pages := image.PageHeight(), image.Pages()
+	if pageHeight <= 0 {
+		pageHeight = image.Height()
+	}
+	if pages < 1 {
+		pages = 1
+	}
+	megapixels := float64(image.Width()) * float64(pageHeight) * float64(pages) / 1e6
+	if megapixels > maxMegapixels {
+		return fmt.Errorf("%w: %.1f megapixels (%dx%d, %d pages) exceed the limit of %g", ErrImageTooLarge, megapixels, image.Width(), pageHeight, pages, maxMegapixels)
+	}
+	return nil
+}
+
+// fitMaxOutputSize shrinks an image larger than the max output size to fit within it
+func (mp *MediaProcessor) fitMaxOutputSize(image *vips.ImageRef) error {
+	config := mp.getConfig()
+	width, height := image.Width(), image.Height()
+	if (config.MaxOutputWidth <= 0 || width <= config.MaxOutputWidth) && (config.MaxOutputHeight <= 0 || height <= config.MaxOutputHeight) {
+		return nil
+	}
+	if config.MaxOutputWidth > 0 {
+		width = config.MaxOutputWidth
+	}
+	if config.MaxOutputHeight > 0 {
+		height = config.MaxOutputHeight
+	}
+	if err := image.ThumbnailWithSize(width, height, vips.InterestingNone, vips.SizeDown); err != nil {
+		return fmt.Errorf("failed to resize image: %w", err)
+	}
+	return nil
+}
+
+// resizeDimensions returns the target width and height of a resize. Percentages
+// are converted to pixels and a missing dimension is computed from the aspect
+// ratio of the image. Both are then
+// multiplied by the device pixel ratio and scaled down together to fit the max
+// output size, keeping their aspect ratio, while requested dimensions above it
+// are an error. When neither dimension is set, 0x0 is returned.
+func (mp *MediaProcessor) resizeDimensions(resize *TransformOptionsResize, dpr float64, imageWidth int, imageHeight int) (int, int, error) {
+	width, height := resize.Width, resize.Height
+	if !resize.hasSize() {
+		return 0, 0, nil
+	}
+	if imageWidth <= 0 || imageHeight <= 0 {
+		return 0, 0, fmt.Errorf("%w: invalid image dimensions %dx%d", ErrInvalidImage, imageWidth, imageHeight)
+	}
+	config := mp.getConfig()
+	maxWidth, maxHeight := config.MaxOutputWidth, config.MaxOutputHeight
+	if maxWidth > 0 && width > maxWidth {
+		return 0, 0, fmt.Errorf("%w: resize width %d exceeds the max output width %d", ErrInvalidOption, width, maxWidth)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		return 0, 0, fmt.Errorf("%w: resize height %d exceeds the max output height %d", ErrInvalidOption, height, maxHeight)
+	}
+	if resize.WidthPercent > 0 {
+		width = percentOf(imageWidth, resize.WidthPercent)
+	}
+	if resize.HeightPercent > 0 {
+		height = percentOf(imageHeight, resize.HeightPercent)
+	}
+	if width == 0 {
+		width = height * imageWidth / imageHeight
+	}
+	if height == 0 {
+		height = width * imageHeight / imageWidth
+	}
+	dpr = clampDpr(dpr)
+	scaledWidth, scaledHeight := float64(width)*dpr, float64(height)*dpr
+	scale := 1.0
+	if maxWidth > 0 && scaledWidth > float64(maxWidth) {
+		scale = float64(maxWidth) / scaledWidth
+	}
+	if maxHeight > 0 && scaledHeight*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / scaledHeight
+	}
+	width = int(math.Max(1, math.Round(scaledWidth*scale)))
+	height = int(math.Max(1, math.Round(scaledHeight*scale)))
+	return width, height, nil
+}
+
+// percentOf returns the percentage of a dimension, rounded to at least one pixel
+func percentOf(dimension int, percent float64) int {
+	value := int(math.Round(float64(dimension) * percent / 100))
+	if value < 1 {
+		return 1
+	}
+	return value
+}
+
+// clampDpr clamps the device pixel ratio between 1 and 4
+func clampDpr(dpr float64) float64 {
+	if !(dpr >= 1) {
+		return 1
+	}
+	if dpr > 4 {
+		return 4
+	}
+	return dpr
+}
+
+// selectFrames keeps the frames first to last (1-based, inclusive) of an
+// animated image. A single frame results in a static image.
+func selectFrames(img *vips.ImageRef, first int, last int) error {
+	pages := img.Pages()
+	if last > pages {
+		return fmt.Errorf("%w: frames %d-%d are outside the %d frames of the image", ErrInvalidOption, first, last, pages)
+	}
+	if first == 1 && last == pages {
+		return nil
+	}
+	pageHeight := img.PageHeight()
+	delays, err := img.PageDelay()
+	if err != nil {
+		return fmt.Errorf("failed to get frame delays: %w", err)
+	}
+	if err := extractFrames(img, first-1, last-first+1, pageHeight); err != nil {
+		return err
+	}
+	if err := img.SetPageHeight(pageHeight); err != nil {
+		return fmt.Errorf("failed to set page height: %w", err)
+	}
+	if len(delays) >= last {
+		if err := img.SetPageDelay(delays[first-1 : last]); err != nil {
+			return fmt.Errorf("failed to set frame delays: %w", err)
+		}
+	}
+	return nil
+}
+
+// extractFrames keeps count frames of an animated image, from the first
+// (0-based). The page height is reset to the height of the image first, as
+// ExtractArea extracts the area from each frame of animated images, and the
+// number of pages is updated, as govips rotates images with several pages
+// frame by frame.
+func extractFrames(img *vips.ImageRef, first int, count int, pageHeight int) error {
+	if err := img.SetPageHeight(img.Height()); err != nil {
+		return fmt.Errorf("failed to set page height: %w", err)
+	}
+	if err := img.ExtractArea(0, first*pageHeight, img.Width(), count*pageHeight); err != nil {
+		return fmt.Errorf("failed to extract frames: %w", err)
+	}
+	img.SetInt("n-pages", count)
+	return nil
+}
+
+// animatedOutputFormats are the output formats animated images stay animated
+// in, unless flatten=true
+var animatedOutputFormats = map[string]bool{
+	"gif":  true,
+	"webp": true,
+}
+
+// transformFrames transforms an image with transform, or each of its frames
+// when it's animated (with its frames stacked vertically), as resizing,
+// rotating or extending all of them at once would mix them up
+func transformFrames(img *vips.ImageRef, transform func(frame *vips.ImageRef) error) error {
+	pages, pageHeight := img.Pages(), img.PageHeight()
+	if pages <= 1 || pageHeight <= 0 || pageHeight*pages != img.Height() {
+		return transform(img)
+	}
+	delays, err := img.PageDelay()
+	if err != nil {
+		return fmt.Errorf("failed to get frame delays: %w", err)
+	}
+	frames := make([]*vips.ImageRef, 0, pages-1)
+	defer func() {
+		for _, frame := range frames {
+			frame.Close()
+		}
+	}()
+	for i := 1; i < pages; i++ {
+		frame, err := img.Copy()
+		if err != nil {
+			return fmt.Errorf("failed to copy image: %w", err)
+		}
+		frames = append(frames, frame)
+		if err := extractFrames(frame, i, 1, pageHeight); err != nil {
+			return err
+		}
+		if err := transform(frame); err != nil {
+			return err
+		}
+	}
+	// the first frame is transformed in place, and the others are joined below it
+	if err := extractFrames(img, 0, 1, pageHeight); err != nil {
+		return err
+	}
+	if err := transform(img); err != nil {
+		return err
+	}
+	frameHeight := img.Height()
+	if err := img.ArrayJoin(frames, 1); err != nil {
+		return fmt.Errorf("failed to join frames: %w", err)
+	}
+	img.SetInt("n-pages", pages)
+	if err := img.SetPageHeight(frameHeight); err != nil {
+		return fmt.Errorf("failed to set page height: %w", err)
+	}
+	if len(delays) > 0 {
+		if err := img.SetPageDelay(delays); err != nil {
+			return fmt.Errorf("failed to set frame delays: %w", err)
+		}
+	}
+	return nil
+}
+
+// firstPageMetadata reports the pages of an image loaded with all its pages
+// (stacked vertically) in the metadata, and extracts the first page from the
+// image, so that the height and previews are those of a single page
+func firstPageMetadata(img *vips.ImageRef, metadata *MetadataResponse) error {
+	pageHeight := img.PageHeight()
+	delays, err := img.PageDelay()
+	if err != nil {
+		return fmt.Errorf("failed to get frame delays: %w", err)
+	}
+	metadata.Height = pageHeight
+	metadata.Frames = make([]MetadataFrame, img.Pages())
+	for i := range metadata.Frames {
+		metadata.Frames[i] = MetadataFrame{Width: img.Width(), Height: pageHeight}
+		if i < len(delays) {
+			metadata.Frames[i].Delay = delays[i]
+		}
+	}
+	if err := extractFrames(img, 0, 1, pageHeight); err != nil {
+		return err
+	}
+	return nil
 }
 
-func NewMediaProcessor() *MediaProcessor {
-	return &MediaProcessor{}
+// pixelate replaces blocks of factor x factor pixels of the image, or the
+// region of it, with their average color
+func pixelate(img *vips.ImageRef, factor int, region *TransformOptionsCropRegion) error {
+	target := img
+	if region != nil {
+		if region.Left+region.Width > img.Width() || region.Top+region.Height > img.Height() {
+			return fmt.Errorf("%w: pixelate region %dx%d+%d+%d is outside the %dx%d image", ErrInvalidOption, region.Width, region.Height, region.Left, region.Top, img.Width(), img.Height())
+		}
+		sub, err := img.Copy()
+		if err != nil {
+			return fmt.Errorf("failed to copy image: %w", err)
+		}
+		defer sub.Close()
+		if err := sub.ExtractArea(region.Left, region.Top, region.Width, region.Height); err != nil {
+			return fmt.Errorf("failed to extract pixelate region: %w", err)
+		}
+		target = sub
+	}
+	// the image is shrunk to a pixel per block (averaging them), and enlarged
+	// back to its size with the nearest neighbour, which keeps the blocks sharp
+	width, height := target.Width(), target.Height()
+	blocksX, blocksY := (width+factor-1)/factor, (height+factor-1)/factor
+	if err := target.ResizeWithVScale(float64(blocksX)/float64(width), float64(blocksY)/float64(height), vips.KernelLinear); err != nil {
+		return fmt.Errorf("failed to pixelate image: %w", err)
+	}
+	if err := target.ResizeWithVScale(float64(width)/float64(target.Width()), float64(height)/float64(target.Height()), vips.KernelNearest); err != nil {
+		return fmt.Errorf("failed to pixelate image: %w", err)
+	}
+	if region != nil {
+		if err := img.Insert(target, region.Left, region.Top, false, nil); err != nil {
+			return fmt.Errorf("failed to insert pixelate region: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyGamma maps every color band through a lookup table of
+// max * (in / max) ^ (1 / gamma), so that values above 1 lighten the midtones
+// and values below 1 darken them. libvips' own gamma operation isn't exposed by
+// govips. Alpha is left unchanged.
+func applyGamma(img *vips.ImageRef, gamma float64) error {
+	if format := img.BandFormat(); format != vips.BandFormatUchar && format != vips.BandFormatUshort {
+		if err := img.Cast(vips.BandFormatUchar); err != nil {
+			return fmt.Errorf("failed to cast image: %w", err)
+		}
+	}
+	lut, err := gammaLUT(gamma, img.BandFormat() == vips.BandFormatUshort)
+	if err != nil {
+		return err
+	}
+	defer lut.Close()
+	if !img.HasAlpha() {
+		return img.Maplut(lut)
+	}
+	alpha, err := img.Copy()
+	if err != nil {
+		return fmt.Errorf("failed to copy image: %w", err)
+	}
+	defer alpha.Close()
+	if err := alpha.ExtractBand(img.Bands()-1, 1); err != nil {
+		return fmt.Errorf("failed to extract alpha: %w", err)
+	}
+	if err := img.ExtractBand(0, img.Bands()-1); err != nil {
+		return fmt.Errorf("failed to extract color bands: %w", err)
+	}
+	if err := img.Maplut(lut); err != nil {
+		return err
+	}
+	return img.BandJoin(alpha)
+}
+
+// gammaLUT returns a one band lookup table for 8 or 16 bit images. It's built as
+// a grayscale PNG, the only way to hand pixel values to govips.
+func gammaLUT(gamma float64, sixteenBit bool) (*vips.ImageRef, error) {
+	var lut image.Image
+	if sixteenBit {
+		gray := image.NewGray16(image.Rect(0, 0, 65536, 1))
+		for i := 0; i < 65536; i++ {
+			gray.SetGray16(i, 0, color.Gray16{Y: uint16(math.Round(65535 * math.Pow(float64(i)/65535, 1/gamma)))})
+		}
+		lut = gray
+	} else {
+		gray := image.NewGray(image.Rect(0, 0, 256, 1))
+		for i := 0; i < 256; i++ {
+			gray.SetGray(i, 0, color.Gray{Y: uint8(math.Round(255 * math.Pow(float64(i)/255, 1/gamma)))})
+		}
+		lut = gray
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, lut); err != nil {
+		return nil, fmt.Errorf("failed to encode gamma lookup table: %w", err)
+	}
+	return vips.NewImageFromBuffer(buf.Bytes())
+}
+
+// colorProfiles maps the color profiles that can be requested to the libvips
+// built-in profile they're converted to. keep leaves the colors unchanged.
+var colorProfiles = map[string]string{
+	"keep": "",
+	"srgb": "srgb",
+	"p3":   "p3",
+}
+
+// convertColorProfile converts the image to a color profile. Images without an
+// embedded profile are assumed to be sRGB.
+func convertColorProfile(img *vips.ImageRef, profile string) error {
+	builtinProfile := colorProfiles[profile]
+	if builtinProfile == "" || (builtinProfile == "srgb" && !img.HasICCProfile()) {
+		return nil
+	}
+	if err := img.TransformICCProfile(builtinProfile); err != nil {
+		return fmt.Errorf("failed to convert to the %s color profile: %w", profile, err)
+	}
+	return nil
 }
 
 func getContentType(imageBytes []byte) string {
@@ -79,7 +1081,7 @@ func parseVipsInteresting(interesting string) (vips.Interesting, error) {
 	case "last":
 		return vips.InterestingLast, nil
 	default:
-		return 0, fmt.Errorf("invalid interesting parameter: %s", interesting)
+		return 0, fmt.Errorf("%w: invalid interesting parameter: %s", ErrInvalidOption, interesting)
 	}
 }
 
@@ -96,39 +1098,283 @@ func parseVipsSize(size string) (vips.Size, error) {
 	case "last":
 		return vips.SizeLast, nil
 	default:
-		return 0, fmt.Errorf("invalid size parameter: %s", size)
+		return 0, fmt.Errorf("%w: invalid size parameter: %s", ErrInvalidOption, size)
+	}
+}
+
+// parseGravity returns the horizontal and vertical position (from 0 to 1) of the area kept for a gravity
+func parseGravity(gravity string) (float64, float64, error) {
+	switch gravity {
+	case "center", "centre":
+		return 0.5, 0.5, nil
+	case "north":
+		return 0.5, 0, nil
+	case "south":
+		return 0.5, 1, nil
+	case "east":
+		return 1, 0.5, nil
+	case "west":
+		return 0, 0.5, nil
+	case "northeast":
+		return 1, 0, nil
+	case "northwest":
+		return 0, 0, nil
+	case "southeast":
+		return 1, 1, nil
+	case "southwest":
+		return 0, 1, nil
+	default:
+		return 0, 0, fmt.Errorf("%w: invalid gravity parameter: %s (must be one of center, north, south, east, west, northeast, northwest, southeast, southwest)", ErrInvalidOption, gravity)
+	}
+}
+
+// cropToAspectRatio crops the image to the aspect ratio of width x height, keeping the area at the gravity position
+func cropToAspectRatio(img *vips.ImageRef, width, height int, gravity string) error {
+	x, y, err := parseGravity(gravity)
+	if err != nil {
+		return err
+	}
+	cropWidth, cropHeight := img.Width(), img.Height()
+	if cropWidth*height > cropHeight*width {
+		cropWidth = int(math.Round(float64(cropHeight) * float64(width) / float64(height)))
+	} else {
+		cropHeight = int(math.Round(float64(cropWidth) * float64(height) / float64(width)))
+	}
+	if cropWidth == img.Width() && cropHeight == img.Height() {
+		return nil
+	}
+	left := int(math.Round(float64(img.Width()-cropWidth) * x))
+	top := int(math.Round(float64(img.Height()-cropHeight) * y))
+	return img.ExtractArea(left, top, cropWidth, cropHeight)
+}
+
+// cropAroundFocus scales the image to cover width x height (as far as size
+// allows) and crops it to that size, with the focal point at x, y (from 0 to 1)
+// as close to the centre as the image bounds allow
+func cropAroundFocus(img *vips.ImageRef, width, height int, size vips.Size, x, y float64) error {
+	scale := math.Max(float64(width)/float64(img.Width()), float64(height)/float64(img.Height()))
+	if (size == vips.SizeDown && scale > 1) || (size == vips.SizeUp && scale < 1) {
+		scale = 1
+	}
+	scaledWidth := int(math.Max(1, math.Round(float64(img.Width())*scale)))
+	scaledHeight := int(math.Max(1, math.Round(float64(img.Height())*scale)))
+	if scaledWidth != img.Width() || scaledHeight != img.Height() {
+		if err := img.ThumbnailWithSize(scaledWidth, scaledHeight, vips.InterestingNone, vips.SizeForce); err != nil {
+			return err
+		}
+	}
+	cropWidth, cropHeight := width, height
+	if cropWidth > scaledWidth {
+		cropWidth = scaledWidth
+	}
+	if cropHeight > scaledHeight {
+		cropHeight = scaledHeight
+	}
+	if cropWidth == scaledWidth && cropHeight == scaledHeight {
+		return nil
+	}
+	left := clampInt(int(math.Round(x*float64(scaledWidth)-float64(cropWidth)/2)), 0, scaledWidth-cropWidth)
+	top := clampInt(int(math.Round(y*float64(scaledHeight)-float64(cropHeight)/2)), 0, scaledHeight-cropHeight)
+	return img.ExtractArea(left, top, cropWidth, cropHeight)
+}
+
+// clampInt limits value to the range from low to high
+func clampInt(value, low, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
 	}
+	return value
 }
 
-func (mp *MediaProcessor) ProcessTransformRequest(imageBytes []byte, params *TransformOptions) ([]byte, string, error) {
+// trimImage removes the border around the image that has the same color as its
+// top-left pixel. Images without a border, or with a single color, are left as is.
+func trimImage(img *vips.ImageRef, threshold float64) error {
+	if threshold == 0 {
+		threshold = 10
+	}
+	point, err := img.GetPoint(0, 0)
+	if err != nil {
+		return err
+	}
+	var background *vips.Color
+	switch {
+	case len(point) >= 3:
+		background = &vips.Color{R: uint8(point[0]), G: uint8(point[1]), B: uint8(point[2])}
+	case len(point) >= 1:
+		background = &vips.Color{R: uint8(point[0]), G: uint8(point[0]), B: uint8(point[0])}
+	}
+	left, top, width, height, err := img.FindTrim(threshold, background)
+	if err != nil {
+		return err
+	}
+	if width <= 0 || height <= 0 || (width == img.Width() && height == img.Height()) {
+		return nil
+	}
+	return img.ExtractArea(left, top, width, height)
+}
+
+func parseVipsAngle(rotate int) (vips.Angle, error) {
+	switch rotate {
+	case 0:
+		return vips.Angle0, nil
+	case 90:
+		return vips.Angle90, nil
+	case 180:
+		return vips.Angle180, nil
+	case 270:
+		return vips.Angle270, nil
+	default:
+		return 0, fmt.Errorf("%w: invalid rotate parameter: %d (must be 0, 90, 180 or 270)", ErrInvalidOption, rotate)
+	}
+}
+
+// parseHexColor parses a hex color like ffffff, #ffffff or fff
+func parseHexColor(hex string) (*vips.Color, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("%w: invalid hex color: %q", ErrInvalidOption, hex)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid hex color: %q", ErrInvalidOption, hex)
+	}
+	return &vips.Color{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb)}, nil
+}
+
+// TransformResult is a transformed image
+type TransformResult struct {
+	Data        []byte
+	ContentType string
+	// Width and Height are the size of the output (of a frame of animated
+	// images), 0 for raw outputs which aren't decoded
+	Width  int
+	Height int
+}
+
+// ProcessTransformRequest transforms the image, returning the output and its
+// content type
+func (mp *MediaProcessor) ProcessTransformRequest(ctx context.Context, imageBytes []byte, params *TransformOptions) ([]byte, string, error) {
+	result, err := mp.ProcessTransform(ctx, imageBytes, params)
+	if err != nil {
+		return nil, "", err
+	}
+	return result.Data, result.ContentType, nil
+}
+
+// ProcessTransform transforms the image like ProcessTransformRequest, also
+// returning the size of the output
+func (mp *MediaProcessor) ProcessTransform(ctx context.Context, imageBytes []byte, params *TransformOptions) (*TransformResult, error) {
+	_, span := tracer.Start(ctx, "ProcessTransformRequest", trace.WithAttributes(attribute.String("output.format", params.OutputFormat)))
+	defer span.End()
 	// Load the image using libvips
 	log.Debug().Int("size", len(imageBytes)).Interface("params", params).Msg("Processing tranform request")
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if err := mp.checkReadOptions(params.Read); err != nil {
+		return nil, err
+	}
 	importParams := vips.NewImportParams()
-	if params.Read.Dpi > 0 {
-		importParams.Density.Set(params.Read.Dpi)
+	if density := params.Read.density(); density > 0 {
+		importParams.Density.Set(density)
+	}
+	firstFrame, lastFrame, selectsFrames, err := params.frameRange()
+	if err != nil {
+		return nil, err
 	}
 	if params.Read.Page > 0 {
 		importParams.Page.Set(params.Read.Page - 1)
+	} else if selectsFrames || (animatedOutputFormats[params.OutputFormat] && !params.Flatten) {
+		// load all the frames, so that animated images stay animated
+		importParams.NumPages.Set(-1)
 	}
 	if params.Raw {
-		return imageBytes, getContentType(imageBytes), nil
+		return &TransformResult{Data: imageBytes, ContentType: getContentType(imageBytes)}, nil
+	}
+	if err := mp.checkInputFormat(imageBytes); err != nil {
+		return nil, err
+	}
+	angle, err := parseVipsAngle(params.Rotate)
+	if err != nil {
+		return nil, err
 	}
 
+	// libvips operations can't be cancelled, so the context is checked between them
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	loadStartTime := time.Now()
 	image, err := vips.LoadImageFromBuffer(imageBytes, importParams)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to load image: %v", err)
+		return nil, fmt.Errorf("%w: failed to load image: %v", ErrUndecodableImage, err)
 	}
 	defer image.Close()
+	// the output format is checked once the image is loaded, so that media that
+	// can't be decoded is reported as such (and can be passed through)
+	if params.OutputFormat != "auto" && !mp.OutputFormatAllowed(params.OutputFormat) {
+		return nil, fmt.Errorf("%w: output format %q is not allowed", ErrInvalidOption, params.OutputFormat)
+	}
+	observeProcessStage("load", params.OutputFormat, loadStartTime)
+	span.SetAttributes(attribute.Int("image.width", image.Width()), attribute.Int("image.height", image.Height()))
+	if err := mp.checkPixels(image); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// height := image.Height() * width / image.Width()
-	if resize := params.Resize; resize != nil {
-		width := resize.Width
-		height := resize.Height
-		if width == 0 {
-			width = height * image.Width() / image.Height()
+	// vector images rendered at a higher density are shrunk to the max output size
+	if format := image.Format(); params.Read.density() > 0 && (format == vips.ImageTypeSVG || format == vips.ImageTypePDF) {
+		if err := mp.fitMaxOutputSize(image); err != nil {
+			return nil, err
+		}
+	}
+
+	if selectsFrames {
+		if err := selectFrames(image, firstFrame, lastFrame); err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the EXIF orientation before any other transform, so that explicit
+	// rotation and resizing are relative to the upright image
+	if params.AutoRotate {
+		if err := image.AutoRotate(); err != nil {
+			return nil, fmt.Errorf("failed to auto-rotate image: %w", err)
+		}
+		if err := image.RemoveOrientation(); err != nil {
+			return nil, fmt.Errorf("failed to remove orientation: %w", err)
 		}
-		if height == 0 {
-			height = width * image.Height() / image.Width()
+	}
+
+	if trim := params.Trim; trim != nil && (trim.Enabled || trim.Threshold > 0) {
+		if err := trimImage(image, trim.Threshold); err != nil {
+			return nil, fmt.Errorf("failed to trim image: %w", err)
+		}
+	}
+
+	if region := params.CropRegion; region != nil {
+		if region.Left+region.Width > image.Width() || region.Top+region.Height > image.Height() {
+			return nil, fmt.Errorf("%w: crop region %dx%d+%d+%d is outside the %dx%d image", ErrInvalidOption, region.Width, region.Height, region.Left, region.Top, image.Width(), image.Height())
+		}
+		if err := image.ExtractArea(region.Left, region.Top, region.Width, region.Height); err != nil {
+			return nil, fmt.Errorf("failed to crop image: %w", err)
+		}
+	}
+
+	// height := image.Height() * width / image.Width()
+	// a resize without width and height (like resize.crop alone) leaves the size unchanged
+	if resize := params.Resize; resize != nil && resize.hasSize() {
+		// the frames of animated images are resized, rather than all of them stacked
+		width, height, err := mp.resizeDimensions(resize, params.Dpr, image.Width(), image.PageHeight())
+		if err != nil {
+			return nil, err
 		}
 		// switch resize.Method {
 		// case "fill":
@@ -142,78 +1388,409 @@ func (mp *MediaProcessor) ProcessTransformRequest(imageBytes []byte, params *Tra
 		// }
 		crop, err := parseVipsInteresting(resize.Crop)
 		if err != nil {
-			return nil, "", fmt.Errorf("invalid crop parameter: %w", err)
+			return nil, fmt.Errorf("invalid crop parameter: %w", err)
 		}
 		size, err := parseVipsSize(resize.Size)
 		if err != nil {
-			return nil, "", fmt.Errorf("invalid size parameter: %w", err)
+			return nil, fmt.Errorf("invalid size parameter: %w", err)
+		}
+		if fit, ok := resizeFits[resize.Fit]; ok {
+			crop, size = fit.crop, fit.size
+		}
+		resizeStartTime := time.Now()
+		err = transformFrames(image, func(frame *vips.ImageRef) error {
+			if resize.Gravity != "" && width > 0 && height > 0 {
+				if err := cropToAspectRatio(frame, width, height, resize.Gravity); err != nil {
+					return fmt.Errorf("failed to crop image: %w", err)
+				}
+			}
+			if resize.Focus != nil && width > 0 && height > 0 {
+				x, y := resize.Focus.point()
+				if err := cropAroundFocus(frame, width, height, size, x, y); err != nil {
+					return fmt.Errorf("failed to crop image: %w", err)
+				}
+				return nil
+			}
+			if err := frame.ThumbnailWithSize(width, height, crop, size); err != nil {
+				return fmt.Errorf("failed to resize image: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		observeProcessStage("resize", params.OutputFormat, resizeStartTime)
+	} else if maxDimension := mp.DefaultMaxDimension(params); maxDimension > 0 {
+		resizeStartTime := time.Now()
+		err := transformFrames(image, func(frame *vips.ImageRef) error {
+			if err := frame.ThumbnailWithSize(maxDimension, maxDimension, vips.InterestingNone, vips.SizeDown); err != nil {
+				return fmt.Errorf("failed to resize image: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		observeProcessStage("resize", params.OutputFormat, resizeStartTime)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Brightness multiplies the pixel values and contrast scales them around
+	// mid-grey, so both are combined into a single linear transform:
+	// out = (in * brightness - grey) * contrast + grey. Gamma is applied
+	// afterwards. A brightness of 0 makes the image black, and a contrast of 0
+	// makes it flat grey. grey is scaled to the range of 16-bit images, which
+	// are cast back to their format, as the result of the transform is float.
+	if params.Brightness != 1 || params.Contrast != 1 {
+		format := image.BandFormat()
+		if format != vips.BandFormatUchar && format != vips.BandFormatUshort {
+			format = vips.BandFormatUchar
+		}
+		grey := 128.0
+		if format == vips.BandFormatUshort {
+			grey = 128.0 * 65535 / 255
+		}
+		a := make([]float64, image.Bands())
+		b := make([]float64, image.Bands())
+		for band := range a {
+			a[band], b[band] = params.Brightness*params.Contrast, grey*(1-params.Contrast)
+		}
+		if image.HasAlpha() {
+			a[len(a)-1], b[len(b)-1] = 1, 0
 		}
-		err = image.ThumbnailWithSize(width, height, crop, size)
+		if err := image.Linear(a, b); err != nil {
+			return nil, fmt.Errorf("failed to adjust brightness and contrast: %w", err)
+		}
+		if err := image.Cast(format); err != nil {
+			return nil, fmt.Errorf("failed to cast image: %w", err)
+		}
+	}
+	if params.Gamma != 0 && params.Gamma != 1 {
+		if err := applyGamma(image, params.Gamma); err != nil {
+			return nil, fmt.Errorf("failed to adjust gamma: %w", err)
+		}
+	}
+
+	if params.Pixelate > 0 {
+		if err := pixelate(image, params.Pixelate, params.PixelateRegion); err != nil {
+			return nil, err
+		}
+	}
+
+	// Blur after resizing, as large sigmas are slow on large images
+	if params.Blur > 0 {
+		if err := image.GaussianBlur(params.Blur); err != nil {
+			return nil, fmt.Errorf("failed to blur image: %w", err)
+		}
+	}
+	if params.Sharpen > 0 {
+		// x1 (flat/jaggy threshold) and m2 (jaggy slope) use the libvips defaults;
+		// the sigma controls the radius of the unsharp mask
+		if err := image.Sharpen(params.Sharpen, 2, 3); err != nil {
+			return nil, fmt.Errorf("failed to sharpen image: %w", err)
+		}
+	}
+
+	// Extend after resizing, so that the final dimensions include the padding
+	extend := params.Extend
+	if extend != nil && !(extend.Top > 0 || extend.Right > 0 || extend.Bottom > 0 || extend.Left > 0) {
+		extend = nil
+	}
+	background := &vips.Color{}
+	if extend != nil && extend.Background != "" {
+		if background, err = parseHexColor(extend.Background); err != nil {
+			return nil, fmt.Errorf("invalid extend background parameter: %w", err)
+		}
+	}
+	if angle != vips.Angle0 || params.FlipH || params.FlipV || extend != nil {
+		// rotating, flipping or extending the stacked frames of animated images
+		// would move them around, so each frame is transformed on its own
+		err := transformFrames(image, func(frame *vips.ImageRef) error {
+			if angle != vips.Angle0 {
+				if err := frame.Rotate(angle); err != nil {
+					return fmt.Errorf("failed to rotate image: %w", err)
+				}
+			}
+			if params.FlipH {
+				if err := frame.Flip(vips.DirectionHorizontal); err != nil {
+					return fmt.Errorf("failed to flip image: %w", err)
+				}
+			}
+			if params.FlipV {
+				if err := frame.Flip(vips.DirectionVertical); err != nil {
+					return fmt.Errorf("failed to flip image: %w", err)
+				}
+			}
+			if extend == nil {
+				return nil
+			}
+			width := frame.Width() + extend.Left + extend.Right
+			height := frame.Height() + extend.Top + extend.Bottom
+			if config := mp.getConfig(); (config.MaxOutputWidth > 0 && width > config.MaxOutputWidth) || (config.MaxOutputHeight > 0 && height > config.MaxOutputHeight) {
+				return fmt.Errorf("%w: extended size %dx%d exceeds the max output size", ErrInvalidOption, width, height)
+			}
+			if err := frame.EmbedBackground(extend.Left, extend.Top, width, height, background); err != nil {
+				return fmt.Errorf("failed to extend image: %w", err)
+			}
+			return nil
+		})
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to resize image: %w", err)
+			return nil, err
+		}
+	}
+
+	// outputFormat=auto is picked from the transformed image
+	if params.OutputFormat == "auto" {
+		if params.OutputFormat, err = mp.autoOutputFormat(image, params.AutoFormats); err != nil {
+			return nil, err
 		}
+		span.SetAttributes(attribute.String("output.format", params.OutputFormat))
 	}
 
+	// Flatten transparent images onto the background color for output formats without alpha
+	if params.Background != "" && params.OutputFormat == "jpeg" && image.HasAlpha() {
+		background, err := parseHexColor(params.Background)
+		if err != nil {
+			return nil, fmt.Errorf("invalid background parameter: %w", err)
+		}
+		if err := image.Flatten(background); err != nil {
+			return nil, fmt.Errorf("failed to flatten image: %w", err)
+		}
+	}
+
+	colorProfile := params.ColorProfile
+	if colorProfile == "" {
+		colorProfile = mp.getConfig().DefaultColorProfile
+	}
+	if err := convertColorProfile(image, colorProfile); err != nil {
+		return nil, err
+	}
+	// Outputs in other color spaces than sRGB need their profile, so only the
+	// other metadata is stripped from them
+	stripMetadata := params.StripMetadata
+	if stripMetadata && colorProfile == "p3" {
+		if err := image.RemoveMetadata("icc-profile-data"); err != nil {
+			return nil, fmt.Errorf("failed to remove metadata: %w", err)
+		}
+		stripMetadata = false
+	}
+
+	span.SetAttributes(attribute.Int("output.width", image.Width()), attribute.Int("output.height", image.Height()))
+	release, err := mp.acquireEncodeSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer observeProcessStage("encode", params.OutputFormat, time.Now())
+	quality := mp.outputQuality(params.OutputFormat, params.Quality)
+	var out []byte
+	var contentType string
+	if params.TargetBytes > 0 && targetBytesFormats[params.OutputFormat] {
+		out, contentType, err = mp.encodeTargetBytes(ctx, image, params, quality, stripMetadata)
+	} else {
+		out, contentType, err = encode(image, params, quality, stripMetadata)
+	}
+	if err != nil {
+		return nil, err
+	}
+	height := image.PageHeight()
+	if height <= 0 {
+		height = image.Height()
+	}
+	return &TransformResult{Data: out, ContentType: contentType, Width: image.Width(), Height: height}, nil
+}
+
+// encode exports the image in the output format of params, with the quality
+// (0 for the libvips default) of the lossy formats
+func encode(image *vips.ImageRef, params *TransformOptions, quality int, stripMetadata bool) ([]byte, string, error) {
 	switch params.OutputFormat {
 	case "jpeg":
 		ep := vips.NewDefaultJPEGExportParams()
+		if quality > 0 {
+			ep.Quality = quality
+		}
+		ep.StripMetadata = stripMetadata
 		outputBytes, _, err := image.Export(ep)
 		return outputBytes, "image/jpeg", err
 	case "png":
 		ep := vips.NewDefaultPNGExportParams()
+		ep.StripMetadata = stripMetadata
 		outputBytes, _, err := image.Export(ep)
 		return outputBytes, "image/png", err
 	case "avif":
 		ep := vips.NewAvifExportParams()
+		if quality > 0 {
+			ep.Quality = quality
+		}
+		ep.Lossless = params.Lossless
+		ep.StripMetadata = stripMetadata
+		if params.Effort != nil {
+			ep.Effort = *params.Effort
+		}
 		outputBytes, _, err := image.ExportAvif(ep)
 		return outputBytes, "image/avif", err
 	case "webp":
 		ep := vips.NewWebpExportParams()
+		if quality > 0 {
+			ep.Quality = quality
+		}
+		ep.Lossless = params.Lossless
+		if params.NearLossless {
+			// libvips uses the quality as the near-lossless level
+			ep.NearLossless = true
+			if params.NearLosslessLevel > 0 {
+				ep.Quality = params.NearLosslessLevel
+			}
+		}
+		ep.StripMetadata = stripMetadata
+		if params.Effort != nil {
+			ep.ReductionEffort = *params.Effort
+		}
 		outputBytes, _, err := image.ExportWebp(ep)
 		return outputBytes, "image/webp", err
+	case "gif":
+		ep := vips.NewGifExportParams()
+		if quality > 0 {
+			ep.Quality = quality
+		}
+		ep.StripMetadata = stripMetadata
+		outputBytes, _, err := image.ExportGIF(ep)
+		return outputBytes, "image/gif", err
 	default:
 		return nil, "", fmt.Errorf("invalid output format: %s", params.OutputFormat)
 	}
 }
 
+type ExifGPS struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type ExifMetadata struct {
+	Make        string   `json:"make,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	DateTime    string   `json:"datetime,omitempty"`
+	Orientation int      `json:"orientation,omitempty"`
+	GPS         *ExifGPS `json:"gps,omitempty"`
+}
+
+// MetadataFrame is a page (or frame) of multi-page media, reported with read.page=-1
+type MetadataFrame struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Delay is the duration of animation frames in milliseconds
+	Delay int `json:"delay,omitempty"`
+}
+
 type MetadataResponse struct {
-	Width      int    `json:"width"`
-	Height     int    `json:"height"`
-	NoOfPages  int    `json:"noOfPages"`
-	Format     string `json:"format"`
-	Blurhash   string `json:"blurhash,omitempty"`
-	Thumbhash  string `json:"thumbhash,omitempty"`
-	PotatoWebp string `json:"potatowebp,omitempty"`
+	Width        int           `json:"width"`
+	Height       int           `json:"height"`
+	NoOfPages    int           `json:"noOfPages"`
+	Format       string        `json:"format"`
+	HasAlpha     bool          `json:"hasAlpha"`
+	Animated     bool          `json:"animated"`
+	Blurhash     string        `json:"blurhash,omitempty"`
+	Thumbhash    string        `json:"thumbhash,omitempty"`
+	PotatoWebp   string        `json:"potatowebp,omitempty"`
+	AverageColor string        `json:"averageColor,omitempty"`
+	Palette      []string      `json:"palette,omitempty"`
+	Exif         *ExifMetadata `json:"exif,omitempty"`
+
+	// Frames are the pages of multi-page media loaded with read.page=-1
+	Frames []MetadataFrame `json:"frames,omitempty"`
 }
 
-func (mp *MediaProcessor) ProcessMetadataRequest(imageBytes []byte, params *MetadataOptions) ([]byte, error) {
+// ProcessMetadataRequest returns the JSON encoded metadata of the image. Like
+// ProcessTransformRequest, it returns the context's error when the context is
+// done between the processing stages.
+func (mp *MediaProcessor) ProcessMetadataRequest(ctx context.Context, imageBytes []byte, params *MetadataOptions) ([]byte, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if err := mp.checkReadOptions(params.Read); err != nil {
+		return nil, err
+	}
 	importParams := vips.NewImportParams()
-	if params.Read.Dpi > 0 {
-		importParams.Density.Set(params.Read.Dpi)
+	if density := params.Read.density(); density > 0 {
+		importParams.Density.Set(density)
 	}
+	// only the first page is loaded by default, as loading all of them is
+	// slower. Some formats report the number of pages only when all are loaded.
+	allPages := params.Read.Page == readAllPages
 	if params.Read.Page > 0 {
 		importParams.Page.Set(params.Read.Page - 1)
+	} else if allPages {
+		importParams.NumPages.Set(-1)
+	}
+	if err := mp.checkInputFormat(imageBytes); err != nil {
+		return nil, err
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	img, err := vips.LoadImageFromBuffer(imageBytes, importParams)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load image: %v", err)
+		return nil, fmt.Errorf("%w: failed to load image: %v", ErrUndecodableImage, err)
 	}
 	defer img.Close()
+	if err := mp.checkPixels(img); err != nil {
+		return nil, err
+	}
 
 	metadata := MetadataResponse{
 		Width:     img.Width(),
 		Height:    img.Height(),
 		NoOfPages: img.Pages(),
 		Format:    vips.ImageTypes[img.Format()],
+		HasAlpha:  img.HasAlpha(),
+		// the pages of documents aren't frames
+		Animated: img.Pages() > 1 && img.Format() != vips.ImageTypePDF,
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if allPages && img.Pages() > 1 {
+		if err := firstPageMetadata(img, &metadata); err != nil {
+			return nil, err
+		}
+	}
+	if exif := params.Exif; exif != nil && (exif.Enabled || exif.GPS) {
+		metadata.Exif = readExif(img, exif.GPS)
 	}
-	if params.BlurHash || params.ThumbHash || params.PotatoWebp {
+	blurHash := params.includesBlurHash()
+	if blurHash || params.ThumbHash || params.PotatoWebp || params.AverageColor || params.Palette > 0 {
 		err := img.Resize(16.0/float64(img.Width()), vips.KernelNearest)
 		if err != nil {
 			return nil, fmt.Errorf("failed to resize image: %v", err)
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if params.AverageColor {
+		averageColor, err := averageColor(img)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute average color: %v", err)
+		}
+		metadata.AverageColor = averageColor
+	}
+	if params.Palette > 0 {
+		ep := vips.NewPngExportParams()
+		ep.StripMetadata = true
+		outputBytes, _, err := img.ExportPng(ep)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export image: %v", err)
+		}
+		gimg, _, err := image.Decode(bytes.NewReader(outputBytes))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %v", err)
+		}
+		metadata.Palette = extractPalette(gimg, params.Palette)
 	}
-	if params.BlurHash {
+	if blurHash {
 		ep := vips.NewDefaultJPEGExportParams()
 		ep.Quality = 10
 		outputBytes, _, err := img.Export(ep)
@@ -224,7 +1801,8 @@ func (mp *MediaProcessor) ProcessMetadataRequest(imageBytes []byte, params *Meta
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode image: %v", err)
 		}
-		hash, err := blurhash.Encode(5, 5, gimg)
+		x, y := params.BlurHash.components()
+		hash, err := blurhash.Encode(x, y, gimg)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode blurhash: %v", err)
 		}
@@ -264,3 +1842,122 @@ func (mp *MediaProcessor) ProcessMetadataRequest(imageBytes []byte, params *Meta
 	}
 	return res, nil
 }
+
+// averageColor returns the mean color of the image as a hex string, ignoring
+// the alpha band. Grayscale images return a gray color, and 16 bit images are
+// scaled down to 8 bits.
+func averageColor(img *vips.ImageRef) (string, error) {
+	scale := 1.0
+	if img.BandFormat() == vips.BandFormatUshort {
+		scale = 255.0 / 65535
+	}
+	colorBands := img.Bands()
+	if img.HasAlpha() {
+		colorBands--
+	}
+	if colorBands > 3 {
+		colorBands = 3
+	}
+	var means []float64
+	for band := 0; band < colorBands; band++ {
+		bandImg, err := img.Copy()
+		if err != nil {
+			return "", err
+		}
+		if err := bandImg.ExtractBand(band, 1); err != nil {
+			bandImg.Close()
+			return "", err
+		}
+		mean, err := bandImg.Average()
+		bandImg.Close()
+		if err != nil {
+			return "", err
+		}
+		means = append(means, math.Max(0, math.Min(255, math.Round(mean*scale))))
+	}
+	if len(means) == 0 {
+		return "", errors.New("image has no color bands")
+	}
+	for len(means) < 3 {
+		means = append(means, means[0])
+	}
+	return fmt.Sprintf("#%02x%02x%02x", uint8(means[0]), uint8(means[1]), uint8(means[2])), nil
+}
+
+// readExif reads the EXIF fields of the image. GPS coordinates are only
+// included when includeGPS is set.
+func readExif(img *vips.ImageRef, includeGPS bool) *ExifMetadata {
+	fields := map[string]bool{}
+	for _, field := range img.ImageFields() {
+		fields[field] = true
+	}
+	get := func(name string) string {
+		if !fields[name] {
+			return ""
+		}
+		return parseExifValue(img.GetString(name))
+	}
+
+	exif := &ExifMetadata{
+		Make:     get("exif-ifd0-Make"),
+		Model:    get("exif-ifd0-Model"),
+		DateTime: get("exif-ifd2-DateTimeOriginal"),
+	}
+	if exif.DateTime == "" {
+		exif.DateTime = get("exif-ifd0-DateTime")
+	}
+	if fields["orientation"] {
+		exif.Orientation = img.GetInt("orientation")
+	}
+	if includeGPS {
+		latitude, latOk := parseExifGPSCoordinate(get("exif-ifd3-GPSLatitude"), get("exif-ifd3-GPSLatitudeRef"))
+		longitude, lonOk := parseExifGPSCoordinate(get("exif-ifd3-GPSLongitude"), get("exif-ifd3-GPSLongitudeRef"))
+		if latOk && lonOk {
+			exif.GPS = &ExifGPS{Latitude: latitude, Longitude: longitude}
+		}
+	}
+	return exif
+}
+
+// parseExifValue returns the value of a libvips EXIF string, which looks like
+// "Canon (Canon, ASCII, 6 components, 6 bytes)"
+func parseExifValue(value string) string {
+	if !strings.HasSuffix(value, ")") {
+		return strings.TrimSpace(value)
+	}
+	// find the opening parenthesis matching the last one, as the value itself may contain parentheses
+	depth := 0
+	for i := len(value) - 1; i >= 0; i-- {
+		switch value[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+		}
+		if depth == 0 {
+			return strings.TrimSpace(value[:i])
+		}
+	}
+	return strings.TrimSpace(value)
+}
+
+// parseExifGPSCoordinate converts a coordinate in degrees, minutes and seconds
+// (like "52, 22, 15.37") and its reference (N, S, E or W) to decimal degrees
+func parseExifGPSCoordinate(value string, ref string) (float64, bool) {
+	parts := strings.Split(value, ",")
+	if value == "" || len(parts) > 3 {
+		return 0, false
+	}
+	coordinate := 0.0
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, false
+		}
+		coordinate += number / math.Pow(60, float64(i))
+	}
+	if ref == "S" || ref == "W" {
+		coordinate = -coordinate
+	}
+	return coordinate, true
+}
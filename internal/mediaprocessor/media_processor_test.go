@@ -1,15 +1,1501 @@
 package mediaprocessor
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+func TestMain(m *testing.M) {
+	vips.LoggingSettings(nil, vips.LogLevelWarning)
+	vips.Startup(&vips.Config{
+		ConcurrencyLevel: 1,
+		MaxCacheFiles:    0,
+		MaxCacheMem:      50 * 1024 * 1024,
+		MaxCacheSize:     100,
+		// ReportLeaks      :
+		// CacheTrace       :
+		// CollectStats     :
+	})
+	code := m.Run()
+	vips.Shutdown()
+	os.Exit(code)
+}
+
+// encodePNG encodes a test fixture image as PNG
+func encodePNG(t testing.TB, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decodeImage decodes the output of a transform request
+func decodeImage(t testing.TB, data []byte) image.Image {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	return img
+}
+
+// quadrantsFixture returns a 2x2 image with red, green, blue and white pixels in
+// the top-left, top-right, bottom-left and bottom-right corners
+func quadrantsFixture() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	img.Set(1, 0, color.RGBA{0, 255, 0, 255})
+	img.Set(0, 1, color.RGBA{0, 0, 255, 255})
+	img.Set(1, 1, color.RGBA{255, 255, 255, 255})
+	return img
+}
+
+func colorAt(img image.Image, x, y int) color.RGBA {
+	r, g, b, a := img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y).RGBA()
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
+
+func TestProcessTransformRequestFlip(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	tests := []struct {
+		name     string
+		params   TransformOptions
+		expected [4]color.RGBA // top-left, top-right, bottom-left, bottom-right
+	}{
+		{"none", TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1}, [4]color.RGBA{red, green, blue, white}},
+		{"flipH", TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, FlipH: true}, [4]color.RGBA{green, red, white, blue}},
+		{"flipV", TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, FlipV: true}, [4]color.RGBA{blue, white, red, green}},
+		{"flipH and flipV", TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, FlipH: true, FlipV: true}, [4]color.RGBA{white, blue, green, red}},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	fixture := encodePNG(t, quadrantsFixture())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &test.params)
+			if err != nil {
+				t.Fatalf("ProcessTransformRequest returned error: %v", err)
+			}
+			img := decodeImage(t, out)
+			actual := [4]color.RGBA{colorAt(img, 0, 0), colorAt(img, 1, 0), colorAt(img, 0, 1), colorAt(img, 1, 1)}
+			if actual != test.expected {
+				t.Errorf("ProcessTransformRequest returned pixels %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestProcessTransformRequestRotate(t *testing.T) {
+	// a 6x4 image with a red 2x2 block in the top-left corner
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	fixture := image.NewRGBA(image.Rect(0, 0, 6, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 6; x++ {
+			if x < 2 && y < 2 {
+				fixture.Set(x, y, red)
+			} else {
+				fixture.Set(x, y, blue)
+			}
+		}
+	}
+	tests := []struct {
+		params         TransformOptions
+		expectedWidth  int
+		expectedHeight int
+		red            image.Point // a corner of the red block
+	}{
+		{TransformOptions{Rotate: 90}, 4, 6, image.Point{3, 0}},
+		{TransformOptions{Rotate: 180}, 6, 4, image.Point{5, 3}},
+		{TransformOptions{Rotate: 270}, 4, 6, image.Point{0, 5}},
+		// resizing happens before rotating, so the width is the one of the source
+		{TransformOptions{Rotate: 90, Resize: &TransformOptionsResize{Width: 3}}, 2, 3, image.Point{1, 0}},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	input := encodePNG(t, fixture)
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d %+v", test.params.Rotate, test.params.Resize), func(t *testing.T) {
+			test.params.OutputFormat, test.params.Brightness, test.params.Contrast = "png", 1, 1
+			out, _, err := mp.ProcessTransformRequest(context.Background(), input, &test.params)
+			if err != nil {
+				t.Fatalf("ProcessTransformRequest returned error: %v", err)
+			}
+			img := decodeImage(t, out)
+			if img.Bounds().Dx() != test.expectedWidth || img.Bounds().Dy() != test.expectedHeight {
+				t.Fatalf("rotated image is %dx%d, expected %dx%d", img.Bounds().Dx(), img.Bounds().Dy(), test.expectedWidth, test.expectedHeight)
+			}
+			if c := colorAt(img, test.red.X, test.red.Y); c != red {
+				t.Errorf("pixel %v is %v, expected the red top-left block", test.red, c)
+			}
+		})
+	}
+}
+
+func TestProcessTransformRequestGamma(t *testing.T) {
+	fixture := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			fixture.Set(x, y, color.NRGBA{64, 64, 64, 255})
+		}
+	}
+	fixture.Set(1, 1, color.NRGBA{64, 64, 64, 128})
+	tests := []struct {
+		gamma    float64
+		expected uint8 // 255 * (64 / 255) ^ (1 / gamma)
+	}{
+		{1, 64},
+		{2, 128},
+		{0.5, 16},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	input := encodePNG(t, fixture)
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.gamma), func(t *testing.T) {
+			out, _, err := mp.ProcessTransformRequest(context.Background(), input, &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Gamma: test.gamma})
+			if err != nil {
+				t.Fatalf("ProcessTransformRequest returned error: %v", err)
+			}
+			img := decodeImage(t, out)
+			for _, p := range []image.Point{{0, 0}, {1, 1}} {
+				c := color.NRGBAModel.Convert(img.At(p.X, p.Y)).(color.NRGBA)
+				if diff := int(c.R) - int(test.expected); diff < -1 || diff > 1 || c.G != c.R || c.B != c.R {
+					t.Errorf("pixel %v is %v, expected a gray of %d", p, c, test.expected)
+				}
+				if expected := fixture.NRGBAAt(p.X, p.Y).A; c.A != expected {
+					t.Errorf("pixel %v has alpha %d, expected %d", p, c.A, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessTransformRequestBrightnessContrast(t *testing.T) {
+	gray8 := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	gray16 := image.NewNRGBA64(image.Rect(0, 0, 2, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			gray8.Set(x, y, color.NRGBA{64, 64, 64, 255})
+			gray16.Set(x, y, color.NRGBA64{64 * 257, 64 * 257, 64 * 257, 65535})
+		}
+	}
+	tests := []struct {
+		brightness float64
+		contrast   float64
+		expected   uint8 // (64 * brightness - 128) * contrast + 128
+	}{
+		{1, 1, 64},
+		{0, 1, 0},
+		{2, 1, 128},
+		{1, 0, 128},
+		{1, 0.5, 96},
+		{0, 0, 128},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	for name, fixture := range map[string]image.Image{"8-bit": gray8, "16-bit": gray16} {
+		input := encodePNG(t, fixture)
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s brightness=%g contrast=%g", name, test.brightness, test.contrast), func(t *testing.T) {
+				out, _, err := mp.ProcessTransformRequest(context.Background(), input, &TransformOptions{OutputFormat: "png", Brightness: test.brightness, Contrast: test.contrast})
+				if err != nil {
+					t.Fatalf("ProcessTransformRequest returned error: %v", err)
+				}
+				c := color.NRGBAModel.Convert(decodeImage(t, out).At(0, 0)).(color.NRGBA)
+				if diff := int(c.R) - int(test.expected); diff < -1 || diff > 1 || c.G != c.R || c.B != c.R {
+					t.Errorf("pixel is %v, expected a gray of %d", c, test.expected)
+				}
+			})
+		}
+	}
+}
+
+// softFixture returns an image with a smooth radial gradient
+func softFixture() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			d := ((x-32)*(x-32) + (y-32)*(y-32)) / 4
+			if d > 255 {
+				d = 255
+			}
+			v := uint8(255 - d)
+			img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func TestProcessTransformRequestSharpen(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	fixture := encodePNG(t, softFixture())
+	plain, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "jpeg", Brightness: 1, Contrast: 1, Quality: 90})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest returned error: %v", err)
+	}
+	sharpened, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "jpeg", Brightness: 1, Contrast: 1, Quality: 90, Sharpen: 2})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest returned error: %v", err)
+	}
+	if len(sharpened) <= len(plain) {
+		t.Errorf("sharpened output is %d bytes, expected it to be larger than the unsharpened %d bytes", len(sharpened), len(plain))
+	}
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "jpeg", Brightness: 1, Contrast: 1, Sharpen: -1}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("ProcessTransformRequest with a negative sharpen returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestProcessTransformRequestGravity(t *testing.T) {
+	// left half red, right half blue
+	fixture := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			if x < 4 {
+				fixture.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				fixture.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	tests := []struct {
+		gravity  string
+		expected color.RGBA
+	}{
+		{"west", color.RGBA{255, 0, 0, 255}},
+		{"east", color.RGBA{0, 0, 255, 255}},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	fixtureBytes := encodePNG(t, fixture)
+	for _, test := range tests {
+		params := &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Resize: &TransformOptionsResize{Width: 2, Height: 2, Gravity: test.gravity}}
+		out, _, err := mp.ProcessTransformRequest(context.Background(), fixtureBytes, params)
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest returned error: %v", err)
+		}
+		img := decodeImage(t, out)
+		if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 2 {
+			t.Errorf("gravity %s returned a %dx%d image, expected 2x2", test.gravity, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+		if c := colorAt(img, 1, 1); c != test.expected {
+			t.Errorf("gravity %s returned color %v, expected %v", test.gravity, c, test.expected)
+		}
+	}
+	params := &TransformOptions{OutputFormat: "png", Resize: &TransformOptionsResize{Width: 2, Height: 2, Gravity: "up"}}
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), fixtureBytes, params); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("ProcessTransformRequest with an unknown gravity returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestProcessTransformRequestFocus(t *testing.T) {
+	// thirds of red, green and blue from left to right
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	fixture := image.NewRGBA(image.Rect(0, 0, 12, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 12; x++ {
+			fixture.Set(x, y, []color.RGBA{red, green, blue}[x/4])
+		}
+	}
+	float := func(f float64) *float64 { return &f }
+	tests := []struct {
+		focus          TransformOptionsFocus
+		width, height  int
+		expectedWidth  int
+		expectedHeight int
+		expected       color.RGBA
+	}{
+		{TransformOptionsFocus{X: float(0.1)}, 4, 4, 4, 4, red},
+		{TransformOptionsFocus{X: float(0.5), Y: float(0.9)}, 4, 4, 4, 4, green},
+		{TransformOptionsFocus{X: float(0.9), Y: float(0.1)}, 4, 4, 4, 4, blue},
+		{TransformOptionsFocus{X: float(0.6)}, 4, 4, 4, 4, green},
+		// scaled to 24x8 before cropping around the focal point
+		{TransformOptionsFocus{X: float(0.95)}, 4, 8, 4, 8, blue},
+		// not enlarged with size=down, so the crop is limited to the image height
+		{TransformOptionsFocus{X: float(0.2)}, 4, 8, 4, 4, red},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	fixtureBytes := encodePNG(t, fixture)
+	for _, test := range tests {
+		resize := &TransformOptionsResize{Width: test.width, Height: test.height, Focus: &test.focus}
+		if test.expectedHeight < test.height {
+			resize.Size = "down"
+		}
+		out, _, err := mp.ProcessTransformRequest(context.Background(), fixtureBytes, &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Resize: resize})
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest returned error: %v", err)
+		}
+		img := decodeImage(t, out)
+		x, y := test.focus.point()
+		if img.Bounds().Dx() != test.expectedWidth || img.Bounds().Dy() != test.expectedHeight {
+			t.Errorf("focus %g,%g returned a %dx%d image, expected %dx%d", x, y, img.Bounds().Dx(), img.Bounds().Dy(), test.expectedWidth, test.expectedHeight)
+		}
+		if c := colorAt(img, 1, 1); c != test.expected {
+			t.Errorf("focus %g,%g returned color %v, expected %v", x, y, c, test.expected)
+		}
+	}
+}
+
+func TestProcessTransformRequestTrim(t *testing.T) {
+	// 10x8 white image with a 4x3 red rectangle at (3, 2)
+	bordered := image.NewRGBA(image.Rect(0, 0, 10, 8))
+	uniform := image.NewRGBA(image.Rect(0, 0, 10, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 10; x++ {
+			bordered.Set(x, y, color.RGBA{255, 255, 255, 255})
+			uniform.Set(x, y, color.RGBA{255, 255, 255, 255})
+			if x >= 3 && x < 7 && y >= 2 && y < 5 {
+				bordered.Set(x, y, color.RGBA{255, 0, 0, 255})
+			}
+		}
+	}
+	tests := []struct {
+		name           string
+		fixture        image.Image
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"bordered", bordered, 4, 3},
+		{"uniform", uniform, 10, 8},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	for _, test := range tests {
+		params := &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Trim: &TransformOptionsTrim{Enabled: true}}
+		out, _, err := mp.ProcessTransformRequest(context.Background(), encodePNG(t, test.fixture), params)
+		if err != nil {
+			t.Fatalf("%s: ProcessTransformRequest returned error: %v", test.name, err)
+		}
+		img := decodeImage(t, out)
+		if img.Bounds().Dx() != test.expectedWidth || img.Bounds().Dy() != test.expectedHeight {
+			t.Errorf("%s: trim returned a %dx%d image, expected %dx%d", test.name, img.Bounds().Dx(), img.Bounds().Dy(), test.expectedWidth, test.expectedHeight)
+		}
+	}
+}
+
+// animatedGIFFixture encodes a 4x4 animated GIF with one solid frame per palette color
+func animatedGIFFixture(t testing.TB, palette color.Palette) []byte {
+	fixture := &gif.GIF{}
+	for i := range palette {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				frame.SetColorIndex(x, y, uint8(i))
+			}
+		}
+		fixture.Image = append(fixture.Image, frame)
+		fixture.Delay = append(fixture.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, fixture); err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessTransformRequestGIF(t *testing.T) {
+	palette := color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	out, contentType, err := mp.ProcessTransformRequest(context.Background(), animatedGIFFixture(t, palette), &TransformOptions{OutputFormat: "gif", Brightness: 1, Contrast: 1})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest returned error: %v", err)
+	}
+	if contentType != "image/gif" {
+		t.Errorf("ProcessTransformRequest returned content type %q, expected %q", contentType, "image/gif")
+	}
+	img, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	if len(img.Image) != len(palette) {
+		t.Fatalf("output has %d frames, expected %d", len(img.Image), len(palette))
+	}
+	for i, frame := range img.Image {
+		if c := colorAt(frame, 0, 0); c != palette[i] {
+			t.Errorf("frame %d has color %v, expected %v", i, c, palette[i])
+		}
+	}
+}
+
+func TestProcessTransformRequestFrames(t *testing.T) {
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	fixture := animatedGIFFixture(t, color.Palette{red, green, blue})
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+
+	out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Frame: 2})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest with frame=2 returned error: %v", err)
+	}
+	img := decodeImage(t, out)
+	if c := colorAt(img, 0, 0); c != green {
+		t.Errorf("frame 2 has color %v, expected %v", c, green)
+	}
+	if img.Bounds().Dy() != 4 {
+		t.Errorf("frame 2 is %d pixels high, expected a single 4 pixel high frame", img.Bounds().Dy())
+	}
+
+	out, _, err = mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "gif", Brightness: 1, Contrast: 1, Frames: "2-3"})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest with frames=2-3 returned error: %v", err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	if len(anim.Image) != 2 || colorAt(anim.Image[0], 0, 0) != green || colorAt(anim.Image[1], 0, 0) != blue {
+		t.Errorf("frames 2-3 returned %d frames, expected the green and blue frames", len(anim.Image))
+	}
+	// extracting the frames mustn't crop each of them
+	if anim.Config.Height != 4 {
+		t.Errorf("frames 2-3 are %d pixels high, expected 4", anim.Config.Height)
+	}
+	for i, frame := range anim.Image {
+		if frame.Bounds().Dy() != 4 {
+			t.Errorf("frame %d is %d pixels high, expected 4", i+2, frame.Bounds().Dy())
+		}
+	}
+
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "png", Frame: 4}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("ProcessTransformRequest with frame=4 returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestProcessTransformDimensions(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	fixture := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	result, err := mp.ProcessTransform(context.Background(), encodePNG(t, fixture), &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Resize: &TransformOptionsResize{Width: 10}})
+	if err != nil {
+		t.Fatalf("ProcessTransform returned error: %v", err)
+	}
+	img := decodeImage(t, result.Data)
+	if result.Width != 10 || result.Height != 5 || img.Bounds().Dx() != result.Width || img.Bounds().Dy() != result.Height {
+		t.Errorf("ProcessTransform returned size %dx%d for a %v output, expected 10x5", result.Width, result.Height, img.Bounds())
+	}
+	if result.ContentType != "image/png" {
+		t.Errorf("ProcessTransform returned content type %q, expected %q", result.ContentType, "image/png")
+	}
+
+	// the size of animations is the size of a frame
+	red, green := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}
+	result, err = mp.ProcessTransform(context.Background(), animatedGIFFixture(t, color.Palette{red, green}), &TransformOptions{OutputFormat: "gif", Brightness: 1, Contrast: 1, Resize: &TransformOptionsResize{Width: 2}})
+	if err != nil {
+		t.Fatalf("ProcessTransform of an animation returned error: %v", err)
+	}
+	if result.Width != 2 || result.Height != 2 {
+		t.Errorf("ProcessTransform of an animation returned size %dx%d, expected the 2x2 frame size", result.Width, result.Height)
+	}
+}
+
+func TestProcessTransformRequestTransformAnimation(t *testing.T) {
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	fixture := animatedGIFFixture(t, color.Palette{red, green, blue, white})
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	tests := []struct {
+		name   string
+		params TransformOptions
+		height int
+		top    bool // whether the top row is the white extended background
+	}{
+		// rotating or flipping the stacked frames would reverse their order
+		{"rotate 180 and flipV", TransformOptions{Rotate: 180, FlipV: true}, 4, false},
+		{"rotate 90 and extend", TransformOptions{Rotate: 90, Extend: &TransformOptionsExtend{Top: 1, Background: "ffffff"}}, 5, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.params.OutputFormat, test.params.Brightness, test.params.Contrast = "gif", 1, 1
+			out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &test.params)
+			if err != nil {
+				t.Fatalf("ProcessTransformRequest returned error: %v", err)
+			}
+			anim, err := gif.DecodeAll(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("failed to decode output: %v", err)
+			}
+			if len(anim.Image) != 4 {
+				t.Fatalf("output has %d frames, expected 4", len(anim.Image))
+			}
+			for i, expected := range []color.RGBA{red, green, blue, white} {
+				frame := anim.Image[i]
+				if frame.Bounds().Dx() != 4 || frame.Bounds().Dy() != test.height {
+					t.Errorf("frame %d is %v, expected 4x%d", i+1, frame.Bounds(), test.height)
+				}
+				if c := colorAt(frame, 0, test.height-1); c != expected {
+					t.Errorf("frame %d has color %v, expected %v", i+1, c, expected)
+				}
+				if c := colorAt(frame, 0, 0); test.top && c != white {
+					t.Errorf("frame %d has color %v at the top, expected the white background", i+1, c)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessTransformRequestResizeAnimation(t *testing.T) {
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	fixture := animatedGIFFixture(t, color.Palette{red, green, blue})
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+
+	out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "gif", Brightness: 1, Contrast: 1, Resize: &TransformOptionsResize{Width: 2}})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest with resize.width=2 returned error: %v", err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	if len(anim.Image) != 3 {
+		t.Fatalf("resized animation has %d frames, expected 3", len(anim.Image))
+	}
+	for i, expected := range []color.RGBA{red, green, blue} {
+		frame := anim.Image[i]
+		if frame.Bounds().Dx() != 2 || frame.Bounds().Dy() != 2 || colorAt(frame, 0, 0) != expected {
+			t.Errorf("resized frame %d is %v with color %v, expected 2x2 with color %v", i+1, frame.Bounds(), colorAt(frame, 0, 0), expected)
+		}
+	}
+
+	out, _, err = mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "webp", Brightness: 1, Contrast: 1, Resize: &TransformOptionsResize{Width: 2}})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest with webp output returned error: %v", err)
+	}
+	importParams := vips.NewImportParams()
+	importParams.NumPages.Set(-1)
+	webp, err := vips.LoadImageFromBuffer(out, importParams)
+	if err != nil {
+		t.Fatalf("failed to load output: %v", err)
+	}
+	defer webp.Close()
+	if webp.Pages() != 3 || webp.Width() != 2 || webp.PageHeight() != 2 {
+		t.Errorf("resized webp animation has %d %dx%d frames, expected 3 2x2 frames", webp.Pages(), webp.Width(), webp.PageHeight())
+	}
+
+	out, _, err = mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "gif", Brightness: 1, Contrast: 1, Flatten: true, Resize: &TransformOptionsResize{Width: 2}})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest with flatten=true returned error: %v", err)
+	}
+	anim, err = gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	if len(anim.Image) != 1 {
+		t.Errorf("flattened output has %d frames, expected 1", len(anim.Image))
+	}
+
+	if err := (&TransformOptions{Flatten: true, Frames: "1-2"}).Validate(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Validate with flatten and frames returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestTransformOptionsRequiresTransform(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(o *TransformOptions)
+		expected bool
+	}{
+		{"defaults", func(o *TransformOptions) {}, false},
+		{"negotiated format", func(o *TransformOptions) { o.OutputFormat, o.AutoFormats = "auto", []string{"webp"} }, false},
+		{"explicit format", func(o *TransformOptions) { o.OutputFormat = "png" }, true},
+		{"resize", func(o *TransformOptions) { o.Resize = &TransformOptionsResize{Width: 100} }, true},
+		{"quality", func(o *TransformOptions) { o.Quality = 50 }, true},
+		{"keep metadata", func(o *TransformOptions) { o.StripMetadata = false }, true},
+	}
+	for _, test := range tests {
+		options := NewTransformOptions()
+		test.modify(options)
+		if requires := options.RequiresTransform(); requires != test.expected {
+			t.Errorf("RequiresTransform() with %s returned %v, expected %v", test.name, requires, test.expected)
+		}
+	}
+}
+
+func TestTransformOptionsFrameRange(t *testing.T) {
+	tests := []struct {
+		options     TransformOptions
+		first, last int
+		ok          bool
+		valid       bool
+	}{
+		{TransformOptions{}, 0, 0, false, true},
+		{TransformOptions{Frame: 3}, 3, 3, true, true},
+		{TransformOptions{Frames: "2-5"}, 2, 5, true, true},
+		{TransformOptions{Frames: "4"}, 4, 4, true, true},
+		{TransformOptions{Frame: -1}, 0, 0, false, false},
+		{TransformOptions{Frames: "5-2"}, 0, 0, false, false},
+		{TransformOptions{Frames: "0-2"}, 0, 0, false, false},
+		{TransformOptions{Frames: "a-b"}, 0, 0, false, false},
+		{TransformOptions{Frame: 1, Frames: "1-2"}, 0, 0, false, false},
+	}
+	for _, test := range tests {
+		first, last, ok, err := test.options.frameRange()
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("frameRange() with frame=%d frames=%q returned error %v, expected valid=%v", test.options.Frame, test.options.Frames, err, test.valid)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("frameRange() with frame=%d frames=%q returned error %v, expected %v", test.options.Frame, test.options.Frames, err, ErrInvalidOption)
+		}
+		if first != test.first || last != test.last || ok != test.ok {
+			t.Errorf("frameRange() with frame=%d frames=%q = %d, %d, %v, expected %d, %d, %v", test.options.Frame, test.options.Frames, first, last, ok, test.first, test.last, test.ok)
+		}
+	}
+	if err := (&TransformOptions{Frame: 1, Read: ReadOptions{Page: 1}}).Validate(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Validate() with frame and read.page returned error %v, expected %v", err, ErrInvalidOption)
+	}
+	if err := (&TransformOptions{Read: ReadOptions{Page: -1}}).Validate(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Validate() with read.page=-1 returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+// pdfFixture builds a PDF document with blank 72x36pt (1x0.5in) pages
+func pdfFixture(pages int) []byte {
+	kids := make([]string, pages)
+	for i := range kids {
+		kids[i] = fmt.Sprintf("%d 0 R", i+3)
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages),
+	}
+	for i := 0; i < pages; i++ {
+		objects = append(objects, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 72 36] >>")
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestProcessPDF(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{MaxDpi: 300})
+	fixture := pdfFixture(2)
+
+	out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Read: ReadOptions{Dpi: 144, Page: 2}})
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest returned error: %v", err)
+	}
+	if img := decodeImage(t, out); img.Bounds().Dx() != 144 || img.Bounds().Dy() != 72 {
+		t.Errorf("page rendered at 144 dpi is %dx%d, expected 144x72", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	out, err = mp.ProcessMetadataRequest(context.Background(), fixture, &MetadataOptions{})
+	if err != nil {
+		t.Fatalf("ProcessMetadataRequest returned error: %v", err)
+	}
+	var metadata MetadataResponse
+	if err := json.Unmarshal(out, &metadata); err != nil {
+		t.Fatalf("failed to decode metadata: %v", err)
+	}
+	if metadata.NoOfPages != 2 || metadata.Animated || metadata.Format != "pdf" {
+		t.Errorf("metadata has %d pages, animated %v and format %q, expected 2 pages, not animated and pdf", metadata.NoOfPages, metadata.Animated, metadata.Format)
+	}
+}
+
+func TestProcessSVG(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{MaxOutputWidth: 300})
+	fixture := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="100" height="50"><rect width="100" height="50" fill="red"/></svg>`)
+	tests := []struct {
+		read           ReadOptions
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{ReadOptions{}, 100, 50},
+		{ReadOptions{Scale: 2}, 200, 100},
+		{ReadOptions{Dpi: 144}, 200, 100},
+		// 400x200 is shrunk to the max output width
+		{ReadOptions{Scale: 4}, 300, 150},
+	}
+	for _, test := range tests {
+		out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Read: test.read})
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest with read %+v returned error: %v", test.read, err)
+		}
+		if img := decodeImage(t, out); img.Bounds().Dx() != test.expectedWidth || img.Bounds().Dy() != test.expectedHeight {
+			t.Errorf("SVG rendered with read %+v is %dx%d, expected %dx%d", test.read, img.Bounds().Dx(), img.Bounds().Dy(), test.expectedWidth, test.expectedHeight)
+		}
+	}
+}
+
+func TestCheckReadOptions(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{MaxDpi: 300})
+	tests := []struct {
+		read  ReadOptions
+		valid bool
+	}{
+		{ReadOptions{}, true},
+		{ReadOptions{Dpi: 300, Page: 2}, true},
+		{ReadOptions{Dpi: 301}, false},
+		{ReadOptions{Dpi: -1}, false},
+		{ReadOptions{Page: -1}, true},
+		{ReadOptions{Page: -2}, false},
+		{ReadOptions{Scale: 4}, true},
+		{ReadOptions{Scale: 4.2}, false},
+		{ReadOptions{Scale: -1}, false},
+		{ReadOptions{Dpi: 144, Scale: 2}, false},
+	}
+	for _, test := range tests {
+		err := mp.checkReadOptions(test.read)
+		if test.valid && err != nil {
+			t.Errorf("checkReadOptions(%+v) returned error %v, expected success", test.read, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("checkReadOptions(%+v) returned error %v, expected %v", test.read, err, ErrInvalidOption)
+		}
+	}
+	if err := NewMediaProcessor(MediaProcessorConfig{}).checkReadOptions(ReadOptions{Dpi: 2400}); err != nil {
+		t.Errorf("checkReadOptions without a max dpi returned error %v, expected success", err)
+	}
+}
+
+// exifJPEGFixture encodes a JPEG with an EXIF segment holding the camera make "Test"
+func exifJPEGFixture(t testing.TB) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, softFixture(), nil); err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	tiff := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0, // little-endian header, IFD0 at offset 8
+		1, 0, // 1 entry
+		0x0f, 0x01, 2, 0, 5, 0, 0, 0, 26, 0, 0, 0, // Make, ASCII, 5 bytes at offset 26
+		0, 0, 0, 0, // no next IFD
+		'T', 'e', 's', 't', 0,
+	}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}, segment...)
+	// insert the APP1 segment after the SOI marker
+	return append(append([]byte{0xff, 0xd8}, app1...), buf.Bytes()[2:]...)
+}
+
+func TestProcessTransformRequestStripMetadata(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	fixture := exifJPEGFixture(t)
+	for _, strip := range []bool{true, false} {
+		out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "jpeg", Brightness: 1, Contrast: 1, StripMetadata: strip})
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest with strip=%v returned error: %v", strip, err)
+		}
+		if hasExif := bytes.Contains(out, []byte("Exif\x00\x00")); hasExif == strip {
+			t.Errorf("ProcessTransformRequest with strip=%v returned output with EXIF %v, expected %v", strip, hasExif, !strip)
+		}
+	}
+}
+
+// displayP3Fixture encodes a solid red (in sRGB) PNG converted to and tagged
+// with the Display P3 color profile
+func displayP3Fixture(t testing.TB) []byte {
+	red := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(red.Pix); i += 4 {
+		copy(red.Pix[i:], []uint8{255, 0, 0, 255})
+	}
+	img, err := vips.NewImageFromBuffer(encodePNG(t, red))
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	defer img.Close()
+	if err := img.TransformICCProfile("p3"); err != nil {
+		t.Fatalf("failed to convert fixture to Display P3: %v", err)
+	}
+	out, _, err := img.ExportPng(vips.NewPngExportParams())
+	if err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	return out
+}
+
+func TestProcessTransformRequestColorProfile(t *testing.T) {
+	fixture := displayP3Fixture(t)
+	near := func(c color.RGBA, r, g, b uint8) bool {
+		diff := func(x, y uint8) bool { return math.Abs(float64(x)-float64(y)) <= 3 }
+		return diff(c.R, r) && diff(c.G, g) && diff(c.B, b)
+	}
+
+	// converted back to sRGB, the pixels are red again
+	for _, test := range []struct {
+		name   string
+		config MediaProcessorConfig
+		params TransformOptions
+	}{
+		{"colorProfile=srgb", MediaProcessorConfig{}, TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, ColorProfile: "srgb"}},
+		{"default srgb", MediaProcessorConfig{DefaultColorProfile: "srgb"}, TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1}},
+	} {
+		out, _, err := NewMediaProcessor(test.config).ProcessTransformRequest(context.Background(), fixture, &test.params)
+		if err != nil {
+			t.Fatalf("%s: ProcessTransformRequest returned error: %v", test.name, err)
+		}
+		if c := colorAt(decodeImage(t, out), 0, 0); !near(c, 255, 0, 0) {
+			t.Errorf("%s: output has color %v, expected red", test.name, c)
+		}
+	}
+
+	// kept in Display P3, the pixels aren't red and the profile is embedded
+	params := &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, ColorProfile: "p3", StripMetadata: true}
+	out, _, err := NewMediaProcessor(MediaProcessorConfig{DefaultColorProfile: "srgb"}).ProcessTransformRequest(context.Background(), fixture, params)
+	if err != nil {
+		t.Fatalf("colorProfile=p3: ProcessTransformRequest returned error: %v", err)
+	}
+	if c := colorAt(decodeImage(t, out), 0, 0); near(c, 255, 0, 0) {
+		t.Errorf("colorProfile=p3: output has color %v, expected it to be converted from red", c)
+	}
+	if !bytes.Contains(out, []byte("iCCP")) {
+		t.Errorf("colorProfile=p3: output doesn't embed the color profile")
+	}
+
+	if err := (&TransformOptions{ColorProfile: "adobergb"}).Validate(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Validate() with colorProfile=adobergb returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestProcessRequestsCanceled(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	input := encodePNG(t, quadrantsFixture())
+	if _, err := mp.ProcessMetadataRequest(ctx, input, &MetadataOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ProcessMetadataRequest with a canceled context returned error %v, expected %v", err, context.Canceled)
+	}
+	if _, _, err := mp.ProcessTransformRequest(ctx, input, NewTransformOptions()); !errors.Is(err, context.Canceled) {
+		t.Errorf("ProcessTransformRequest with a canceled context returned error %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestProcessRequestsMaxMegapixels(t *testing.T) {
+	// a single color compresses well, so the 16 megapixels fit in a small file
+	bomb := encodePNG(t, image.NewGray(image.Rect(0, 0, 4000, 4000)))
+	if len(bomb) > 100_000 {
+		t.Fatalf("the fixture is %d bytes, expected a small file", len(bomb))
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{MaxMegapixels: 10})
+	if _, err := mp.ProcessMetadataRequest(context.Background(), bomb, &MetadataOptions{}); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("ProcessMetadataRequest of a 16 megapixel image returned error %v, expected %v", err, ErrImageTooLarge)
+	}
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), bomb, NewTransformOptions()); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("ProcessTransformRequest of a 16 megapixel image returned error %v, expected %v", err, ErrImageTooLarge)
+	}
+	if _, err := mp.ProcessMetadataRequest(context.Background(), encodePNG(t, quadrantsFixture()), &MetadataOptions{}); err != nil {
+		t.Errorf("ProcessMetadataRequest of a small image returned error: %v", err)
+	}
+}
+
+func TestAcquireEncodeSlot(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{EncodeConcurrency: 1})
+	release, err := mp.acquireEncodeSlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquireEncodeSlot returned error: %v", err)
+	}
+
+	waited := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, err := mp.acquireEncodeSlot(ctx)
+		waited <- err
+	}()
+	for testutil.ToFloat64(encodeQueueDepth) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-waited; !errors.Is(err, context.Canceled) {
+		t.Errorf("acquireEncodeSlot while all slots are taken returned error %v, expected %v", err, context.Canceled)
+	}
+	if depth := testutil.ToFloat64(encodeQueueDepth); depth != 0 {
+		t.Errorf("encode queue depth is %v after the wait, expected 0", depth)
+	}
+
+	release()
+	release, err = mp.acquireEncodeSlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquireEncodeSlot after release returned error: %v", err)
+	}
+	release()
+
+	unlimited := NewMediaProcessor(MediaProcessorConfig{})
+	for i := 0; i < 3; i++ {
+		if _, err := unlimited.acquireEncodeSlot(context.Background()); err != nil {
+			t.Fatalf("acquireEncodeSlot without a limit returned error: %v", err)
+		}
+	}
+}
+
+func TestProcessMetadataRequestAverageColor(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range gray.Pix {
+		gray.Pix[i] = 0x40
+	}
+	// a 16 bit PNG is loaded with 16 bit bands
+	deep := image.NewNRGBA64(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			deep.SetNRGBA64(x, y, color.NRGBA64{0xffff, 0x8080, 0x0101, 0xffff})
+		}
+	}
+	tests := []struct {
+		name     string
+		fixture  image.Image
+		expected string
+	}{
+		{"rgb", quadrantsFixture(), "#808080"},
+		{"grayscale", gray, "#404040"},
+		{"16 bit", deep, "#ff8001"},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	for _, test := range tests {
+		out, err := mp.ProcessMetadataRequest(context.Background(), encodePNG(t, test.fixture), &MetadataOptions{AverageColor: true})
+		if err != nil {
+			t.Fatalf("%s: ProcessMetadataRequest returned error: %v", test.name, err)
+		}
+		var metadata MetadataResponse
+		if err := json.Unmarshal(out, &metadata); err != nil {
+			t.Fatalf("%s: failed to decode metadata: %v", test.name, err)
+		}
+		if metadata.AverageColor != test.expected {
+			t.Errorf("%s: average color is %q, expected %q", test.name, metadata.AverageColor, test.expected)
+		}
+	}
+}
+
+func TestProcessMetadataRequestAllPages(t *testing.T) {
+	fixture := animatedGIFFixture(t, color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}})
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	tests := []struct {
+		page           int
+		expectedFrames []MetadataFrame
+	}{
+		{0, nil},
+		{-1, []MetadataFrame{{4, 4, 100}, {4, 4, 100}, {4, 4, 100}}},
+	}
+	for _, test := range tests {
+		out, err := mp.ProcessMetadataRequest(context.Background(), fixture, &MetadataOptions{Read: ReadOptions{Page: test.page}, ThumbHash: true})
+		if err != nil {
+			t.Fatalf("ProcessMetadataRequest with read.page=%d returned error: %v", test.page, err)
+		}
+		var metadata MetadataResponse
+		if err := json.Unmarshal(out, &metadata); err != nil {
+			t.Fatalf("failed to decode metadata: %v", err)
+		}
+		if metadata.Width != 4 || metadata.Height != 4 || metadata.NoOfPages != 3 {
+			t.Errorf("read.page=%d: metadata is %dx%d with %d pages, expected 4x4 with 3 pages", test.page, metadata.Width, metadata.Height, metadata.NoOfPages)
+		}
+		if !reflect.DeepEqual(metadata.Frames, test.expectedFrames) {
+			t.Errorf("read.page=%d: frames are %v, expected %v", test.page, metadata.Frames, test.expectedFrames)
+		}
+	}
+	if _, err := mp.ProcessMetadataRequest(context.Background(), fixture, &MetadataOptions{Read: ReadOptions{Page: -2}}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("ProcessMetadataRequest with read.page=-2 returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestProcessMetadataRequestAlphaAndAnimation(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	transparent.Set(1, 1, color.NRGBA{255, 0, 0, 128})
+	tests := []struct {
+		name             string
+		fixture          []byte
+		expectedAlpha    bool
+		expectedAnimated bool
+	}{
+		{"opaque png", encodePNG(t, quadrantsFixture()), false, false},
+		{"transparent png", encodePNG(t, transparent), true, false},
+		{"animated gif", animatedGIFFixture(t, color.Palette{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 0, 0}}), true, true},
+	}
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	for _, test := range tests {
+		out, err := mp.ProcessMetadataRequest(context.Background(), test.fixture, &MetadataOptions{})
+		if err != nil {
+			t.Fatalf("%s: ProcessMetadataRequest returned error: %v", test.name, err)
+		}
+		var metadata MetadataResponse
+		if err := json.Unmarshal(out, &metadata); err != nil {
+			t.Fatalf("%s: failed to decode metadata: %v", test.name, err)
+		}
+		if metadata.HasAlpha != test.expectedAlpha || metadata.Animated != test.expectedAnimated {
+			t.Errorf("%s: hasAlpha is %v and animated is %v, expected %v and %v", test.name, metadata.HasAlpha, metadata.Animated, test.expectedAlpha, test.expectedAnimated)
+		}
+	}
+}
+
+func TestParseExifValue(t *testing.T) {
+	tests := map[string]string{
+		"Canon (Canon, ASCII, 6 components, 6 bytes)":                               "Canon",
+		"Canon EOS (5D) (Canon EOS (5D), ASCII, 14 components, 14 bytes)":           "Canon EOS (5D)",
+		"2023:01:02 03:04:05 (2023:01:02 03:04:05, ASCII, 20 components, 20 bytes)": "2023:01:02 03:04:05",
+		"plain": "plain",
+	}
+	for value, expected := range tests {
+		if parsed := parseExifValue(value); parsed != expected {
+			t.Errorf("parseExifValue(%q) = %q, expected %q", value, parsed, expected)
+		}
+	}
+}
+
+func TestParseExifGPSCoordinate(t *testing.T) {
+	tests := []struct {
+		value    string
+		ref      string
+		expected float64
+		ok       bool
+	}{
+		{"52, 30, 0", "N", 52.5, true},
+		{"13, 15, 36", "W", -13.26, true},
+		{"12.5", "S", -12.5, true},
+		{"", "N", 0, false},
+		{"north", "N", 0, false},
+	}
+	for _, test := range tests {
+		coordinate, ok := parseExifGPSCoordinate(test.value, test.ref)
+		if ok != test.ok || math.Abs(coordinate-test.expected) > 1e-9 {
+			t.Errorf("parseExifGPSCoordinate(%q, %q) = %g, %v, expected %g, %v", test.value, test.ref, coordinate, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestResizeDimensions(t *testing.T) {
+	limited := NewMediaProcessor(MediaProcessorConfig{MaxOutputWidth: 1000, MaxOutputHeight: 800})
+	unlimited := NewMediaProcessor(MediaProcessorConfig{})
+	tests := []struct {
+		mp             *MediaProcessor
+		resize         TransformOptionsResize
+		dpr            float64
+		imageWidth     int
+		imageHeight    int
+		expectedWidth  int
+		expectedHeight int
+		valid          bool
+	}{
+		{limited, TransformOptionsResize{Width: 100}, 1, 200, 100, 100, 50, true},
+		{limited, TransformOptionsResize{Width: 100, Height: 100}, 1, 200, 100, 100, 100, true},
+		{limited, TransformOptionsResize{Width: 1000, Height: 800}, 1, 200, 100, 1000, 800, true},
+		// the computed dimension is scaled down to the limit with the other one
+		{limited, TransformOptionsResize{Width: 100}, 1, 10, 10000, 1, 800, true},
+		{limited, TransformOptionsResize{Height: 50}, 1, 10000, 10, 1000, 1, true},
+		{unlimited, TransformOptionsResize{Width: 100}, 1, 10, 10000, 100, 100000, true},
+		// requested dimensions above the limit are an error
+		{limited, TransformOptionsResize{Width: 1001}, 1, 200, 100, 0, 0, false},
+		{limited, TransformOptionsResize{Height: 100000}, 1, 200, 100, 0, 0, false},
+		// degenerate images and resizes
+		{unlimited, TransformOptionsResize{}, 1, 200, 100, 0, 0, true},
+		{unlimited, TransformOptionsResize{Width: 100}, 1, 200, 0, 0, 0, false},
+		{unlimited, TransformOptionsResize{Height: 100}, 1, 0, 100, 0, 0, false},
+		{unlimited, TransformOptionsResize{Width: 100, Height: 100}, 1, 0, 0, 0, 0, false},
+		// the size is multiplied by the clamped dpr, and scaled down to the limits
+		{limited, TransformOptionsResize{Width: 100}, 2, 200, 100, 200, 100, true},
+		{limited, TransformOptionsResize{Width: 100, Height: 30}, 1.5, 200, 100, 150, 45, true},
+		{limited, TransformOptionsResize{Width: 100}, 10, 200, 100, 400, 200, true},
+		{limited, TransformOptionsResize{Width: 100}, 0, 200, 100, 100, 50, true},
+		{limited, TransformOptionsResize{Width: 600}, 2, 200, 100, 1000, 500, true},
+		{limited, TransformOptionsResize{Width: 500, Height: 400}, 2, 200, 100, 1000, 800, true},
+		{limited, TransformOptionsResize{Width: 100}, math.NaN(), 200, 100, 100, 50, true},
+		// percentages of the image size, mixed with pixel sizes
+		{limited, TransformOptionsResize{WidthPercent: 50}, 1, 200, 100, 100, 50, true},
+		{limited, TransformOptionsResize{WidthPercent: 50, HeightPercent: 10}, 1, 200, 100, 100, 10, true},
+		{limited, TransformOptionsResize{Width: 30, HeightPercent: 25}, 1, 200, 100, 30, 25, true},
+		{limited, TransformOptionsResize{HeightPercent: 0.1}, 1, 200, 100, 2, 1, true},
+		{limited, TransformOptionsResize{WidthPercent: 50}, 2, 200, 100, 200, 100, true},
+		{limited, TransformOptionsResize{WidthPercent: 1000}, 1, 200, 100, 1000, 500, true},
+	}
+	for _, test := range tests {
+		width, height, err := test.mp.resizeDimensions(&test.resize, test.dpr, test.imageWidth, test.imageHeight)
+		if test.valid && err != nil {
+			t.Errorf("resizeDimensions(%+v, %d, %d) returned error: %v", test.resize, test.imageWidth, test.imageHeight, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidOption) && !errors.Is(err, ErrInvalidImage) {
+			t.Errorf("resizeDimensions(%+v, %d, %d) returned error %v, expected an invalid option or image error", test.resize, test.imageWidth, test.imageHeight, err)
+		}
+		if width != test.expectedWidth || height != test.expectedHeight {
+			t.Errorf("resizeDimensions(%+v, %d, %d) = %dx%d, expected %dx%d", test.resize, test.imageWidth, test.imageHeight, width, height, test.expectedWidth, test.expectedHeight)
+		}
+	}
+}
+
+func TestProcessTransformRequestEmptyResize(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	params := &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Resize: &TransformOptionsResize{Crop: "centre"}}
+	out, _, err := mp.ProcessTransformRequest(context.Background(), encodePNG(t, quadrantsFixture()), params)
+	if err != nil {
+		t.Fatalf("ProcessTransformRequest returned error: %v", err)
+	}
+	if img := decodeImage(t, out); img.Bounds().Dx() != 2 || img.Bounds().Dy() != 2 {
+		t.Errorf("resize without dimensions returned a %dx%d image, expected 2x2", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+}
+
+func TestProcessTransformRequestFit(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	portrait := encodePNG(t, image.NewRGBA(image.Rect(0, 0, 40, 80)))
+	landscape := encodePNG(t, image.NewRGBA(image.Rect(0, 0, 80, 40)))
+	tests := []struct {
+		name           string
+		input          []byte
+		fit            string
+		box            int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"portrait", portrait, "contain", 60, 30, 60},
+		{"landscape", landscape, "contain", 60, 60, 30},
+		{"portrait", portrait, "contain", 100, 40, 80},
+		{"landscape", landscape, "contain", 100, 80, 40},
+		{"portrait", portrait, "inside", 100, 50, 100},
+		{"landscape", landscape, "inside", 100, 100, 50},
+		{"portrait", portrait, "cover", 60, 60, 60},
+		{"landscape", landscape, "cover", 100, 100, 100},
+	}
+	for _, test := range tests {
+		params := &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Resize: &TransformOptionsResize{Width: test.box, Height: test.box, Fit: test.fit}}
+		out, _, err := mp.ProcessTransformRequest(context.Background(), test.input, params)
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest with %s fit returned error: %v", test.fit, err)
+		}
+		if img := decodeImage(t, out); img.Bounds().Dx() != test.expectedWidth || img.Bounds().Dy() != test.expectedHeight {
+			t.Errorf("%s fit of a %s image in %dx%d returned a %dx%d image, expected %dx%d", test.fit, test.name, test.box, test.box, img.Bounds().Dx(), img.Bounds().Dy(), test.expectedWidth, test.expectedHeight)
+		}
+	}
+
+	for _, resize := range []*TransformOptionsResize{
+		{Width: 60, Fit: "fill"},
+		{Width: 60, Fit: "contain", Size: "both"},
+		{Width: 60, Fit: "cover", Crop: "attention"},
+		{Width: 60, Fit: "inside", Gravity: "north"},
+	} {
+		if err := (&TransformOptions{Resize: resize}).Validate(); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Validate with resize %+v returned error %v, expected %v", resize, err, ErrInvalidOption)
+		}
+	}
+}
+
+func TestProcessTransformRequestDefaultMaxDimension(t *testing.T) {
+	fixture := encodePNG(t, image.NewRGBA(image.Rect(0, 0, 8, 4)))
+	tests := []struct {
+		maxDimension   int
+		resize         *TransformOptionsResize
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{0, nil, 8, 4},
+		{4, nil, 4, 2},
+		{16, nil, 8, 4},
+		{4, &TransformOptionsResize{Crop: "centre"}, 4, 2},
+		{4, &TransformOptionsResize{Width: 6}, 6, 3},
+	}
+	for _, test := range tests {
+		mp := NewMediaProcessor(MediaProcessorConfig{DefaultMaxDimension: test.maxDimension})
+		out, _, err := mp.ProcessTransformRequest(context.Background(), fixture, &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1, Resize: test.resize})
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest returned error: %v", err)
+		}
+		if img := decodeImage(t, out); img.Bounds().Dx() != test.expectedWidth || img.Bounds().Dy() != test.expectedHeight {
+			t.Errorf("ProcessTransformRequest with default max dimension %d and resize %+v returned a %dx%d image, expected %dx%d", test.maxDimension, test.resize, img.Bounds().Dx(), img.Bounds().Dy(), test.expectedWidth, test.expectedHeight)
+		}
+	}
+}
+
+func TestProcessTransformRequestInputFormat(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{AllowedInputFormats: []string{"png"}})
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), encodePNG(t, quadrantsFixture()), &TransformOptions{OutputFormat: "png", Brightness: 1, Contrast: 1}); err != nil {
+		t.Errorf("ProcessTransformRequest with an allowed input format returned error: %v", err)
+	}
+	inputs := map[string][]byte{
+		"jpeg": exifJPEGFixture(t),
+		"html": []byte("<html><body>502 Bad Gateway</body></html>"),
+	}
+	for name, input := range inputs {
+		if _, _, err := mp.ProcessTransformRequest(context.Background(), input, &TransformOptions{OutputFormat: "png"}); !errors.Is(err, ErrUnsupportedInputFormat) {
+			t.Errorf("ProcessTransformRequest with %s input returned error %v, expected %v", name, err, ErrUnsupportedInputFormat)
+		}
+		if _, err := mp.ProcessMetadataRequest(context.Background(), input, &MetadataOptions{}); !errors.Is(err, ErrUnsupportedInputFormat) {
+			t.Errorf("ProcessMetadataRequest with %s input returned error %v, expected %v", name, err, ErrUnsupportedInputFormat)
+		}
+	}
+}
+
+func TestProcessTransformRequestNearLossless(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	input := encodePNG(t, softFixture())
+	outputs := map[string][]byte{}
+	for name, params := range map[string]*TransformOptions{
+		"lossy":         {OutputFormat: "webp", Brightness: 1, Contrast: 1, Quality: 80},
+		"lossless":      {OutputFormat: "webp", Brightness: 1, Contrast: 1, Lossless: true},
+		"near-lossless": {OutputFormat: "webp", Brightness: 1, Contrast: 1, NearLossless: true, NearLosslessLevel: 20},
+	} {
+		output, contentType, err := mp.ProcessTransformRequest(context.Background(), input, params)
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest with %s params returned error: %v", name, err)
+		}
+		if contentType != "image/webp" {
+			t.Errorf("ProcessTransformRequest with %s params returned content type %q, expected %q", name, contentType, "image/webp")
+		}
+		outputs[name] = output
+	}
+	if bytes.Equal(outputs["near-lossless"], outputs["lossy"]) || bytes.Equal(outputs["near-lossless"], outputs["lossless"]) {
+		t.Errorf("near-lossless output equals the lossy or lossless output")
+	}
+
+	if err := (&TransformOptions{NearLossless: true, NearLosslessLevel: 101}).Validate(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Validate with nearLosslessLevel 101 returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestProcessTransformRequestPixelate(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	input := encodePNG(t, softFixture())
+	transform := func(params *TransformOptions) image.Image {
+		params.OutputFormat, params.Brightness, params.Contrast = "png", 1, 1
+		output, _, err := mp.ProcessTransformRequest(context.Background(), input, params)
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest with %+v returned error: %v", params, err)
+		}
+		return decodeImage(t, output)
+	}
+	original := transform(&TransformOptions{})
+	region := &TransformOptionsCropRegion{Left: 16, Top: 16, Width: 32, Height: 32}
+	tests := []struct {
+		name   string
+		region *TransformOptionsCropRegion
+	}{
+		{"whole image", nil},
+		{"region", region},
+	}
+	for _, test := range tests {
+		img := transform(&TransformOptions{Pixelate: 8, PixelateRegion: test.region})
+		if img.Bounds() != original.Bounds() {
+			t.Fatalf("%s: pixelated image is %v, expected %v", test.name, img.Bounds(), original.Bounds())
+		}
+		left, top, right, bottom := 0, 0, 64, 64
+		if test.region != nil {
+			left, top, right, bottom = test.region.Left, test.region.Top, test.region.Left+test.region.Width, test.region.Top+test.region.Height
+		}
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				if x < left || x >= right || y < top || y >= bottom {
+					// outside the region, the image is unchanged
+					if c, expected := colorAt(img, x, y), colorAt(original, x, y); c != expected {
+						t.Fatalf("%s: pixel (%d, %d) outside the region is %v, expected %v", test.name, x, y, c, expected)
+					}
+					continue
+				}
+				// inside, each pixel has the color of the top-left pixel of its block
+				blockX, blockY := left+(x-left)/8*8, top+(y-top)/8*8
+				if c, expected := colorAt(img, x, y), colorAt(img, blockX, blockY); c != expected {
+					t.Fatalf("%s: pixel (%d, %d) is %v, expected the color %v of its block", test.name, x, y, c, expected)
+				}
+			}
+		}
+	}
+
+	for _, params := range []*TransformOptions{
+		{Pixelate: 1},
+		{Pixelate: -2},
+		{PixelateRegion: region},
+		{Pixelate: 8, PixelateRegion: &TransformOptionsCropRegion{Left: -1, Width: 8, Height: 8}},
+	} {
+		if err := params.Validate(); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Validate(%+v) returned error %v, expected %v", params, err, ErrInvalidOption)
+		}
+	}
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), input, &TransformOptions{Pixelate: 8, PixelateRegion: &TransformOptionsCropRegion{Left: 60, Width: 8, Height: 8}}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("ProcessTransformRequest with a pixelate region outside the image returned error %v, expected %v", err, ErrInvalidOption)
+	}
+}
+
+func TestDefaultMaxDimension(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{DefaultMaxDimension: 1000})
+	tests := []struct {
+		resize   *TransformOptionsResize
+		expected int
+	}{
+		{nil, 1000},
+		{&TransformOptionsResize{Crop: "centre"}, 1000},
+		{&TransformOptionsResize{Width: 100}, 0},
+		{&TransformOptionsResize{HeightPercent: 50}, 0},
+	}
+	for _, test := range tests {
+		if maxDimension := mp.DefaultMaxDimension(&TransformOptions{Resize: test.resize}); maxDimension != test.expected {
+			t.Errorf("DefaultMaxDimension(%+v) = %d, expected %d", test.resize, maxDimension, test.expected)
+		}
+	}
+}
+
+func TestObserveProcessStageFormatLabel(t *testing.T) {
+	before := testutil.CollectAndCount(processDuration)
+	observeProcessStage("encode", "webp", time.Now())
+	observeProcessStage("encode", "bmp", time.Now())
+	observeProcessStage("encode", "<script>", time.Now())
+	// webp and a single series for both unknown formats
+	if n := testutil.CollectAndCount(processDuration) - before; n != 2 {
+		t.Errorf("observeProcessStage created %d series, expected 2", n)
+	}
+}
+
+func TestOutputQuality(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{DefaultQuality: map[string]int{"jpeg": 82, "avif": 50}})
+	tests := []struct {
+		format   string
+		quality  int
+		expected int
+	}{
+		{"jpeg", 0, 82},
+		{"jpeg", 90, 90},
+		{"avif", 0, 50},
+		{"webp", 0, 0},
+		{"webp", 70, 70},
+	}
+	for _, test := range tests {
+		if quality := mp.outputQuality(test.format, test.quality); quality != test.expected {
+			t.Errorf("outputQuality(%q, %d) = %d, expected %d", test.format, test.quality, quality, test.expected)
+		}
+	}
+}
+
+func TestOutputFormatAllowed(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{AllowedOutputFormats: []string{"jpeg", "webp"}})
+	for format, expected := range map[string]bool{"jpeg": true, "webp": true, "avif": false, "png": false} {
+		if allowed := mp.OutputFormatAllowed(format); allowed != expected {
+			t.Errorf("OutputFormatAllowed(%q) = %v, expected %v", format, allowed, expected)
+		}
+	}
+	if !NewMediaProcessor(MediaProcessorConfig{}).OutputFormatAllowed("avif") {
+		t.Errorf("OutputFormatAllowed(%q) without allowed formats = false, expected true", "avif")
+	}
+	mp.UpdateConfig(MediaProcessorConfig{AllowedOutputFormats: []string{"avif"}})
+	if !mp.OutputFormatAllowed("avif") || mp.OutputFormatAllowed("jpeg") {
+		t.Errorf("OutputFormatAllowed doesn't use the updated config")
+	}
+}
+
+func TestProcessTransformRequestOutputFormatAllowed(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{AllowedOutputFormats: []string{"jpeg", "webp"}})
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), encodePNG(t, quadrantsFixture()), &TransformOptions{OutputFormat: "avif"}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("ProcessTransformRequest with a disallowed output format returned error %v, expected %v", err, ErrInvalidOption)
+	}
+	// undecodable media is reported as such first, so that it can be passed through
+	if _, _, err := mp.ProcessTransformRequest(context.Background(), []byte("not an image"), &TransformOptions{OutputFormat: "png"}); !errors.Is(err, ErrUndecodableImage) {
+		t.Errorf("ProcessTransformRequest of undecodable media with a disallowed output format returned error %v, expected %v", err, ErrUndecodableImage)
+	}
+}
+
+func TestParseVipsInteresting(t *testing.T) {
+	tests := map[string]vips.Interesting{
+		"":          vips.InterestingNone,
+		"none":      vips.InterestingNone,
+		"centre":    vips.InterestingCentre,
+		"entropy":   vips.InterestingEntropy,
+		"attention": vips.InterestingAttention,
+		"low":       vips.InterestingLow,
+		"high":      vips.InterestingHigh,
+		"all":       vips.InterestingAll,
+		"last":      vips.InterestingLast,
+	}
+	for value, expected := range tests {
+		if interesting, err := parseVipsInteresting(value); err != nil || interesting != expected {
+			t.Errorf("parseVipsInteresting(%q) = %v, %v, expected %v", value, interesting, err, expected)
+		}
+	}
+	if _, err := parseVipsInteresting("center"); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("parseVipsInteresting(%q) returned error %v, expected %v", "center", err, ErrInvalidOption)
+	}
+}
+
+func TestParseVipsSize(t *testing.T) {
+	tests := map[string]vips.Size{
+		"":      vips.SizeBoth,
+		"both":  vips.SizeBoth,
+		"up":    vips.SizeUp,
+		"down":  vips.SizeDown,
+		"force": vips.SizeForce,
+		"last":  vips.SizeLast,
+	}
+	for value, expected := range tests {
+		if size, err := parseVipsSize(value); err != nil || size != expected {
+			t.Errorf("parseVipsSize(%q) = %v, %v, expected %v", value, size, err, expected)
+		}
+	}
+	if _, err := parseVipsSize("smaller"); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("parseVipsSize(%q) returned error %v, expected %v", "smaller", err, ErrInvalidOption)
+	}
+}
+
+func TestTransformOptionsValidateResizeCropAndSize(t *testing.T) {
+	outside, inside := 1.5, 0.25
+	for _, resize := range []*TransformOptionsResize{
+		{Width: 100, Crop: "middle"},
+		{Width: 100, Size: "smaller"},
+		{Width: 100, Height: 100, Focus: &TransformOptionsFocus{X: &outside}},
+		{Width: 100, Height: 100, Crop: "attention", Focus: &TransformOptionsFocus{X: &inside}},
+		{Width: 100, Height: 100, Fit: "contain", Focus: &TransformOptionsFocus{X: &inside}},
+	} {
+		if err := (&TransformOptions{Resize: resize}).Validate(); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Validate with resize %+v returned error %v, expected %v", resize, err, ErrInvalidOption)
+		}
+	}
+	if err := (&TransformOptions{Resize: &TransformOptionsResize{Width: 100, Crop: "attention", Size: "down"}}).Validate(); err != nil {
+		t.Errorf("Validate with a valid crop and size returned error: %v", err)
+	}
+	if err := (&TransformOptions{Resize: &TransformOptionsResize{Width: 100, Height: 100, Fit: "cover", Focus: &TransformOptionsFocus{Y: &inside}}}).Validate(); err != nil {
+		t.Errorf("Validate with a valid focus returned error: %v", err)
+	}
+}
+
+func TestTransformOptionsValidateDpr(t *testing.T) {
+	for _, dpr := range []float64{-1, math.NaN(), math.Inf(1)} {
+		if err := (&TransformOptions{Dpr: dpr}).Validate(); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Validate with dpr %g returned error %v, expected %v", dpr, err, ErrInvalidOption)
+		}
+	}
+	for _, dpr := range []float64{0, 0.5, 2, 10} {
+		if err := (&TransformOptions{Dpr: dpr}).Validate(); err != nil {
+			t.Errorf("Validate with dpr %g returned error: %v", dpr, err)
+		}
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		hex      string
+		expected *vips.Color
+	}{
+		{"ffffff", &vips.Color{R: 255, G: 255, B: 255}},
+		{"#ff8000", &vips.Color{R: 255, G: 128, B: 0}},
+		{"0f0", &vips.Color{R: 0, G: 255, B: 0}},
+		{"fffff", nil},
+		{"gggggg", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		c, err := parseHexColor(test.hex)
+		if test.expected == nil {
+			if !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("parseHexColor(%q) returned error %v, expected %v", test.hex, err, ErrInvalidOption)
+			}
+			continue
+		}
+		if err != nil || *c != *test.expected {
+			t.Errorf("parseHexColor(%q) = %v, %v, expected %v", test.hex, c, err, test.expected)
+		}
+	}
+}
+
 func downloadFile(url, fileName string) error {
 	//Get the response bytes from the url
 	response, err := http.Get(url)
@@ -38,18 +1524,6 @@ func downloadFile(url, fileName string) error {
 }
 
 func BenchmarkProcessMetadataRequest(b *testing.B) {
-	vips.LoggingSettings(nil, vips.LogLevelWarning)
-	vips.Startup(&vips.Config{
-		ConcurrencyLevel: 1,
-		MaxCacheFiles:    0,
-		MaxCacheMem:      50 * 1024 * 1024,
-		MaxCacheSize:     100,
-		// ReportLeaks      :
-		// CacheTrace       :
-		// CollectStats     :
-	})
-	// defer vips.Shutdown()
-
 	// Load test image
 	if err := os.Mkdir("tempdata", 0755); err != nil {
 		if !os.IsExist(err) {
@@ -69,16 +1543,16 @@ func BenchmarkProcessMetadataRequest(b *testing.B) {
 
 	// Create metadata options
 	params := &MetadataOptions{
-		// BlurHash:  true,
+		// BlurHash:  &MetadataOptionsBlurHash{Enabled: true},
 		ThumbHash: true,
 		// PotatoWebp: true,
 	}
 
-	mp := NewMediaProcessor()
+	mp := NewMediaProcessor(MediaProcessorConfig{})
 	// Run the benchmark
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := mp.ProcessMetadataRequest(imageBytes, params)
+		_, err := mp.ProcessMetadataRequest(context.Background(), imageBytes, params)
 		if err != nil {
 			b.Fatalf("failed to process metadata: %v", err)
 		}
@@ -0,0 +1,107 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"image"
+	"sort"
+)
+
+// MaxPaletteColors is the maximum number of colors of a palette
+const MaxPaletteColors = 16
+
+type paletteBox struct {
+	pixels [][3]uint8
+}
+
+// channelRange returns the channel with the widest range of values in the box, and that range
+func (b *paletteBox) channelRange() (int, int) {
+	channel, widest := 0, 0
+	for c := 0; c < 3; c++ {
+		lo, hi := 255, 0
+		for _, p := range b.pixels {
+			v := int(p[c])
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > widest {
+			channel, widest = c, hi-lo
+		}
+	}
+	return channel, widest
+}
+
+func (b *paletteBox) average() [3]uint8 {
+	var sum [3]int
+	for _, p := range b.pixels {
+		for c := 0; c < 3; c++ {
+			sum[c] += int(p[c])
+		}
+	}
+	var avg [3]uint8
+	for c := 0; c < 3; c++ {
+		avg[c] = uint8((sum[c] + len(b.pixels)/2) / len(b.pixels))
+	}
+	return avg
+}
+
+// extractPalette quantizes the image to up to n colors using median cut. The
+// colors are returned as hex strings, ordered by the number of pixels they
+// represent (most common first). Mostly transparent pixels are ignored.
+func extractPalette(img image.Image, n int) []string {
+	bounds := img.Bounds()
+	box := &paletteBox{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// un-premultiply the alpha
+			box.pixels = append(box.pixels, [3]uint8{uint8(r * 0xff / a), uint8(g * 0xff / a), uint8(b * 0xff / a)})
+		}
+	}
+	if len(box.pixels) == 0 || n <= 0 {
+		return nil
+	}
+
+	boxes := []*paletteBox{box}
+	for len(boxes) < n {
+		// split the box with the widest channel range at its median
+		index, channel, widest := -1, 0, 0
+		for i, b := range boxes {
+			if c, r := b.channelRange(); r > widest {
+				index, channel, widest = i, c, r
+			}
+		}
+		if index < 0 {
+			break
+		}
+		pixels := boxes[index].pixels
+		sort.Slice(pixels, func(i, j int) bool { return pixels[i][channel] < pixels[j][channel] })
+		median := len(pixels) / 2
+		// keep pixels with the same value in one box
+		for median > 0 && pixels[median-1][channel] == pixels[median][channel] {
+			median--
+		}
+		if median == 0 {
+			median = len(pixels) / 2
+			for median < len(pixels) && pixels[median-1][channel] == pixels[median][channel] {
+				median++
+			}
+		}
+		boxes[index] = &paletteBox{pixels: pixels[:median]}
+		boxes = append(boxes, &paletteBox{pixels: pixels[median:]})
+	}
+
+	sort.SliceStable(boxes, func(i, j int) bool { return len(boxes[i].pixels) > len(boxes[j].pixels) })
+	palette := make([]string, 0, len(boxes))
+	for _, b := range boxes {
+		avg := b.average()
+		palette = append(palette, fmt.Sprintf("#%02x%02x%02x", avg[0], avg[1], avg[2]))
+	}
+	return palette
+}
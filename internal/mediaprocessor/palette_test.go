@@ -0,0 +1,54 @@
+package mediaprocessor
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestExtractPalette(t *testing.T) {
+	// 3/4 red, 1/4 blue, and a transparent row that is ignored
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 5))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if x < 3 {
+				img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	for x := 0; x < 4; x++ {
+		img.Set(x, 4, color.NRGBA{0, 255, 0, 0})
+	}
+	tests := []struct {
+		n        int
+		expected []string
+	}{
+		{0, nil},
+		{1, []string{"#bf0040"}},
+		{2, []string{"#ff0000", "#0000ff"}},
+		// there are only two distinct colors
+		{4, []string{"#ff0000", "#0000ff"}},
+	}
+	for _, test := range tests {
+		if palette := extractPalette(img, test.n); !reflect.DeepEqual(palette, test.expected) {
+			t.Errorf("extractPalette(%d) = %v, expected %v", test.n, palette, test.expected)
+		}
+	}
+	if palette := extractPalette(image.NewNRGBA(image.Rect(0, 0, 2, 2)), 4); palette != nil {
+		t.Errorf("extractPalette of a transparent image = %v, expected none", palette)
+	}
+}
+
+func TestMetadataOptionsValidatePalette(t *testing.T) {
+	for _, palette := range []int{-1, MaxPaletteColors + 1} {
+		if err := (&MetadataOptions{Palette: palette}).Validate(); err == nil {
+			t.Errorf("Validate with palette %d returned no error", palette)
+		}
+	}
+	if err := (&MetadataOptions{Palette: MaxPaletteColors}).Validate(); err != nil {
+		t.Errorf("Validate with palette %d returned error: %v", MaxPaletteColors, err)
+	}
+}
@@ -0,0 +1,60 @@
+package mediaprocessor
+
+import (
+	"context"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/rs/zerolog/log"
+)
+
+// maxTargetBytesAttempts bounds the number of encodes of targetBytes, and so its latency
+const maxTargetBytesAttempts = 6
+
+// targetBytesFormats are the lossy output formats whose quality targetBytes searches
+var targetBytesFormats = map[string]bool{
+	"jpeg": true,
+	"webp": true,
+	"avif": true,
+}
+
+// encodeTargetBytes encodes the image with the highest quality whose output
+// fits in params.TargetBytes, binary searching between 1 and the requested
+// (or default) quality, or 100 when there's none. It encodes at most
+// maxTargetBytesAttempts times, and returns the output of the lowest quality
+// when none fits.
+func (mp *MediaProcessor) encodeTargetBytes(ctx context.Context, image *vips.ImageRef, params *TransformOptions, quality int, stripMetadata bool) ([]byte, string, error) {
+	low, high := 1, quality
+	if high <= 0 {
+		high = 100
+	}
+	var best, lowest []byte
+	var contentType string
+	for attempt := 0; attempt < maxTargetBytesAttempts && low <= high; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		// the highest quality is tried first, as it often fits, and the
+		// lowest last when nothing did
+		q := (low + high + 1) / 2
+		if attempt == 0 {
+			q = high
+		} else if attempt == maxTargetBytesAttempts-1 && best == nil {
+			q = low
+		}
+		out, ct, err := encode(image, params, q, stripMetadata)
+		if err != nil {
+			return nil, "", err
+		}
+		contentType = ct
+		log.Debug().Int("quality", q).Int("size", len(out)).Int("targetBytes", params.TargetBytes).Msg("Encoded image for the target size")
+		if len(out) <= params.TargetBytes {
+			best, low = out, q+1
+		} else {
+			lowest, high = out, q-1
+		}
+	}
+	if best != nil {
+		return best, contentType, nil
+	}
+	return lowest, contentType, nil
+}
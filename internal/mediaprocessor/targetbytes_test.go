@@ -0,0 +1,44 @@
+package mediaprocessor
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestProcessTransformRequestTargetBytes(t *testing.T) {
+	mp := NewMediaProcessor(MediaProcessorConfig{})
+	input := encodePNG(t, softFixture())
+	encodeSize := func(params *TransformOptions) int {
+		params.Brightness, params.Contrast = 1, 1
+		output, _, err := mp.ProcessTransformRequest(context.Background(), input, params)
+		if err != nil {
+			t.Fatalf("ProcessTransformRequest with %+v returned error: %v", params, err)
+		}
+		return len(output)
+	}
+	for _, format := range []string{"jpeg", "webp"} {
+		highest := encodeSize(&TransformOptions{OutputFormat: format, Quality: 100})
+		lowest := encodeSize(&TransformOptions{OutputFormat: format, Quality: 1})
+		tests := []struct {
+			name        string
+			targetBytes int
+			check       func(size int) bool
+		}{
+			{"large target", highest, func(size int) bool { return size == highest }},
+			{"medium target", (highest + lowest) / 2, func(size int) bool { return size <= (highest+lowest)/2 && size > lowest }},
+			{"unreachable target", lowest - 1, func(size int) bool { return size == lowest }},
+		}
+		for _, test := range tests {
+			if size := encodeSize(&TransformOptions{OutputFormat: format, TargetBytes: test.targetBytes}); !test.check(size) {
+				t.Errorf("%s output with %s %d is %d bytes (%d at quality 100, %d at quality 1)", format, test.name, test.targetBytes, size, highest, lowest)
+			}
+		}
+	}
+
+	for _, params := range []*TransformOptions{{TargetBytes: -1}, {TargetBytes: 1000, Lossless: true}} {
+		if err := params.Validate(); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("Validate(%+v) returned error %v, expected %v", params, err, ErrInvalidOption)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// acceptRange is a media range of an Accept header with its q-value
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses an Accept header into its media ranges, sorted by q-value
+// (highest first, keeping the header order for equal q-values). Malformed
+// ranges and ranges with an invalid q-value are skipped.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok || typ == "" || subtype == "" || (typ == "*" && subtype != "*") {
+			continue
+		}
+		q, valid := 1.0, true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				valid = false
+				break
+			}
+			q = parsed
+		}
+		if valid {
+			ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
+
+// acceptQuality returns the q-value of the most specific range matching the
+// content type (exact match, then type/*, then */*), or 0 when none match.
+func acceptQuality(ranges []acceptRange, contentType string) float64 {
+	typ, _, _ := strings.Cut(contentType, "/")
+	q, specificity := 0.0, 0
+	for _, r := range ranges {
+		s := 0
+		switch r.mediaType {
+		case contentType:
+			s = 3
+		case typ + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// explicitAcceptQuality returns the q-value of the range naming exactly the
+// content type, ignoring wildcards, or 0 when the content type isn't listed.
+func explicitAcceptQuality(ranges []acceptRange, contentType string) float64 {
+	for _, r := range ranges {
+		if r.mediaType == contentType {
+			return r.q
+		}
+	}
+	return 0
+}
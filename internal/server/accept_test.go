@@ -0,0 +1,47 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAccept(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []acceptRange
+	}{
+		{"", nil},
+		{"*/*", []acceptRange{{"*/*", 1}}},
+		{"image/webp;q=0.8,image/png", []acceptRange{{"image/png", 1}, {"image/webp", 0.8}}},
+		{"IMAGE/AVIF ; Q=0.9 , image/*;level=1", []acceptRange{{"image/*", 1}, {"image/avif", 0.9}}},
+		{"image/avif;q=0,text/html", []acceptRange{{"text/html", 1}, {"image/avif", 0}}},
+		// malformed ranges are skipped
+		{"image,/png,*/webp,image/webp;q=abc,image/avif;q=2,,;q=1,image/png", []acceptRange{{"image/png", 1}}},
+	}
+	for _, test := range tests {
+		if ranges := parseAccept(test.header); !reflect.DeepEqual(ranges, test.expected) {
+			t.Errorf("parseAccept(%q) = %v, expected %v", test.header, ranges, test.expected)
+		}
+	}
+}
+
+func TestAcceptQuality(t *testing.T) {
+	ranges := parseAccept("image/webp;q=0,image/*;q=0.8,*/*;q=0.5,image/png")
+	tests := []struct {
+		contentType string
+		expected    float64
+	}{
+		{"image/png", 1},
+		{"image/webp", 0},
+		{"image/jpeg", 0.8},
+		{"text/html", 0.5},
+	}
+	for _, test := range tests {
+		if q := acceptQuality(ranges, test.contentType); q != test.expected {
+			t.Errorf("acceptQuality(%q) = %g, expected %g", test.contentType, q, test.expected)
+		}
+	}
+	if q := acceptQuality(nil, "image/png"); q != 0 {
+		t.Errorf("acceptQuality without ranges = %g, expected 0", q)
+	}
+}
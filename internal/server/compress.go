@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// minCompressSize is the size below which response bodies aren't compressed,
+// as the compression overhead outweighs the savings
+const minCompressSize = 1024
+
+// negotiateEncoding returns the content coding a response body of the given
+// size is compressed with for the Accept-Encoding header: gzip when the client
+// accepts it (listed or with *, and a non-zero q-value), or empty.
+func negotiateEncoding(acceptEncoding string, size int) string {
+	if size < minCompressSize {
+		return ""
+	}
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				parsed = 0
+			}
+			q = parsed
+		}
+		switch coding {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			wildcardQ = q
+		}
+	}
+	if gzipQ > 0 || (gzipQ < 0 && wildcardQ > 0) {
+		return "gzip"
+	}
+	return ""
+}
+
+// writeEncoded writes the response body compressed with the content coding
+// (if any), falling back to the uncompressed body when compressing fails
+func writeEncoded(w http.ResponseWriter, body []byte, encoding string) {
+	if encoding == "gzip" {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(body)
+		if err == nil {
+			err = gz.Close()
+		}
+		if err == nil {
+			w.Header().Set("Content-Encoding", encoding)
+			// the length of the uncompressed body doesn't apply anymore
+			w.Header().Del("Content-Length")
+			w.Write(buf.Bytes())
+			return
+		}
+		log.Error().Err(err).Msg("Failed to compress response")
+	}
+	w.Write(body)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		size           int
+		expected       string
+	}{
+		{"gzip, deflate, br, zstd", 2048, "gzip"},
+		{"gzip, deflate, br, zstd", 100, ""},
+		{"deflate, br", 2048, ""},
+		{"*", 2048, "gzip"},
+		{"gzip;q=0, *", 2048, ""},
+		{"br;q=1.0, gzip;q=0.5", 2048, "gzip"},
+		{"identity", 2048, ""},
+		{"", 2048, ""},
+	}
+	for _, test := range tests {
+		if encoding := negotiateEncoding(test.acceptEncoding, test.size); encoding != test.expected {
+			t.Errorf("negotiateEncoding(%q, %d) = %q, expected %q", test.acceptEncoding, test.size, encoding, test.expected)
+		}
+	}
+}
+
+func TestWriteEncoded(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"potatowebp":"UklGRjQAAABXRUJQ"}`), 100)
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Length", "3400")
+	writeEncoded(rec, body, "gzip")
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("writeEncoded set Content-Encoding %q, expected %q", encoding, "gzip")
+	}
+	if length := rec.Header().Get("Content-Length"); length != "" {
+		t.Errorf("writeEncoded kept Content-Length %q of the uncompressed body", length)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to read compressed body: %v", err)
+	}
+	decompressed, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress body: %v", err)
+	}
+	if !bytes.Equal(decompressed, body) {
+		t.Errorf("writeEncoded wrote a body decompressing to %d bytes, expected the %d byte body", len(decompressed), len(body))
+	}
+
+	rec = httptest.NewRecorder()
+	writeEncoded(rec, body, "")
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("writeEncoded without encoding set Content-Encoding %q", encoding)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Errorf("writeEncoded without encoding changed the body")
+	}
+}
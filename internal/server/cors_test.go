@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blesswinsamuel/media-proxy/internal/cache"
+	"github.com/blesswinsamuel/media-proxy/internal/loader"
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	tests := []struct {
+		allowedOrigins []string
+		method         string
+		origin         string
+		expectedOrigin string
+		expectedCode   int
+	}{
+		{[]string{"https://app.example.com"}, http.MethodGet, "https://app.example.com", "https://app.example.com", http.StatusOK},
+		{[]string{"https://app.example.com"}, http.MethodGet, "https://evil.example.com", "", http.StatusOK},
+		{[]string{"https://app.example.com"}, http.MethodGet, "", "", http.StatusOK},
+		{[]string{"*"}, http.MethodGet, "https://any.example.com", "*", http.StatusOK},
+		{[]string{"https://app.example.com"}, http.MethodOptions, "https://app.example.com", "https://app.example.com", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/_/media/image.jpg", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			r.Header.Set("Access-Control-Request-Headers", "If-None-Match")
+		}
+		rec := httptest.NewRecorder()
+		corsMiddleware(test.allowedOrigins)(next).ServeHTTP(rec, r)
+		if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != test.expectedOrigin {
+			t.Errorf("%s from %q with allowed origins %v returned Access-Control-Allow-Origin %q, expected %q", test.method, test.origin, test.allowedOrigins, origin, test.expectedOrigin)
+		}
+		if rec.Code != test.expectedCode {
+			t.Errorf("%s from %q with allowed origins %v returned status %d, expected %d", test.method, test.origin, test.allowedOrigins, rec.Code, test.expectedCode)
+		}
+		if test.expectedCode == http.StatusNoContent && rec.Header().Get("Access-Control-Allow-Headers") != "If-None-Match" {
+			t.Errorf("preflight returned Access-Control-Allow-Headers %q, expected %q", rec.Header().Get("Access-Control-Allow-Headers"), "If-None-Match")
+		}
+	}
+}
+
+func TestServerWithoutCORSOrigins(t *testing.T) {
+	s := NewServer(ServerConfig{EnableUnsafe: true, Concurrency: 1}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	r := httptest.NewRequest(http.MethodOptions, "/_/media/image.jpg", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, r)
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("server without CORS origins returned Access-Control-Allow-Origin %q, expected none", origin)
+	}
+}
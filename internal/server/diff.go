@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// diffInput is one of the transformed media of a diff request
+type diffInput struct {
+	MediaPath string
+	Params    *mediaprocessor.TransformOptions
+}
+
+// diffOptions are the options of /diff: the media paths a and b, with their
+// transform options as the query of each (like image.jpg?resize.width=100)
+type diffOptions struct {
+	A         diffInput
+	B         diffInput
+	DiffImage bool
+}
+
+func parseDiffQuery(query url.Values) (*diffOptions, error) {
+	opts := &diffOptions{}
+	for name, input := range map[string]*diffInput{"a": &opts.A, "b": &opts.B} {
+		value := query.Get(name)
+		if value == "" {
+			return nil, fmt.Errorf("%w: missing %s parameter", mediaprocessor.ErrInvalidOption, name)
+		}
+		mediaPath, rawQuery, _ := strings.Cut(value, "?")
+		transformQuery, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid %s parameter: %v", mediaprocessor.ErrInvalidOption, name, err)
+		}
+		params, err := parseTransformQuery(transformQuery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s parameter: %w", name, err)
+		}
+		*input = diffInput{MediaPath: mediaPath, Params: params}
+	}
+	if value := query.Get("diffImage"); value != "" {
+		var err error
+		if opts.DiffImage, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("%w: invalid diffImage parameter: %q", mediaprocessor.ErrInvalidOption, value)
+		}
+	}
+	return opts, nil
+}
+
+// handleDiffRequest compares the media a and b, transformed with their
+// options, responding with their similarity and optionally an image of their
+// differences. The signature covers diff/ and the query, like
+// SignPath(secret, "diff", "", query). Results aren't cached.
+func (s *server) handleDiffRequest(w http.ResponseWriter, r *http.Request) {
+	info, err := getRequestInfo(s, r, "diff", parseDiffQuery)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get request info")
+		writeError(w, err)
+		return
+	}
+	logger := log.With().Str("method", r.Method).Stringer("url", r.URL).Logger()
+	ctx := logger.WithContext(requestContext(r))
+	logger.Debug().Interface("opts", info.RequestParams).Msg("Incoming Request")
+	ctx, span := tracer.Start(ctx, "handleDiffRequest")
+	defer span.End()
+
+	opts := info.RequestParams
+	a, err := s.renderDiffInput(ctx, opts.A, info.UpstreamHeader)
+	var b []byte
+	if err == nil {
+		b, err = s.renderDiffInput(ctx, opts.B, info.UpstreamHeader)
+	}
+	var diff *mediaprocessor.DiffResponse
+	if err == nil {
+		diff, err = s.mediaProcessor.DiffImages(ctx, a, b, opts.DiffImage)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to process diff request")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to process diff request")
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// renderDiffInput fetches and transforms the media of a diff input. Inputs
+// without an output format are rendered as PNG, so that the comparison isn't
+// affected by lossy compression.
+func (s *server) renderDiffInput(ctx context.Context, input diffInput, header http.Header) ([]byte, error) {
+	media, err := s.getOriginalImage(ctx, input.MediaPath, header)
+	if err != nil {
+		return nil, err
+	}
+	params := input.Params
+	if params.OutputFormat == "" {
+		params.OutputFormat = "png"
+	}
+	out, _, err := s.mediaProcessor.ProcessTransformRequest(ctx, media.Data, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transform %s: %w", input.MediaPath, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blesswinsamuel/media-proxy/internal/cache"
+	"github.com/blesswinsamuel/media-proxy/internal/loader"
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+	"github.com/blesswinsamuel/media-proxy/signature"
+)
+
+func TestParseDiffQuery(t *testing.T) {
+	opts, err := parseDiffQuery(url.Values{"a": {"a.png?resize.width=100&outputFormat=webp"}, "b": {"images/b.png"}, "diffImage": {"true"}})
+	if err != nil {
+		t.Fatalf("parseDiffQuery returned error: %v", err)
+	}
+	if opts.A.MediaPath != "a.png" || opts.A.Params.Resize == nil || opts.A.Params.Resize.Width != 100 || opts.A.Params.OutputFormat != "webp" {
+		t.Errorf("parseDiffQuery parsed a as %q with %+v, expected a.png resized to a width of 100 as webp", opts.A.MediaPath, opts.A.Params)
+	}
+	if opts.B.MediaPath != "images/b.png" || opts.B.Params.Resize != nil || !opts.DiffImage {
+		t.Errorf("parseDiffQuery parsed b as %q with %+v (diff image %v), expected images/b.png without options", opts.B.MediaPath, opts.B.Params, opts.DiffImage)
+	}
+}
+
+func TestHandleDiffRequestErrors(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.png"), []byte("data"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(root), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	tests := []struct {
+		name            string
+		path            string
+		expectedCode    int
+		expectedMessage string
+	}{
+		{"invalid signature", signature.SignPath("other", "diff", "", url.Values{"a": {"a.png"}, "b": {"a.png"}}), http.StatusForbidden, "Invalid signature"},
+		{"missing b", signature.SignPath("secret", "diff", "", url.Values{"a": {"a.png"}}), http.StatusBadRequest, "missing b parameter"},
+		{"invalid options", signature.SignPath("secret", "diff", "", url.Values{"a": {"a.png?rotate=abc"}, "b": {"a.png"}}), http.StatusBadRequest, "invalid a parameter"},
+		{"missing media", signature.SignPath("secret", "diff", "", url.Values{"a": {"missing.png"}, "b": {"a.png"}}), http.StatusNotFound, "Failed to fetch image"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, test.path, nil))
+		if rec.Code != test.expectedCode || !strings.Contains(rec.Body.String(), test.expectedMessage) {
+			t.Errorf("%s: diff request returned %d %q, expected %d with %q", test.name, rec.Code, rec.Body.String(), test.expectedCode, test.expectedMessage)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+	"github.com/rs/zerolog/log"
+)
+
+// imgproxyGravities maps the imgproxy gravity types to resize gravities
+var imgproxyGravities = map[string]string{
+	"no":   "north",
+	"so":   "south",
+	"ea":   "east",
+	"we":   "west",
+	"noea": "northeast",
+	"nowe": "northwest",
+	"soea": "southeast",
+	"sowe": "southwest",
+	"ce":   "center",
+}
+
+// imgproxyFormats maps the imgproxy output formats to output formats
+var imgproxyFormats = map[string]string{
+	"jpg":  "jpeg",
+	"jpeg": "jpeg",
+	"png":  "png",
+	"webp": "webp",
+	"avif": "avif",
+	"gif":  "gif",
+}
+
+// handleImgproxyRequest handles imgproxy URLs, like
+// /{signature}/rs:fill:300:200/g:sm/plain/http://example.com/image.jpg@webp
+func (s *server) handleImgproxyRequest(w http.ResponseWriter, r *http.Request) {
+	signature, path, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	path = "/" + path
+	if !s.config.EnableUnsafe && !validImgproxySignature(s.config.ImgproxyKey, s.config.ImgproxySalt, signature, path) {
+		writeError(w, NewHTTPError(http.StatusForbidden, "Invalid signature", nil))
+		return
+	}
+	mediaPath, params, err := parseImgproxyPath(path)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse imgproxy path")
+		writeError(w, NewHTTPError(http.StatusBadRequest, "Failed to parse imgproxy options", err))
+		return
+	}
+	s.transform(w, r, &RequestInfo[mediaprocessor.TransformOptions]{
+		Signature:        signature,
+		MediaPath:        mediaPath,
+		RequestParams:    params,
+		RequestParamsRaw: url.Values{"imgproxy": {path}},
+		UpstreamHeader:   s.forwardedHeaders(r),
+	})
+}
+
+// validImgproxySignature validates the signature of an imgproxy URL path: the
+// unpadded base64url encoded HMAC-SHA256 of the salt and the path
+func validImgproxySignature(key []byte, salt []byte, signature string, path string) bool {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(path))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// parseImgproxyPath parses the processing options and source URL of an
+// imgproxy URL path (without the signature) into the media path and transform
+// options. Unsupported options are an error.
+func parseImgproxyPath(path string) (string, *mediaprocessor.TransformOptions, error) {
+	opts := mediaprocessor.NewTransformOptions()
+	resizingType, gravity := "fit", ""
+	var width, height int
+	var enlarge bool
+
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	// the options are followed by the source URL, which is either plain or
+	// base64 encoded (without colons)
+	i := 0
+	for ; i < len(segments) && segments[i] != "plain" && strings.Contains(segments[i], ":"); i++ {
+		args := strings.Split(segments[i], ":")
+		name, args := args[0], args[1:]
+		var err error
+		switch name {
+		case "resize", "rs":
+			if len(args) > 0 && args[0] != "" {
+				resizingType = args[0]
+			}
+			if len(args) > 1 {
+				width, height, enlarge, err = parseImgproxySize(args[1:])
+			}
+		case "size", "s":
+			width, height, enlarge, err = parseImgproxySize(args)
+		case "resizing_type", "rt":
+			resizingType = args[0]
+		case "width", "w":
+			width, err = parseImgproxyInt(args[0])
+		case "height", "h":
+			height, err = parseImgproxyInt(args[0])
+		case "enlarge", "el":
+			enlarge = parseImgproxyBool(args[0])
+		case "gravity", "g":
+			gravity = args[0]
+			if len(args) > 1 {
+				err = errors.New("gravity offsets aren't supported")
+			}
+		case "dpr":
+			opts.Dpr, err = strconv.ParseFloat(args[0], 64)
+		case "quality", "q":
+			opts.Quality, err = parseImgproxyInt(args[0])
+		case "format", "f", "ext":
+			opts.OutputFormat = imgproxyFormats[args[0]]
+			if opts.OutputFormat == "" {
+				err = fmt.Errorf("unsupported format %q", args[0])
+			}
+		case "blur", "bl":
+			opts.Blur, err = strconv.ParseFloat(args[0], 64)
+		case "sharpen", "sh":
+			opts.Sharpen, err = strconv.ParseFloat(args[0], 64)
+		case "rotate", "rot":
+			opts.Rotate, err = parseImgproxyInt(args[0])
+		case "background", "bg":
+			opts.Background, err = parseImgproxyBackground(args)
+		case "strip_metadata", "sm":
+			opts.StripMetadata = parseImgproxyBool(args[0])
+		case "auto_rotate", "ar":
+			opts.AutoRotate = parseImgproxyBool(args[0])
+		case "cachebuster", "cb":
+			// only changes the URL, which is part of the cache key
+		default:
+			err = errors.New("unsupported option")
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: invalid imgproxy option %q: %v", mediaprocessor.ErrInvalidOption, segments[i], err)
+		}
+	}
+
+	mediaPath, extension, err := parseImgproxySource(segments[i:])
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: invalid imgproxy source URL: %v", mediaprocessor.ErrInvalidOption, err)
+	}
+	if extension != "" {
+		if opts.OutputFormat = imgproxyFormats[extension]; opts.OutputFormat == "" {
+			return "", nil, fmt.Errorf("%w: unsupported imgproxy format %q", mediaprocessor.ErrInvalidOption, extension)
+		}
+	}
+
+	if width > 0 || height > 0 {
+		resize := &mediaprocessor.TransformOptionsResize{Width: width, Height: height, Size: "down"}
+		if enlarge {
+			resize.Size = "both"
+		}
+		switch resizingType {
+		case "fit":
+		case "fill", "fill-down", "auto":
+			if resizingType == "fill-down" {
+				resize.Size = "down"
+			}
+			switch {
+			case gravity == "sm":
+				resize.Crop = "attention"
+			case gravity != "":
+				if resize.Gravity = imgproxyGravities[gravity]; resize.Gravity == "" {
+					return "", nil, fmt.Errorf("%w: unsupported imgproxy gravity %q", mediaprocessor.ErrInvalidOption, gravity)
+				}
+			default:
+				resize.Gravity = "center"
+			}
+		case "force":
+			resize.Size = "force"
+		default:
+			return "", nil, fmt.Errorf("%w: unsupported imgproxy resizing type %q", mediaprocessor.ErrInvalidOption, resizingType)
+		}
+		opts.Resize = resize
+	}
+	return mediaPath, opts, nil
+}
+
+// parseImgproxySource parses the source URL segments of an imgproxy URL path,
+// returning the URL and the extension setting the output format (if any)
+func parseImgproxySource(segments []string) (string, string, error) {
+	if len(segments) == 0 || (len(segments) == 1 && segments[0] == "plain") {
+		return "", "", errors.New("missing source URL")
+	}
+	if segments[0] == "plain" {
+		source, extension := strings.Join(segments[1:], "/"), ""
+		if at := strings.LastIndex(source, "@"); at >= 0 && !strings.Contains(source[at:], "/") {
+			source, extension = source[:at], source[at+1:]
+		}
+		source, err := url.PathUnescape(source)
+		return source, extension, err
+	}
+	encoded, extension, _ := strings.Cut(strings.Join(segments, ""), ".")
+	source, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	return string(source), extension, err
+}
+
+// parseImgproxySize parses the width, height and enlarge arguments of the size option
+func parseImgproxySize(args []string) (int, int, bool, error) {
+	var width, height int
+	var err error
+	if len(args) > 0 {
+		if width, err = parseImgproxyInt(args[0]); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	if len(args) > 1 {
+		if height, err = parseImgproxyInt(args[1]); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	return width, height, len(args) > 2 && parseImgproxyBool(args[2]), nil
+}
+
+// parseImgproxyInt parses an integer argument, where an empty argument is 0
+func parseImgproxyInt(arg string) (int, error) {
+	if arg == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(arg)
+}
+
+// parseImgproxyBool parses a boolean argument, which is true for 1, t and true
+func parseImgproxyBool(arg string) bool {
+	return arg == "1" || arg == "t" || arg == "true"
+}
+
+// parseImgproxyBackground parses the background option, either R:G:B or a hex color
+func parseImgproxyBackground(args []string) (string, error) {
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	if len(args) != 3 {
+		return "", errors.New("expected R:G:B or a hex color")
+	}
+	var rgb [3]uint64
+	for i, arg := range args {
+		value, err := strconv.ParseUint(arg, 10, 8)
+		if err != nil {
+			return "", err
+		}
+		rgb[i] = value
+	}
+	return fmt.Sprintf("%02x%02x%02x", rgb[0], rgb[1], rgb[2]), nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/blesswinsamuel/media-proxy/internal/cache"
+	"github.com/blesswinsamuel/media-proxy/internal/loader"
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+)
+
+func TestValidImgproxySignature(t *testing.T) {
+	// echo -n "salt/rs:fill:300:200/plain/image.jpg" | openssl dgst -sha256 -hmac secret -binary | base64 | tr '+/' '-_' | tr -d '='
+	signature := "TGp8cueZj3hDfkBfGHJcjNPtM9cECPxfBBnOEHZQm1c"
+	if !validImgproxySignature([]byte("secret"), []byte("salt"), signature, "/rs:fill:300:200/plain/image.jpg") {
+		t.Errorf("validImgproxySignature rejected a valid signature")
+	}
+	if validImgproxySignature([]byte("secret"), []byte("salt"), signature, "/rs:fill:300:300/plain/image.jpg") {
+		t.Errorf("validImgproxySignature accepted a signature for another path")
+	}
+	if validImgproxySignature([]byte("secret"), []byte("other"), signature, "/rs:fill:300:200/plain/image.jpg") {
+		t.Errorf("validImgproxySignature accepted a signature with another salt")
+	}
+}
+
+func TestParseImgproxyPath(t *testing.T) {
+	withDefaults := func(modify func(opts *mediaprocessor.TransformOptions)) *mediaprocessor.TransformOptions {
+		opts := mediaprocessor.NewTransformOptions()
+		modify(opts)
+		return opts
+	}
+	tests := []struct {
+		path              string
+		expectedMediaPath string
+		expectedOpts      *mediaprocessor.TransformOptions
+	}{
+		{"/plain/http://example.com/image.jpg", "http://example.com/image.jpg", mediaprocessor.NewTransformOptions()},
+		{"/rs:fit:300:200/plain/image.jpg@webp", "image.jpg", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Width: 300, Height: 200, Size: "down"}
+			opts.OutputFormat = "webp"
+		})},
+		{"/rs:fill:300:200:1/g:sm/q:80/aW1hZ2UuanBn.png", "image.jpg", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Width: 300, Height: 200, Size: "both", Crop: "attention"}
+			opts.Quality = 80
+			opts.OutputFormat = "png"
+		})},
+		{"/rt:fill/w:300/g:nowe/bg:255:0:16/plain/dir%2Fimage.jpg", "dir/image.jpg", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Width: 300, Size: "down", Gravity: "northwest"}
+			opts.Background = "ff0010"
+		})},
+		{"/s:100:100/rt:force/bl:2/rot:90/sm:0/f:jpg/cb:123/plain/image.png", "image.png", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Width: 100, Height: 100, Size: "force"}
+			opts.Blur = 2
+			opts.Rotate = 90
+			opts.StripMetadata = false
+			opts.OutputFormat = "jpeg"
+		})},
+	}
+	for _, test := range tests {
+		mediaPath, opts, err := parseImgproxyPath(test.path)
+		if err != nil {
+			t.Errorf("parseImgproxyPath(%q) returned error: %v", test.path, err)
+			continue
+		}
+		if mediaPath != test.expectedMediaPath {
+			t.Errorf("parseImgproxyPath(%q) returned media path %q, expected %q", test.path, mediaPath, test.expectedMediaPath)
+		}
+		if !reflect.DeepEqual(opts, test.expectedOpts) {
+			t.Errorf("parseImgproxyPath(%q) returned options %+v, expected %+v", test.path, opts, test.expectedOpts)
+		}
+	}
+
+	for _, path := range []string{
+		"/rs:fill:300:200",
+		"/plain",
+		"/wm:0.5/plain/image.jpg",
+		"/rs:crop:300:200/plain/image.jpg",
+		"/w:abc/plain/image.jpg",
+		"/f:tiff/plain/image.jpg",
+		"/plain/image.jpg@bmp",
+		"/rs:fill:300:200/g:ce:10:10/plain/image.jpg",
+	} {
+		if _, _, err := parseImgproxyPath(path); !errors.Is(err, mediaprocessor.ErrInvalidOption) {
+			t.Errorf("parseImgproxyPath(%q) returned error %v, expected %v", path, err, mediaprocessor.ErrInvalidOption)
+		}
+	}
+}
+
+func TestHandleImgproxyRequestErrors(t *testing.T) {
+	s := NewServer(ServerConfig{Concurrency: 1, Secret: "secret", CompatMode: "imgproxy", ImgproxyKey: []byte("secret"), ImgproxySalt: []byte("salt")}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	tests := []struct {
+		path         string
+		expectedCode int
+	}{
+		{"/TGp8cueZj3hDfkBfGHJcjNPtM9cECPxfBBnOEHZQm1c/rs:fill:300:200/plain/image.jpg", http.StatusNotFound},
+		{"/TGp8cueZj3hDfkBfGHJcjNPtM9cECPxfBBnOEHZQm1c/rs:fill:300:300/plain/image.jpg", http.StatusForbidden},
+		{"/insecure/rs:fill:300:200/plain/image.jpg", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != test.expectedCode {
+			t.Errorf("request to %q returned status %d, expected %d", test.path, rec.Code, test.expectedCode)
+		}
+	}
+
+	s = NewServer(ServerConfig{Concurrency: 1, EnableUnsafe: true, CompatMode: "imgproxy"}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/insecure/wm:0.5/plain/image.jpg", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("request with an unsupported option returned status %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
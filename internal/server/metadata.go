@@ -1,20 +1,21 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 
 	"github.com/blesswinsamuel/media-proxy/internal/cache"
 	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
-	"github.com/gorilla/schema"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func parseMetadataQuery(query url.Values) (*mediaprocessor.MetadataOptions, error) {
 	metadataOpts := &mediaprocessor.MetadataOptions{}
-	var decoder = schema.NewDecoder()
-	decoder.SetAliasTag("query")
-	if err := decoder.Decode(metadataOpts, query); err != nil {
+	if err := decodeQuery(metadataOpts, query, "exif", "blurhash"); err != nil {
 		return nil, err
 	}
 	return metadataOpts, nil
@@ -24,20 +25,24 @@ func (s *server) handleMetadataRequest(w http.ResponseWriter, r *http.Request) {
 	info, err := getRequestInfo(s, r, "metadata", parseMetadataQuery)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get request info")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	logger := log.With().Str("method", r.Method).Stringer("url", r.URL).Logger()
-	ctx := logger.WithContext(r.Context())
+	ctx := logger.WithContext(requestContext(r))
 	logger.Debug().Interface("opts", info.RequestParams).Msg("Incoming Request")
 
+	ctx, span := tracer.Start(ctx, "handleMetadataRequest", trace.WithAttributes(attribute.String("media.path", info.MediaPath)))
+	defer span.End()
+
 	params := info.RequestParams
-	out, err := cache.GetCachedOrFetch(s.metadataCache, info.MediaPath+"?"+r.URL.Query().Encode(), func() ([]byte, error) {
-		imageBytes, err := s.getOriginalImage(ctx, info.MediaPath)
+	cacheKey := versionedCacheKey(s.config.CacheVersion, info.CacheKey())
+	out, metadataCache, err := cache.GetCachedOrFetch(ctx, s.metadataCache, "metadata", cacheKey, func(ctx context.Context) ([]byte, error) {
+		media, err := s.getOriginalImage(ctx, info.MediaPath, info.UpstreamHeader)
 		if err != nil {
 			return nil, err
 		}
-		out, err := s.mediaProcessor.ProcessMetadataRequest(imageBytes, params)
+		out, err := s.mediaProcessor.ProcessMetadataRequest(ctx, media.Data, params)
 		if err != nil {
 			return nil, err
 		}
@@ -46,8 +51,26 @@ func (s *server) handleMetadataRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to process metadata request")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to process metadata request")
+		writeError(w, err)
+		return
+	}
+	logger.Debug().Str("metadataCache", string(metadataCache)).Msg("Responding with metadata")
+	// the JSON can hold base64 encoded previews, so it's compressed unlike the media
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), len(out))
+	w.Header().Add("Vary", "Accept-Encoding")
+	directives := s.config.MetadataCacheControl
+	if params.IncludesHash() {
+		directives = s.config.HashCacheControl
+	}
+	s.setCacheControl(w, directives, info.Expiry)
+	etagType := "application/json"
+	if encoding != "" {
+		etagType += "+" + encoding
+	}
+	if checkNotModified(w, r, etag(cacheKey, etagType)) {
 		return
 	}
-	w.Write(out)
+	writeEncoded(w, out, encoding)
 }
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// maxNegativeCacheEntries bounds the memory of the negative cache. Errors
+// aren't cached while it's full of unexpired entries.
+const maxNegativeCacheEntries = 10000
+
+type negativeCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// negativeCache remembers the permanent upstream errors (like 404s) of loader
+// cache keys for a short time, so that requests for missing media don't all
+// hit the upstream. A nil negativeCache caches nothing.
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]negativeCacheEntry
+}
+
+// newNegativeCache returns a negative cache whose entries expire after ttl,
+// or nil when ttl isn't positive
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &negativeCache{ttl: ttl, now: time.Now, entries: map[string]negativeCacheEntry{}}
+}
+
+// get returns the cached error for key, or nil when there's none or it expired
+func (c *negativeCache) get(key string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.err
+}
+
+// put caches err for key until the ttl elapses
+func (c *negativeCache) put(key string, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= maxNegativeCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNegativeCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = negativeCacheEntry{err: err, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	now := time.Now()
+	c := newNegativeCache(time.Minute)
+	c.now = func() time.Time { return now }
+	errNotFound := errors.New("not found")
+
+	if err := c.get("a"); err != nil {
+		t.Errorf("get of a missing key = %v, expected nil", err)
+	}
+	c.put("a", errNotFound)
+	if err := c.get("a"); err != errNotFound {
+		t.Errorf("get of a cached key = %v, expected %v", err, errNotFound)
+	}
+	now = now.Add(time.Minute)
+	if err := c.get("a"); err != nil {
+		t.Errorf("get of an expired key = %v, expected nil", err)
+	}
+
+	if c := newNegativeCache(0); c != nil {
+		t.Errorf("newNegativeCache(0) = %v, expected nil", c)
+	}
+	var disabled *negativeCache
+	disabled.put("a", errNotFound)
+	if err := disabled.get("a"); err != nil {
+		t.Errorf("get of a disabled negative cache = %v, expected nil", err)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// uploadField is the multipart form field of the image uploaded to /process
+const uploadField = "image"
+
+// uploadTimeout is the time uploads to /process can take, as the server's read
+// timeout is meant for requests without a body
+const uploadTimeout = time.Minute
+
+// handleProcessRequest transforms an image uploaded as the image field of a
+// multipart form, with the transform options of the query. The signature
+// covers process/ and the query, like SignPath(secret, "process", "", query).
+// The loader and the caches are bypassed.
+func (s *server) handleProcessRequest(w http.ResponseWriter, r *http.Request) {
+	info, err := getRequestInfo(s, r, "process", parseTransformQuery)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get request info")
+		writeError(w, err)
+		return
+	}
+	logger := log.With().Str("method", r.Method).Stringer("url", r.URL).Logger()
+	ctx := logger.WithContext(requestContext(r))
+	logger.Debug().Interface("opts", info.RequestParams).Msg("Incoming Request")
+	ctx, span := tracer.Start(ctx, "handleProcessRequest")
+	defer span.End()
+
+	// the response is written after the upload, so its deadline moves along
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(time.Now().Add(uploadTimeout)); err != nil {
+		logger.Debug().Err(err).Msg("Failed to extend the read deadline of the upload")
+	}
+	if err := controller.SetWriteDeadline(time.Now().Add(uploadTimeout + s.srv.WriteTimeout)); err != nil {
+		logger.Debug().Err(err).Msg("Failed to extend the write deadline of the upload")
+	}
+	if s.config.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadSize)
+	}
+	data, err := readUpload(r)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read uploaded image")
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, NewHTTPError(http.StatusRequestEntityTooLarge, "Uploaded image too large", err))
+			return
+		}
+		writeError(w, NewHTTPError(http.StatusBadRequest, "Failed to read uploaded image", err))
+		return
+	}
+
+	params := info.RequestParams
+	if params.OutputFormat == "" {
+		params.OutputFormat = s.negotiateOutputFormat(r, data)
+	}
+	if params.OutputFormat == "auto" {
+		params.AutoFormats = autoFormats(r.Header.Get("Accept"))
+	}
+	result, err := s.mediaProcessor.ProcessTransform(ctx, data, params)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to process uploaded image")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to process uploaded image")
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	if params.TargetBytes > 0 {
+		w.Header().Set("X-Achieved-Bytes", strconv.Itoa(len(result.Data)))
+	}
+	if s.config.DimensionHeaders {
+		setDimensionHeaders(w, result.ContentType, result.Width, result.Height)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(result.Data)))
+	w.Write(result.Data)
+}
+
+// readUpload reads the uploaded image from the multipart form, streaming the
+// parts instead of buffering the form in memory or temporary files
+func readUpload(r *http.Request) ([]byte, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("missing %s field", uploadField)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == uploadField {
+			defer part.Close()
+			return io.ReadAll(part)
+		}
+		part.Close()
+	}
+}
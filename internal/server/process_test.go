@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blesswinsamuel/media-proxy/internal/cache"
+	"github.com/blesswinsamuel/media-proxy/internal/loader"
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+	"github.com/blesswinsamuel/media-proxy/signature"
+)
+
+// multipartUpload encodes a multipart form with the data as the given field
+func multipartUpload(t *testing.T, field string, data []byte) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile(field, "image.png")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	part.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close multipart writer: %v", err)
+	}
+	return &body, writer.FormDataContentType()
+}
+
+func TestHandleProcessRequest(t *testing.T) {
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, MaxUploadSize: 1024}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	data := []byte("\x89PNG\r\n\x1a\nupload")
+	tests := []struct {
+		name         string
+		path         string
+		field        string
+		data         []byte
+		expectedCode int
+	}{
+		// raw returns the upload as is, without processing it
+		{"raw", signature.SignPath("secret", "process", "", url.Values{"raw": {"true"}}), "image", data, http.StatusOK},
+		{"invalid signature", signature.SignPath("other", "process", "", url.Values{"raw": {"true"}}), "image", data, http.StatusForbidden},
+		{"invalid query", signature.SignPath("secret", "process", "", url.Values{"rotate": {"abc"}}), "image", data, http.StatusBadRequest},
+		{"missing field", signature.SignPath("secret", "process", "", url.Values{"raw": {"true"}}), "file", data, http.StatusBadRequest},
+		{"too large", signature.SignPath("secret", "process", "", url.Values{"raw": {"true"}}), "image", bytes.Repeat([]byte("a"), 2048), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		body, contentType := multipartUpload(t, test.field, test.data)
+		req := httptest.NewRequest(http.MethodPost, test.path, body)
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, req)
+		if rec.Code != test.expectedCode {
+			t.Errorf("%s upload returned status %d, expected %d", test.name, rec.Code, test.expectedCode)
+		}
+		if test.expectedCode == http.StatusOK && !bytes.Equal(rec.Body.Bytes(), test.data) {
+			t.Errorf("%s upload returned %q, expected %q", test.name, rec.Body.Bytes(), test.data)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "process", "", nil), nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET request to /process returned status %d, expected %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleProcessRequestTransform(t *testing.T) {
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	body, contentType := multipartUpload(t, "image", pngFixture(t, 8, 8))
+	req := httptest.NewRequest(http.MethodPost, signature.SignPath("secret", "process", "", url.Values{"resize.width": {"4"}, "outputFormat": {"png"}}), body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload returned status %d: %s", rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("upload returned Content-Type %q, expected %q", contentType, "image/png")
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to decode the processed upload: %v", err)
+	}
+	if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 4 {
+		t.Errorf("processed upload is %v, expected it resized to 4x4", img.Bounds())
+	}
+}
+
+func TestHandleProcessRequestSlowUpload(t *testing.T) {
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	ts := httptest.NewUnstartedServer(s.srv.Handler)
+	// uploads may take longer than the read timeout of the server
+	ts.Config.ReadTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	data := []byte("\x89PNG\r\n\x1a\nupload")
+	body, contentType := multipartUpload(t, "image", data)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write(body.Next(body.Len() / 2))
+		time.Sleep(150 * time.Millisecond)
+		writer.Write(body.Bytes())
+		writer.Close()
+	}()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+signature.SignPath("secret", "process", "", url.Values{"raw": {"true"}}), reader)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("slow upload failed: %v", err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(out, data) {
+		t.Errorf("slow upload returned %d %q, expected %d %q", resp.StatusCode, out, http.StatusOK, data)
+	}
+}
@@ -3,27 +3,33 @@ package server
 import (
 	"context"
 	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/blesswinsamuel/media-proxy/internal/cache"
 	"github.com/blesswinsamuel/media-proxy/internal/loader"
 	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+	"github.com/blesswinsamuel/media-proxy/signature"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gorilla/schema"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 var (
@@ -44,19 +50,88 @@ var (
 		Name: "media_proxy_network_conns_count_total",
 		Help: "Network connections count",
 	}, []string{"state"})
+	outputSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "media_proxy_output_size_bytes",
+		Help:    "Processed output size in bytes",
+		Buckets: prometheus.ExponentialBuckets(1000, 4, 8),
+	}, []string{"content_type"})
 )
 
+var tracer = otel.Tracer("github.com/blesswinsamuel/media-proxy/internal/server")
+
 type ServerConfig struct {
-	Port         string
-	MetricsPort  string
-	Secret       string
-	EnableUnsafe bool
-	AutoAvif     bool
-	AutoWebp     bool
-	Concurrency  int
+	Port                   string
+	MetricsPort            string
+	TLSCertFile            string
+	TLSKeyFile             string
+	Secret                 string
+	SignatureAlgorithm     string
+	EnableUnsafe           bool
+	AutoAvif               bool
+	AutoWebp               bool
+	Concurrency            int
+	ForwardHeaders         []string
+	RequireSignatureExpiry bool
+	// CORSAllowedOrigins are the origins allowed to fetch media and metadata
+	// cross-origin. "*" allows all origins, and no CORS headers are sent when empty.
+	CORSAllowedOrigins []string
+	// FallbackImage is served, transformed like the requested media, when
+	// fetching or processing the media fails. Errors are responded when empty.
+	FallbackImage []byte
+	// FallbackImageStatus is the status code the fallback image is served with
+	FallbackImageStatus int
+	// Capabilities are the formats supported by libvips, reported by /capabilities
+	Capabilities mediaprocessor.Capabilities
+	// CompatMode also serves the URLs of another image proxy: imgproxy, thumbor or none
+	CompatMode string
+	// ImgproxyKey and ImgproxySalt validate the signatures of imgproxy URLs
+	ImgproxyKey  []byte
+	ImgproxySalt []byte
+	// ThumborKey validates the signatures of thumbor URLs
+	ThumborKey string
+	// RequestTimeout limits the time spent fetching and processing media for a
+	// request, responding with 504 when exceeded. 0 means no limit.
+	RequestTimeout time.Duration
+	// CacheVersion is mixed into the keys of the result and metadata caches
+	// (and the ETags), and LoaderCacheVersion into the keys of the loader
+	// cache. Changing one makes the cached entries unreachable, so that they
+	// are processed or fetched again, while the old entries expire (or can
+	// be deleted) on their own. Empty keeps the unversioned keys.
+	CacheVersion       string
+	LoaderCacheVersion string
+	// CacheKeyIgnoreParams are query params (like tracking params) that are
+	// dropped after validating the signature, so that they neither vary the
+	// cache key nor are parsed as options. A trailing * matches a prefix.
+	CacheKeyIgnoreParams []string
+	// ResponseCacheControl is the Cache-Control header of media responses,
+	// MetadataCacheControl of metadata responses, and HashCacheControl of
+	// metadata responses with a blurhash or thumbhash (which clients may
+	// expect to be fresh). The max-age directives of signed URLs with an
+	// expiry are capped at the remaining validity. No header is sent when empty.
+	ResponseCacheControl string
+	MetadataCacheControl string
+	HashCacheControl     string
+	// MaxUploadSize limits the size in bytes of the request body of uploads
+	// to /process. 0 means no limit.
+	MaxUploadSize int64
+	// NegativeCacheTTL is how long media that wasn't found upstream is
+	// remembered as missing, responding with 404 without fetching it again.
+	// Other upstream errors, which may be transient, aren't remembered. 0
+	// disables the negative cache.
+	NegativeCacheTTL time.Duration
+	// PassthroughUnsupported serves the original media, with its detected
+	// content type, when libvips can't decode it and no transform was
+	// requested, instead of responding with an error
+	PassthroughUnsupported bool
+	// DimensionHeaders sets the X-Image-Width, X-Image-Height and
+	// X-Image-Format headers of transformed images, so that clients get their
+	// size without decoding them
+	DimensionHeaders bool
 }
 
 type server struct {
+	// mu guards the config fields that can be updated while running
+	mu                 sync.RWMutex
 	mediaProcessor     *mediaprocessor.MediaProcessor
 	loader             loader.Loader
 	config             ServerConfig
@@ -65,16 +140,22 @@ type server struct {
 	loaderCache        cache.Cache
 	metadataCache      cache.Cache
 	resultCache        cache.Cache
+	negativeCache      *negativeCache
 }
 
 func NewServer(config ServerConfig, mediaProcessor *mediaprocessor.MediaProcessor, loader loader.Loader, loaderCache cache.Cache, metadataCache cache.Cache, resultCache cache.Cache) *server {
 	mux := chi.NewRouter()
+	// the request timeout should be reached before the connection is closed mid-write
+	writeTimeout := 20 * time.Second
+	if config.RequestTimeout > 0 && config.RequestTimeout+5*time.Second > writeTimeout {
+		writeTimeout = config.RequestTimeout + 5*time.Second
+	}
 	srv := &http.Server{
 		Addr:              ":" + config.Port,
 		Handler:           mux,
 		ReadTimeout:       5 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      20 * time.Second,
+		WriteTimeout:      writeTimeout,
 		IdleTimeout:       120 * time.Second,
 		ConnState: func(c net.Conn, cs http.ConnState) {
 			networkConnsTotal.WithLabelValues(cs.String()).Inc()
@@ -93,6 +174,7 @@ func NewServer(config ServerConfig, mediaProcessor *mediaprocessor.MediaProcesso
 		srv:                srv,
 		maxConnectionCount: config.Concurrency,
 		loaderCache:        loaderCache,
+		negativeCache:      newNegativeCache(config.NegativeCacheTTL),
 		metadataCache:      metadataCache,
 		resultCache:        resultCache,
 	}
@@ -103,8 +185,28 @@ func NewServer(config ServerConfig, mediaProcessor *mediaprocessor.MediaProcesso
 	}))
 	mux.Use(middleware.RequestID)
 	mux.Use(prometheusMiddleware)
-	mux.HandleFunc("/{signature}/metadata/*", s.handleMetadataRequest)
-	mux.HandleFunc("/{signature}/media/*", s.handleTransformRequest)
+	mux.Get("/capabilities", s.handleCapabilities)
+	mux.Group(func(r chi.Router) {
+		if len(config.CORSAllowedOrigins) > 0 {
+			r.Use(corsMiddleware(config.CORSAllowedOrigins))
+		}
+		if config.RequestTimeout > 0 {
+			r.Use(timeoutMiddleware(config.RequestTimeout))
+		}
+		r.HandleFunc("/{signature}/metadata/*", s.handleMetadataRequest)
+		r.HandleFunc("/{signature}/media/*", s.handleTransformRequest)
+		// the URLs of SignPath end with process/
+		r.Post("/{signature}/process", s.handleProcessRequest)
+		r.Post("/{signature}/process/", s.handleProcessRequest)
+		r.Post("/{signature}/diff", s.handleDiffRequest)
+		r.Post("/{signature}/diff/", s.handleDiffRequest)
+		switch config.CompatMode {
+		case "imgproxy":
+			r.HandleFunc("/{signature}/*", s.handleImgproxyRequest)
+		case "thumbor":
+			r.HandleFunc("/{signature}/*", s.handleThumborRequest)
+		}
+	})
 	return s
 }
 
@@ -118,10 +220,34 @@ func (w *statusWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the connection, like to extend
+// the deadlines of uploads
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (s *server) health(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleCapabilities responds with the formats supported by libvips, probed at startup
+func (s *server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.config.Capabilities)
+}
+
+// timeoutMiddleware sets a deadline on the request context, so that fetching
+// and processing media are cancelled when it's exceeded
+func timeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 func prometheusMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		activeRequests.Inc()
@@ -137,8 +263,16 @@ func prometheusMiddleware(next http.Handler) http.Handler {
 
 func (s *server) Start() {
 	go func() {
-		log.Info().Msgf("Server listening on port %s", s.srv.Addr)
-		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.config.TLSCertFile != "" {
+			// ListenAndServeTLS also enables HTTP/2
+			log.Info().Msgf("Server listening on port %s (TLS)", s.srv.Addr)
+			err = s.srv.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile)
+		} else {
+			log.Info().Msgf("Server listening on port %s", s.srv.Addr)
+			err = s.srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("")
 		}
 	}()
@@ -174,6 +308,10 @@ func (e *HTTPError) Error() string {
 	return fmt.Sprintf("%d: %s: %s", e.Code, e.Message, e.OrigError)
 }
 
+func (e *HTTPError) Unwrap() error {
+	return e.OrigError
+}
+
 func NewHTTPError(code int, message string, err error) *HTTPError {
 	return &HTTPError{
 		Code:      code,
@@ -187,12 +325,68 @@ type RequestInfo[T any] struct {
 	MediaPath        string
 	RequestParamsRaw url.Values
 	RequestParams    *T
+	UpstreamHeader   http.Header
+	// Expiry is the expiry of the signature (exp), zero when it has none
+	Expiry time.Time
+}
+
+// CacheKey returns the key of the processed result in the result/metadata caches
+func (info *RequestInfo[T]) CacheKey() string {
+	return info.MediaPath + "?" + info.RequestParamsRaw.Encode() + headerCacheKey(info.UpstreamHeader)
+}
+
+// versionedCacheKey mixes the cache version into a cache key
+func versionedCacheKey(version string, key string) string {
+	if version == "" {
+		return key
+	}
+	return "version=" + version + "#" + key
+}
+
+// headerCacheKey returns a cache key suffix for the forwarded headers, since they may vary the upstream response
+func headerCacheKey(header http.Header) string {
+	if len(header) == 0 {
+		return ""
+	}
+	return "#" + url.Values(header).Encode()
+}
+
+func (s *server) forwardedHeaders(r *http.Request) http.Header {
+	header := http.Header{}
+	for _, name := range s.config.ForwardHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return header
+}
+
+// decodeQuery decodes the query into dst. Toggle keys (like "trim") replace
+// their whole struct when decoded, so they are decoded before the rest of the
+// query to keep the struct's fields (like "trim.threshold").
+func decodeQuery(dst interface{}, query url.Values, toggleKeys ...string) error {
+	decoder := schema.NewDecoder()
+	decoder.SetAliasTag("query")
+	rest := url.Values{}
+	for key, values := range query {
+		rest[key] = values
+	}
+	for _, key := range toggleKeys {
+		if values, ok := rest[key]; ok {
+			if err := decoder.Decode(dst, url.Values{key: values}); err != nil {
+				return err
+			}
+			delete(rest, key)
+		}
+	}
+	return decoder.Decode(dst, rest)
 }
 
 func getRequestInfo[T any](s *server, r *http.Request, requestType string, parseQuery func(query url.Values) (*T, error)) (*RequestInfo[T], error) {
 	// validate signature
 	signature := chi.URLParam(r, "signature")
 	mediaPath := chi.URLParam(r, "*")
+	query := r.URL.Query()
 
 	if !s.config.EnableUnsafe {
 		mp := requestType + "/" + mediaPath
@@ -202,33 +396,289 @@ func getRequestInfo[T any](s *server, r *http.Request, requestType string, parse
 		if !s.validateSignature(signature, mp) {
 			return nil, NewHTTPError(http.StatusForbidden, "Invalid signature", nil)
 		}
+		// the signature covers exp, so it can't be changed
+		if err := checkSignatureExpiry(query.Get("exp"), s.config.RequireSignatureExpiry, time.Now()); err != nil {
+			return nil, NewHTTPError(http.StatusForbidden, "Invalid signature", err)
+		}
+	}
+	// exp isn't a request parameter, and shouldn't vary the cache key
+	var expiry time.Time
+	if exp, err := strconv.ParseInt(query.Get("exp"), 10, 64); err == nil {
+		expiry = time.Unix(exp, 0)
+	}
+	query.Del("exp")
+	// neither are the ignored params, like tracking params
+	for key := range query {
+		if ignoredParam(s.config.CacheKeyIgnoreParams, key) {
+			query.Del(key)
+		}
 	}
 
 	mediaPath = strings.TrimSuffix(mediaPath, "/")
 
 	// parse query
-	requestParams, err := parseQuery(r.URL.Query())
+	requestParams, err := parseQuery(query)
 	if err != nil {
-		return nil, NewHTTPError(http.StatusBadRequest, "Failed to parse query", err)
+		// the decode errors name the invalid parameter, so they are responded
+		return nil, NewHTTPError(http.StatusBadRequest, "Failed to parse query: "+err.Error(), err)
 	}
 
 	return &RequestInfo[T]{
 		Signature:        signature,
 		MediaPath:        mediaPath,
 		RequestParams:    requestParams,
-		RequestParamsRaw: r.URL.Query(),
+		RequestParamsRaw: query,
+		UpstreamHeader:   s.forwardedHeaders(r),
+		Expiry:           expiry,
 	}, nil
 }
 
-func (s *server) getOriginalImage(ctx context.Context, mediaPath string) ([]byte, error) {
-	// Perform the request to the target server
-	imageBytes, err := cache.GetCachedOrFetch(s.loaderCache, mediaPath, func() ([]byte, error) {
-		return s.loader.GetMedia(ctx, mediaPath)
+// ignoredParam reports whether a query param matches one of the ignored
+// params, which end with * to match a prefix (like utm_*)
+func ignoredParam(ignoredParams []string, key string) bool {
+	for _, ignored := range ignoredParams {
+		if key == ignored {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(ignored, "*"); ok && strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignatureExpiry checks the expiry (in unix seconds) of a signed URL
+func checkSignatureExpiry(exp string, required bool, now time.Time) error {
+	if exp == "" {
+		if required {
+			return errors.New("signature expiry is required")
+		}
+		return nil
+	}
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid exp parameter: %q", exp)
+	}
+	if now.Unix() > expiry {
+		return errors.New("signature expired")
+	}
+	return nil
+}
+
+// requestContext returns the request's context, continuing the trace of the caller
+func requestContext(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+func (s *server) getOriginalImage(ctx context.Context, mediaPath string, header http.Header) (*loader.Media, error) {
+	ctx, span := tracer.Start(ctx, "getOriginalImage")
+	defer span.End()
+	// the client's conditional headers (when forwarded) are about the client's
+	// copy, which the upstream would answer with a bodyless 304
+	header = withoutConditionalHeaders(header)
+	// Perform the request to the target server. The cache entries hold the
+	// upstream metadata too, so the key is prefixed to not read entries cached
+	// without it. Concurrent requests for the same media (like distinct
+	// transforms of it on a cold cache) share a single upstream fetch.
+	key := versionedCacheKey(s.config.LoaderCacheVersion, "original:"+mediaPath+headerCacheKey(header))
+	if err := s.negativeCache.get(key); err != nil {
+		log.Debug().Str("mediaPath", mediaPath).Msg("Upstream media recently not found, skipping the fetch")
+		return nil, NewHTTPError(http.StatusInternalServerError, "Failed to fetch image", err)
+	}
+	out, loaderCache, err := cache.GetCachedOrRevalidate(ctx, s.loaderCache, "loader", key, func(ctx context.Context, stale []byte) ([]byte, error) {
+		// revalidate expired entries with a conditional request, reusing them when unchanged
+		var staleMedia *loader.Media
+		requestHeader := header
+		if stale != nil {
+			if staleMedia, _ = decodeOriginal(stale); staleMedia != nil {
+				requestHeader = conditionalHeader(header, staleMedia)
+			}
+		}
+		media, err := s.loader.GetMedia(ctx, mediaPath, requestHeader)
+		if errors.Is(err, loader.ErrNotModified) && staleMedia != nil {
+			log.Debug().Str("mediaPath", mediaPath).Msg("Upstream media not modified, reusing the cached media")
+			return stale, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return encodeOriginal(media)
 	})
 	if err != nil {
+		if errors.Is(err, loader.ErrUpstreamNotFound) {
+			s.negativeCache.put(key, err)
+		}
 		return nil, NewHTTPError(http.StatusInternalServerError, "Failed to fetch image", err)
 	}
-	return imageBytes, nil
+	media, err := decodeOriginal(out)
+	if err != nil {
+		return nil, NewHTTPError(http.StatusInternalServerError, "Failed to fetch image", err)
+	}
+	// the request's logger, with its method and URL
+	zerolog.Ctx(ctx).Debug().Str("mediaPath", mediaPath).Str("loaderCache", string(loaderCache)).Str("contentType", media.ContentType).Msg("Loaded original media")
+	return media, nil
+}
+
+// originalMetadata is the upstream metadata stored with the original media in the loader cache
+type originalMetadata struct {
+	ContentType  string `json:"contentType,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// encodeOriginal encodes the original media and its metadata into a loader cache entry
+func encodeOriginal(media *loader.Media) ([]byte, error) {
+	metadata, err := json.Marshal(originalMetadata{ContentType: media.ContentType, ETag: media.ETag, LastModified: media.LastModified})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode media metadata: %w", err)
+	}
+	return concatenateContentTypeAndData(string(metadata), media.Data), nil
+}
+
+// decodeOriginal decodes a loader cache entry encoded by encodeOriginal
+func decodeOriginal(entry []byte) (*loader.Media, error) {
+	encodedMetadata, data := getContentTypeAndData(entry)
+	var metadata originalMetadata
+	if err := json.Unmarshal([]byte(encodedMetadata), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode media metadata: %w", err)
+	}
+	return &loader.Media{Data: data, ContentType: metadata.ContentType, ETag: metadata.ETag, LastModified: metadata.LastModified}, nil
+}
+
+// conditionalHeaderNames are the request headers that make the upstream response conditional
+var conditionalHeaderNames = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+
+// withoutConditionalHeaders returns the header without its conditional headers
+func withoutConditionalHeaders(header http.Header) http.Header {
+	for _, name := range conditionalHeaderNames {
+		if _, ok := header[name]; ok {
+			header = header.Clone()
+			for _, name := range conditionalHeaderNames {
+				header.Del(name)
+			}
+			return header
+		}
+	}
+	return header
+}
+
+// conditionalHeader returns the upstream request header to revalidate media with
+func conditionalHeader(header http.Header, media *loader.Media) http.Header {
+	conditional := header.Clone()
+	if conditional == nil {
+		conditional = http.Header{}
+	}
+	if media.ETag != "" {
+		conditional.Set("If-None-Match", media.ETag)
+	}
+	if media.LastModified != "" {
+		conditional.Set("If-Modified-Since", media.LastModified)
+	}
+	return conditional
+}
+
+// statusClientClosedRequest is the non-standard status code (from nginx) of
+// requests whose client disconnected before the response was sent
+const statusClientClosedRequest = 499
+
+// errorStatusCode returns the response status code for an error that occurred while fetching or processing media
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	case errors.Is(err, loader.ErrUpstreamNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, loader.ErrUpstreamBadStatus):
+		return http.StatusBadGateway
+	case errors.Is(err, loader.ErrUpstreamNotAllowed), errors.Is(err, loader.ErrInvalidDataURI):
+		return http.StatusBadRequest
+	case errors.Is(err, mediaprocessor.ErrInvalidOption), errors.Is(err, mediaprocessor.ErrInvalidImage):
+		return http.StatusBadRequest
+	case errors.Is(err, mediaprocessor.ErrUnsupportedInputFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, mediaprocessor.ErrImageTooLarge):
+		return http.StatusUnprocessableEntity
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError responds with the status code of err. HTTPErrors are responded
+// with their message, so that the details of the underlying error aren't sent.
+func writeError(w http.ResponseWriter, err error) {
+	message := err.Error()
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		message = httpErr.Message
+	}
+	http.Error(w, message, errorStatusCode(err))
+}
+
+// cacheControl returns the Cache-Control header value of a response, capping
+// the max-age and s-maxage directives at the time until expiry (when not zero)
+func cacheControl(directives string, expiry time.Time, now time.Time) string {
+	if directives == "" || expiry.IsZero() {
+		return directives
+	}
+	remaining := int64(expiry.Sub(now).Seconds())
+	if remaining < 0 {
+		remaining = 0
+	}
+	parts := strings.Split(directives, ",")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		name, value, found := strings.Cut(part, "=")
+		if found && (strings.EqualFold(name, "max-age") || strings.EqualFold(name, "s-maxage")) {
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > remaining {
+				part = name + "=" + strconv.FormatInt(remaining, 10)
+			}
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setCacheControl sets the Cache-Control header of a media or metadata response
+// to the directives
+func (s *server) setCacheControl(w http.ResponseWriter, directives string, expiry time.Time) {
+	if value := cacheControl(directives, expiry, time.Now()); value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// etag returns a strong ETag for the response of a result cache key. The content
+// type is included since the output format may be negotiated from the Accept header.
+func etag(cacheKey string, contentType string) string {
+	return `"` + cache.Sha256Hash(cacheKey+"#"+contentType) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches the ETag, using
+// the weak comparison required for If-None-Match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the ETag header and responds with 304 Not Modified
+// when the request's If-None-Match matches it. It reports whether the
+// response has been written.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
 }
 
 func concatenateContentTypeAndData(contentType string, data []byte) []byte {
@@ -246,11 +696,20 @@ func getContentTypeAndData(concatenatedBytes []byte) (string, []byte) {
 	return contentType, data
 }
 
-func (s *server) validateSignature(signature string, imagePath string) bool {
-	hash := hmac.New(sha1.New, []byte(s.config.Secret))
-	hash.Write([]byte(imagePath))
-	expectedHash := base64.URLEncoding.EncodeToString(hash.Sum(nil))
+// UpdateSignatureConfig replaces the secret and algorithm signatures are validated with
+func (s *server) UpdateSignatureConfig(secret string, algorithm string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Secret = secret
+	s.config.SignatureAlgorithm = algorithm
+}
+
+func (s *server) validateSignature(sig string, imagePath string) bool {
+	s.mu.RLock()
+	algorithm, secret := s.config.SignatureAlgorithm, s.config.Secret
+	s.mu.RUnlock()
+	expectedHash := signature.Sign(algorithm, secret, imagePath)
 	// expectedHash = expectedHash[:40]
 	// log.Debug().Msgf("expected hash (%s): %s", imagePath, expectedHash)
-	return expectedHash == signature
+	return hmac.Equal([]byte(expectedHash), []byte(sig))
 }
@@ -2,7 +2,33 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/blesswinsamuel/media-proxy/internal/cache"
+	"github.com/blesswinsamuel/media-proxy/internal/loader"
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+	"github.com/blesswinsamuel/media-proxy/signature"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
 )
 
 func TestConcatenateContentTypeAndData(t *testing.T) {
@@ -39,3 +65,1058 @@ func TestGetContentTypeAndData(t *testing.T) {
 		t.Errorf("getContentTypeAndData(%q) returned data %q, expected %q", concatenatedBytes, data, expectedData)
 	}
 }
+
+func TestErrorStatusCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{fmt.Errorf("failed to fetch from upstream: %w", NewHTTPError(http.StatusInternalServerError, "Failed to fetch image", loader.ErrUpstreamNotFound)), http.StatusNotFound},
+		{fmt.Errorf("failed to fetch from upstream: %w", NewHTTPError(http.StatusInternalServerError, "Failed to fetch image", loader.ErrUpstreamBadStatus)), http.StatusBadGateway},
+		{fmt.Errorf("failed to fetch from upstream: %w", NewHTTPError(http.StatusInternalServerError, "Failed to fetch image", loader.ErrUpstreamNotAllowed)), http.StatusBadRequest},
+		{fmt.Errorf("failed to fetch from upstream: %w", fmt.Errorf("%w: invalid rotate parameter", mediaprocessor.ErrInvalidOption)), http.StatusBadRequest},
+		{fmt.Errorf("%w: invalid image dimensions 0x0", mediaprocessor.ErrInvalidImage), http.StatusBadRequest},
+		{fmt.Errorf("%w: unknown (detected content type text/html; charset=utf-8)", mediaprocessor.ErrUnsupportedInputFormat), http.StatusUnsupportedMediaType},
+		{fmt.Errorf("%w: 16.0 megapixels (4000x4000, 1 pages) exceed the limit of 10", mediaprocessor.ErrImageTooLarge), http.StatusUnprocessableEntity},
+		{NewHTTPError(http.StatusForbidden, "Invalid signature", errors.New("signature expired")), http.StatusForbidden},
+		{NewHTTPError(http.StatusInternalServerError, "Failed to fetch image", fmt.Errorf("failed to fetch image: %w", context.DeadlineExceeded)), http.StatusGatewayTimeout},
+		{fmt.Errorf("failed to process image: %w", context.Canceled), statusClientClosedRequest},
+		{errors.New("failed to load image"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if code := errorStatusCode(test.err); code != test.expected {
+			t.Errorf("errorStatusCode(%q) = %d, expected %d", test.err, code, test.expected)
+		}
+	}
+}
+
+func TestParseTransformQueryTrim(t *testing.T) {
+	// trim is decoded before trim.threshold, so the threshold is kept whatever
+	// the order of the query map
+	opts, err := parseTransformQuery(url.Values{"trim": {"true"}, "trim.threshold": {"25"}, "rotate": {"90"}})
+	if err != nil {
+		t.Fatalf("parseTransformQuery returned error: %v", err)
+	}
+	if opts.Trim == nil || !opts.Trim.Enabled || opts.Trim.Threshold != 25 {
+		t.Errorf("parseTransformQuery returned trim %+v, expected enabled with threshold 25", opts.Trim)
+	}
+	if opts.Rotate != 90 {
+		t.Errorf("parseTransformQuery returned rotate %d, expected 90", opts.Rotate)
+	}
+}
+
+func TestParseTransformQueryStrip(t *testing.T) {
+	opts, err := parseTransformQuery(url.Values{})
+	if err != nil {
+		t.Fatalf("parseTransformQuery returned error: %v", err)
+	}
+	if !opts.StripMetadata {
+		t.Errorf("parseTransformQuery returned strip %v by default, expected true", opts.StripMetadata)
+	}
+	opts, err = parseTransformQuery(url.Values{"strip": {"false"}})
+	if err != nil {
+		t.Fatalf("parseTransformQuery returned error: %v", err)
+	}
+	if opts.StripMetadata {
+		t.Errorf("parseTransformQuery(strip=false) returned strip %v, expected false", opts.StripMetadata)
+	}
+}
+
+func TestNegotiateOutputFormat(t *testing.T) {
+	const (
+		chrome  = "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+		firefox = "image/avif,image/webp,*/*"
+		safari  = "image/webp,image/avif,image/jxl,image/heic,image/heic-sequence,video/*;q=0.8,image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5"
+		edge    = "image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	)
+	tests := []struct {
+		accept      string
+		contentType string
+		autoAvif    bool
+		autoWebp    bool
+		expected    string
+	}{
+		{chrome, "image/jpeg", true, true, "avif"},
+		{chrome, "image/jpeg", false, true, "webp"},
+		{chrome, "image/jpeg", false, false, "jpeg"},
+		{firefox, "image/png", true, true, "avif"},
+		{safari, "image/jpeg", true, true, "avif"},
+		{safari, "image/png", false, false, "png"},
+		{edge, "image/jpeg", true, true, "webp"},
+		{"image/webp;q=0.8,image/png", "image/png", true, true, "png"},
+		{"image/webp;q=0.8,image/png", "image/jpeg", true, true, "webp"},
+		{"*/*", "image/gif", true, true, "gif"},
+		{"image/avif;q=0,image/webp;q=0.5,image/*", "image/jpeg", true, true, "jpeg"},
+		{"image/avif;q=0,image/webp,image/*", "image/jpeg", true, true, "webp"},
+		{"image/*;q=0.5,image/jpeg", "image/jpeg", true, true, "jpeg"},
+		{"image/webp;q=nope", "image/jpeg", true, true, "jpeg"},
+		{"text/html", "image/png", true, true, "png"},
+		{"", "image/svg+xml", true, true, "png"},
+	}
+	for _, test := range tests {
+		if format := negotiateOutputFormat(test.accept, test.contentType, test.autoAvif, test.autoWebp); format != test.expected {
+			t.Errorf("negotiateOutputFormat(%q, %q, %v, %v) = %q, expected %q", test.accept, test.contentType, test.autoAvif, test.autoWebp, format, test.expected)
+		}
+	}
+}
+
+func TestServerNegotiateOutputFormatAllowList(t *testing.T) {
+	pngData := []byte("\x89PNG\r\n\x1a\n")
+	tests := []struct {
+		allowed  []string
+		accept   string
+		data     []byte
+		expected string
+	}{
+		// the source format and the png fallback are replaced by the first allowed format
+		{[]string{"jpeg", "webp"}, "image/*", pngData, "jpeg"},
+		{[]string{"webp", "jpeg"}, "", []byte("<svg></svg>"), "webp"},
+		{[]string{"png", "avif"}, "image/avif", pngData, "avif"},
+		{[]string{"png"}, "image/avif,image/webp", pngData, "png"},
+		{nil, "image/*", pngData, "png"},
+	}
+	for _, test := range tests {
+		mp := mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{AllowedOutputFormats: test.allowed})
+		s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, AutoAvif: true, AutoWebp: true}, mp, loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", test.accept)
+		if format := s.negotiateOutputFormat(r, test.data); format != test.expected {
+			t.Errorf("negotiateOutputFormat with allowed formats %v and Accept %q = %q, expected %q", test.allowed, test.accept, format, test.expected)
+		}
+	}
+}
+
+func TestAutoFormats(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected []string
+	}{
+		{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", []string{"avif", "webp"}},
+		{"image/webp,*/*", []string{"webp"}},
+		{"image/avif;q=0,image/webp;q=0.5", []string{"webp"}},
+		{"image/*,*/*", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if formats := autoFormats(test.accept); !reflect.DeepEqual(formats, test.expected) {
+			t.Errorf("autoFormats(%q) = %v, expected %v", test.accept, formats, test.expected)
+		}
+	}
+}
+
+func TestParseMetadataQueryBlurHash(t *testing.T) {
+	tests := []struct {
+		query     url.Values
+		expectedX int
+		expectedY int
+		valid     bool
+	}{
+		{url.Values{"blurhash": {"true"}}, 0, 0, true},
+		{url.Values{"blurhash": {"true"}, "blurhash.x": {"3"}, "blurhash.y": {"9"}}, 3, 9, true},
+		{url.Values{"blurhash": {"true"}, "blurhash.x": {"10"}}, 10, 0, false},
+		{url.Values{"blurhash": {"true"}, "blurhash.y": {"-1"}}, 0, -1, false},
+	}
+	for _, test := range tests {
+		opts, err := parseMetadataQuery(test.query)
+		if err != nil {
+			t.Fatalf("parseMetadataQuery(%v) returned error: %v", test.query, err)
+		}
+		if opts.BlurHash == nil || !opts.BlurHash.Enabled || opts.BlurHash.X != test.expectedX || opts.BlurHash.Y != test.expectedY {
+			t.Errorf("parseMetadataQuery(%v) returned blurhash %+v, expected %dx%d", test.query, opts.BlurHash, test.expectedX, test.expectedY)
+		}
+		if err := opts.Validate(); (err == nil) != test.valid || (err != nil && errorStatusCode(err) != http.StatusBadRequest) {
+			t.Errorf("Validate of %v returned error %v, expected valid: %v", test.query, err, test.valid)
+		}
+	}
+}
+
+func TestCheckSignatureExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		exp      string
+		required bool
+		valid    bool
+	}{
+		{"", false, true},
+		{"", true, false},
+		{"1700000001", true, true},
+		{"1700000000", false, true},
+		{"1699999999", false, false},
+		{"tomorrow", false, false},
+	}
+	for _, test := range tests {
+		if err := checkSignatureExpiry(test.exp, test.required, now); (err == nil) != test.valid {
+			t.Errorf("checkSignatureExpiry(%q, %v) returned error %v, expected valid: %v", test.exp, test.required, err, test.valid)
+		}
+	}
+}
+
+func TestValidateSignature(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		signature string
+	}{
+		// echo -n "media/image.jpg?rotate=90" | openssl dgst -sha1 -hmac secret -binary | base64 | tr '+/' '-_'
+		{"", "YuYRt0tocVmtzJomQKJCA_Wa-u4="},
+		{"sha1", "YuYRt0tocVmtzJomQKJCA_Wa-u4="},
+		// echo -n "media/image.jpg?rotate=90" | openssl dgst -sha256 -hmac secret -binary | base64 | tr '+/' '-_'
+		{"sha256", "Owru0cRFyqTfKatpgKdBk7j0Kx0Ks3fSlOOkbl5doCI="},
+	}
+	for _, test := range tests {
+		s := &server{config: ServerConfig{Secret: "secret", SignatureAlgorithm: test.algorithm}}
+		if !s.validateSignature(test.signature, "media/image.jpg?rotate=90") {
+			t.Errorf("validateSignature with algorithm %q rejected a valid signature", test.algorithm)
+		}
+		if s.validateSignature(test.signature, "media/image.jpg?rotate=180") {
+			t.Errorf("validateSignature with algorithm %q accepted a signature for another path", test.algorithm)
+		}
+	}
+}
+
+func TestGetRequestInfoSignedPath(t *testing.T) {
+	s := &server{config: ServerConfig{Secret: "secret"}}
+	paths := []string{
+		signature.SignPath("secret", "media", "dir/image.jpg", url.Values{"rotate": {"90"}, "resize.width": {"100"}}),
+		signature.SignPath("secret", "media", "dir/image.jpg/", nil),
+		signature.SignPath("secret", "media", "dir/image.jpg", url.Values{"rotate": {"90"}}) + "0",
+	}
+	expectedCodes := []int{http.StatusOK, http.StatusOK, http.StatusForbidden}
+	for i, path := range paths {
+		mux := chi.NewRouter()
+		mux.HandleFunc("/{signature}/media/*", func(w http.ResponseWriter, r *http.Request) {
+			info, err := getRequestInfo(s, r, "media", parseTransformQuery)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatusCode(err))
+				return
+			}
+			if info.MediaPath != "dir/image.jpg" {
+				t.Errorf("getRequestInfo(%q) returned media path %q", path, info.MediaPath)
+			}
+		})
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != expectedCodes[i] {
+			t.Errorf("request to %q returned status %d, expected %d", path, rec.Code, expectedCodes[i])
+		}
+	}
+}
+
+// sourceOutputFormatsKey is the cache key suffix of results whose output
+// format is negotiated without an Accept header, keeping the source format
+const sourceOutputFormatsKey = "#outputFormats=avif,gif,jpeg,png,webp"
+
+func TestCacheKeyIgnoreParams(t *testing.T) {
+	resultCache := cache.NewMemoryCache(1000)
+	resultCache.Put(cache.Sha256Hash("image.png?rotate=90"+sourceOutputFormatsKey), concatenateContentTypeAndData("image/png", []byte("cached")))
+	// the loader has no media, so only cached results can be served
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, CacheKeyIgnoreParams: []string{"utm_*", "ref"}}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), resultCache)
+	tests := []struct {
+		query        url.Values
+		expectedCode int
+	}{
+		{url.Values{"rotate": {"90"}}, http.StatusOK},
+		{url.Values{"rotate": {"90"}, "utm_source": {"newsletter"}}, http.StatusOK},
+		{url.Values{"rotate": {"90"}, "utm_campaign": {"launch"}, "ref": {"home"}}, http.StatusOK},
+		{url.Values{"rotate": {"90"}, "referrer": {"home"}}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", "image.png", test.query), nil))
+		if rec.Code != test.expectedCode {
+			t.Errorf("request with %v returned status %d, expected %d", test.query, rec.Code, test.expectedCode)
+		}
+		if test.expectedCode == http.StatusOK && rec.Body.String() != "cached" {
+			t.Errorf("request with %v returned %q, expected the cached result", test.query, rec.Body.String())
+		}
+	}
+
+	// the ignored params are still covered by the signature
+	path := signature.SignPath("secret", "media", "image.png", url.Values{"rotate": {"90"}}) + "&utm_source=newsletter"
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("request with an unsigned ignored param returned status %d, expected %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestUpdateSignatureConfig(t *testing.T) {
+	s := &server{config: ServerConfig{Secret: "old", SignatureAlgorithm: "sha1"}}
+	sig := signature.Sign("sha256", "new", "media/image.jpg")
+	if s.validateSignature(sig, "media/image.jpg") {
+		t.Fatalf("validateSignature accepted a signature of the new secret before the update")
+	}
+	s.UpdateSignatureConfig("new", "sha256")
+	if !s.validateSignature(sig, "media/image.jpg") {
+		t.Errorf("validateSignature rejected a signature of the new secret after the update")
+	}
+}
+
+func TestETag(t *testing.T) {
+	tag := etag("image.jpg?rotate=90", "image/webp")
+	if tag != etag("image.jpg?rotate=90", "image/webp") {
+		t.Errorf("etag is not stable")
+	}
+	if tag == etag("image.jpg?rotate=180", "image/webp") || tag == etag("image.jpg?rotate=90", "image/avif") {
+		t.Errorf("etag doesn't vary with the cache key and content type")
+	}
+	tests := []struct {
+		ifNoneMatch string
+		matches     bool
+	}{
+		{"", false},
+		{tag, true},
+		{"W/" + tag, true},
+		{`"other", ` + tag, true},
+		{"*", true},
+		{`"other"`, false},
+	}
+	for _, test := range tests {
+		if matches := etagMatches(test.ifNoneMatch, tag); matches != test.matches {
+			t.Errorf("etagMatches(%q) = %v, expected %v", test.ifNoneMatch, matches, test.matches)
+		}
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	tag := etag("image.jpg", "image/png")
+	for _, ifNoneMatch := range []string{"", tag} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		written := checkNotModified(rec, r, tag)
+		if rec.Header().Get("ETag") != tag {
+			t.Errorf("checkNotModified set ETag %q, expected %q", rec.Header().Get("ETag"), tag)
+		}
+		if expected := ifNoneMatch != ""; written != expected || (written && rec.Code != http.StatusNotModified) {
+			t.Errorf("checkNotModified with If-None-Match %q returned %v with status %d", ifNoneMatch, written, rec.Code)
+		}
+	}
+}
+
+func TestParseTransformQueryResizePercent(t *testing.T) {
+	tests := []struct {
+		query                 url.Values
+		expectedWidth         int
+		expectedWidthPercent  float64
+		expectedHeightPercent float64
+		valid                 bool
+	}{
+		{url.Values{"resize.width": {"50%"}}, 0, 50, 0, true},
+		{url.Values{"resize.width": {"100"}, "resize.height": {"12.5%"}}, 100, 0, 12.5, true},
+		{url.Values{"resize.width": {"0%"}}, 0, 0, 0, false},
+		{url.Values{"resize.width": {"-5%"}}, 0, 0, 0, false},
+		{url.Values{"resize.height": {"half%"}}, 0, 0, 0, false},
+	}
+	for _, test := range tests {
+		opts, err := parseTransformQuery(test.query)
+		if !test.valid {
+			if errorStatusCode(err) != http.StatusBadRequest {
+				t.Errorf("parseTransformQuery(%v) returned error %v, expected a bad request", test.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseTransformQuery(%v) returned error: %v", test.query, err)
+		}
+		if r := opts.Resize; r == nil || r.Width != test.expectedWidth || r.WidthPercent != test.expectedWidthPercent || r.HeightPercent != test.expectedHeightPercent {
+			t.Errorf("parseTransformQuery(%v) returned resize %+v", test.query, opts.Resize)
+		}
+	}
+}
+
+func TestParseTransformQuerySize(t *testing.T) {
+	tests := []struct {
+		query          url.Values
+		expectedWidth  int
+		expectedHeight int
+		valid          bool
+	}{
+		{url.Values{"size": {"300x200"}}, 300, 200, true},
+		{url.Values{"size": {"300x"}}, 300, 0, true},
+		{url.Values{"size": {"x200"}}, 0, 200, true},
+		{url.Values{"size": {"300x200"}, "resize.width": {"100"}}, 100, 200, true},
+		{url.Values{"size": {"300x200"}, "resize.height": {"50%"}}, 300, 0, true},
+		{url.Values{"size": {"x"}}, 0, 0, false},
+		{url.Values{"size": {"300"}}, 0, 0, false},
+		{url.Values{"size": {""}}, 0, 0, false},
+		{url.Values{"size": {"0x200"}}, 0, 0, false},
+		{url.Values{"size": {"-300x200"}}, 0, 0, false},
+		{url.Values{"size": {"300x200x100"}}, 0, 0, false},
+		{url.Values{"size": {"wide"}}, 0, 0, false},
+	}
+	for _, test := range tests {
+		opts, err := parseTransformQuery(test.query)
+		if !test.valid {
+			if errorStatusCode(err) != http.StatusBadRequest {
+				t.Errorf("parseTransformQuery(%v) returned error %v, expected a bad request", test.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseTransformQuery(%v) returned error: %v", test.query, err)
+		}
+		if r := opts.Resize; r == nil || r.Width != test.expectedWidth || r.Height != test.expectedHeight {
+			t.Errorf("parseTransformQuery(%v) returned resize %+v, expected %dx%d", test.query, opts.Resize, test.expectedWidth, test.expectedHeight)
+		}
+	}
+
+	query := url.Values{"size": {"300x200"}}
+	if _, err := parseTransformQuery(query); err != nil || query.Get("size") != "300x200" {
+		t.Errorf("parseTransformQuery(%v) returned error %v, or modified the query", query, err)
+	}
+}
+
+func TestHandleTransformRequestRawStreamsOriginal(t *testing.T) {
+	root := t.TempDir()
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`)
+	if err := os.WriteFile(filepath.Join(root, "logo.svg"), svg, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	s := NewServer(ServerConfig{EnableUnsafe: true, Concurrency: 1}, nil, loader.NewFileLoader(root), nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/media/logo.svg?raw=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("raw request returned status %d, expected %d", rec.Code, http.StatusOK)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), svg) {
+		t.Errorf("raw request returned body %q, expected %q", rec.Body.Bytes(), svg)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "image/svg+xml" {
+		t.Errorf("raw request returned Content-Type %q, expected %q", contentType, "image/svg+xml")
+	}
+	if contentLength := rec.Header().Get("Content-Length"); contentLength != strconv.Itoa(len(svg)) {
+		t.Errorf("raw request returned Content-Length %q, expected %d", contentLength, len(svg))
+	}
+
+	rec = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/media/missing.svg?raw=true", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("raw request for missing media returned status %d, expected %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleTransformRequestPassthroughUnsupported(t *testing.T) {
+	root := t.TempDir()
+	video := []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+	if err := os.WriteFile(filepath.Join(root, "clip.mp4"), video, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "page.html"), []byte("<html><script>alert(1)</script></html>"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	newServer := func(passthrough bool, allowedOutputFormats ...string) *server {
+		mp := mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{AllowedOutputFormats: allowedOutputFormats})
+		return NewServer(ServerConfig{EnableUnsafe: true, Concurrency: 1, PassthroughUnsupported: passthrough}, mp, loader.NewFileLoader(root), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	}
+
+	// the output format negotiated for the video must not be rejected first
+	for _, s := range []*server{newServer(true), newServer(true, "webp")} {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/media/clip.mp4", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request without options returned status %d, expected %d", rec.Code, http.StatusOK)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), video) {
+			t.Errorf("request without options returned body %q, expected the original %q", rec.Body.Bytes(), video)
+		}
+		if contentType := rec.Header().Get("Content-Type"); contentType != "video/mp4" {
+			t.Errorf("request without options returned Content-Type %q, expected %q", contentType, "video/mp4")
+		}
+	}
+
+	tests := []struct {
+		passthrough bool
+		path        string
+	}{
+		{true, "/_/media/clip.mp4?resize.width=100"},
+		{true, "/_/media/clip.mp4?outputFormat=png"},
+		{false, "/_/media/clip.mp4"},
+		// text isn't passed through
+		{true, "/_/media/page.html"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		newServer(test.passthrough).srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s with passthrough=%v returned status %d, expected %d", test.path, test.passthrough, rec.Code, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestHandleTransformRequestValidate(t *testing.T) {
+	mp := mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{MaxOutputWidth: 1000, AllowedOutputFormats: []string{"webp", "jpeg"}})
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1}, mp, loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	tests := []struct {
+		query         url.Values
+		expectedCode  int
+		expectedError string
+	}{
+		{url.Values{"validate": {"true"}, "resize.width": {"300"}, "outputFormat": {"webp"}}, http.StatusOK, ""},
+		{url.Values{"validate": {"true"}, "resize.width": {"2000"}}, http.StatusBadRequest, "resize width 2000 exceeds the max output width 1000"},
+		{url.Values{"validate": {"true"}, "outputFormat": {"png"}}, http.StatusBadRequest, `output format "png" is not allowed`},
+		{url.Values{"validate": {"true"}, "outputFormat": {"tiff"}}, http.StatusBadRequest, `invalid outputFormat parameter: "tiff"`},
+		{url.Values{"validate": {"true"}, "quality": {"101"}}, http.StatusBadRequest, "invalid quality parameter: 101"},
+		{url.Values{"validate": {"true"}, "rotate": {"abc"}}, http.StatusBadRequest, "rotate"},
+		{url.Values{"validate": {"true"}, "resize.width": {"300"}, "resize.crop": {"middle"}}, http.StatusBadRequest, "invalid resize.crop parameter"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		// the media doesn't exist, so it must not be fetched
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", "missing.jpg", test.query), nil))
+		if rec.Code != test.expectedCode {
+			t.Errorf("validate request with %v returned status %d, expected %d", test.query, rec.Code, test.expectedCode)
+		}
+		var response validationResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("validate request with %v returned invalid JSON: %v", test.query, err)
+		}
+		if response.Valid != (test.expectedError == "") || !strings.Contains(response.Error, test.expectedError) {
+			t.Errorf("validate request with %v returned %+v, expected error %q", test.query, response, test.expectedError)
+		}
+		if test.expectedError == "" && (response.Options == nil || response.Options.Resize.Width != 300 || response.Options.Dpr != 1) {
+			t.Errorf("validate request with %v returned options %+v, expected the normalized options", test.query, response.Options)
+		}
+	}
+}
+
+func TestHandlerErrorResponses(t *testing.T) {
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		path            string
+		expectedCode    int
+		expectedMessage string
+	}{
+		{signature.SignPath("secret", "media", "image.jpg", url.Values{"rotate": {"90"}}) + "0", http.StatusForbidden, "Invalid signature"},
+		{signature.SignPath("other", "metadata", "image.jpg", nil), http.StatusForbidden, "Invalid signature"},
+		{signature.SignPath("secret", "media", "image.jpg", url.Values{"exp": {expired}}), http.StatusForbidden, "Invalid signature"},
+		{signature.SignPath("secret", "media", "image.jpg", url.Values{"rotate": {"abc"}}), http.StatusBadRequest, `Failed to parse query: schema: error converting value for "rotate"`},
+		{signature.SignPath("secret", "media", "image.jpg", url.Values{"resize.width": {"1.5"}}), http.StatusBadRequest, `Failed to parse query: schema: error converting value for "resize.width"`},
+		{signature.SignPath("secret", "media", "image.jpg", url.Values{"flipH": {"maybe"}}), http.StatusBadRequest, `Failed to parse query: schema: error converting value for "flipH"`},
+		{signature.SignPath("secret", "media", "image.jpg", url.Values{"unknown": {"1"}}), http.StatusBadRequest, `Failed to parse query: schema: invalid path "unknown"`},
+		{signature.SignPath("secret", "metadata", "image.jpg", url.Values{"exif": {"abc"}}), http.StatusBadRequest, `Failed to parse query: schema: error converting value for "exif". Details: invalid option: invalid exif parameter: "abc"`},
+		{signature.SignPath("secret", "metadata", "image.jpg", url.Values{"thumbhash": {"yes"}}), http.StatusBadRequest, `Failed to parse query: schema: error converting value for "thumbhash"`},
+		{signature.SignPath("secret", "metadata", "image.jpg", url.Values{"palette": {"many"}}), http.StatusBadRequest, `Failed to parse query: schema: error converting value for "palette"`},
+		{signature.SignPath("secret", "media", "missing.jpg", nil), http.StatusNotFound, "Failed to fetch image"},
+		{signature.SignPath("secret", "metadata", "missing.jpg", nil), http.StatusNotFound, "Failed to fetch image"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != test.expectedCode {
+			t.Errorf("request to %q returned status %d, expected %d", test.path, rec.Code, test.expectedCode)
+		}
+		if message := strings.TrimSpace(rec.Body.String()); message != test.expectedMessage {
+			t.Errorf("request to %q returned message %q, expected %q", test.path, message, test.expectedMessage)
+		}
+	}
+}
+
+func TestHandleCapabilities(t *testing.T) {
+	capabilities := mediaprocessor.Capabilities{
+		InputFormats:  map[string]bool{"jpeg": true, "heif": false},
+		OutputFormats: map[string]bool{"jpeg": true, "avif": false},
+	}
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, Capabilities: capabilities}, nil, loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("capabilities request returned status %d, expected %d", rec.Code, http.StatusOK)
+	}
+	var response mediaprocessor.Capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("capabilities request returned invalid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(response, capabilities) {
+		t.Errorf("capabilities request returned %+v, expected %+v", response, capabilities)
+	}
+}
+
+type blockingLoader struct {
+	loader.Loader
+	fetches atomic.Int32
+	release chan struct{}
+}
+
+func (l *blockingLoader) GetMedia(ctx context.Context, mediaPath string, header http.Header) (*loader.Media, error) {
+	l.fetches.Add(1)
+	<-l.release
+	return &loader.Media{Data: []byte("data"), ContentType: "image/png"}, nil
+}
+
+// waitForFetchWaiters waits until n calls of cache.GetCachedOrRevalidate wait
+// for their fetch to finish. Joining a shared fetch isn't observable
+// otherwise, so the goroutines blocked in it are counted from their stacks.
+func waitForFetchWaiters(t *testing.T, n int) {
+	t.Helper()
+	buf := make([]byte, 1<<20)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		waiters := 0
+		for _, stack := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+			if strings.Contains(stack, " [select") && strings.Contains(stack, "cache.GetCachedOrRevalidate(") {
+				waiters++
+			}
+		}
+		if waiters >= n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d calls to wait for their fetch", n)
+}
+
+func TestGetOriginalImageDeduplicatesConcurrentFetches(t *testing.T) {
+	l := &blockingLoader{release: make(chan struct{})}
+	s := &server{loader: l, loaderCache: cache.NewNoopCache()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			media, err := s.getOriginalImage(context.Background(), "image.png", nil)
+			if err != nil || string(media.Data) != "data" {
+				t.Errorf("getOriginalImage returned %v, %v, expected %q", media, err, "data")
+			}
+		}()
+	}
+	waitForFetchWaiters(t, 10)
+	close(l.release)
+	wg.Wait()
+
+	if n := l.fetches.Load(); n != 1 {
+		t.Errorf("GetMedia called %d times, expected 1", n)
+	}
+}
+
+func TestGetOriginalImageLoaderCacheVersion(t *testing.T) {
+	l := &blockingLoader{release: make(chan struct{})}
+	close(l.release)
+	loaderCache := cache.NewMemoryCache(1000)
+	for _, version := range []string{"", "", "2", "2", ""} {
+		s := &server{loader: l, loaderCache: loaderCache, config: ServerConfig{LoaderCacheVersion: version, CacheVersion: "other"}}
+		if _, err := s.getOriginalImage(context.Background(), "image.png", nil); err != nil {
+			t.Fatalf("getOriginalImage returned error: %v", err)
+		}
+	}
+	// the unversioned entry is still cached after switching back
+	if n := l.fetches.Load(); n != 2 {
+		t.Errorf("GetMedia called %d times, expected 2", n)
+	}
+}
+
+// notFoundLoader is a loader that never finds the media
+type notFoundLoader struct {
+	loader.Loader
+	fetches atomic.Int32
+	err     error
+}
+
+func (l *notFoundLoader) GetMedia(ctx context.Context, mediaPath string, header http.Header) (*loader.Media, error) {
+	l.fetches.Add(1)
+	return nil, l.err
+}
+
+func TestHandleTransformRequestRejectsInvalidResizeBeforeFetching(t *testing.T) {
+	l := &notFoundLoader{err: loader.ErrUpstreamNotFound}
+	s := NewServer(ServerConfig{EnableUnsafe: true, Concurrency: 1}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), l, cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	for _, query := range []string{"resize.width=100&resize.crop=middle", "resize.width=100&resize.size=smaller", "resize.width=100&resize.fit=fill"} {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_/media/image.png?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("request with %s returned status %d, expected %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if n := l.fetches.Load(); n != 0 {
+		t.Errorf("GetMedia called %d times, expected the invalid requests not to fetch the media", n)
+	}
+}
+
+func TestGetOriginalImageNegativeCache(t *testing.T) {
+	tests := []struct {
+		err             error
+		expectedFetches int32
+	}{
+		{loader.ErrUpstreamNotFound, 1},
+		// transient errors aren't remembered
+		{loader.ErrUpstreamBadStatus, 3},
+	}
+	for _, test := range tests {
+		l := &notFoundLoader{err: test.err}
+		s := &server{loader: l, loaderCache: cache.NewNoopCache(), negativeCache: newNegativeCache(time.Minute)}
+		for i := 0; i < 3; i++ {
+			_, err := s.getOriginalImage(context.Background(), "image.png", nil)
+			if !errors.Is(err, test.err) {
+				t.Errorf("getOriginalImage returned error %v, expected %v", err, test.err)
+			}
+		}
+		if n := l.fetches.Load(); n != test.expectedFetches {
+			t.Errorf("GetMedia failing with %v called %d times, expected %d", test.err, n, test.expectedFetches)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		directives string
+		expiry     time.Time
+		expected   string
+	}{
+		{"public, max-age=31536000, immutable", time.Time{}, "public, max-age=31536000, immutable"},
+		{"public, max-age=31536000, immutable", time.Unix(1600, 0), "public, max-age=600, immutable"},
+		{"public,max-age=60,s-maxage=31536000", time.Unix(1600, 0), "public, max-age=60, s-maxage=600"},
+		{"public, max-age=31536000", time.Unix(900, 0), "public, max-age=0"},
+		{"no-cache", time.Unix(1600, 0), "no-cache"},
+		{"", time.Unix(1600, 0), ""},
+	}
+	for _, test := range tests {
+		if value := cacheControl(test.directives, test.expiry, now); value != test.expected {
+			t.Errorf("cacheControl(%q, %v) = %q, expected %q", test.directives, test.expiry, value, test.expected)
+		}
+	}
+}
+
+func TestHandleMetadataRequestCacheControl(t *testing.T) {
+	metadataCache := cache.NewMemoryCache(1000)
+	metadataCache.Put(cache.Sha256Hash("image.png?"), []byte(`{"width":2}`))
+	metadataCache.Put(cache.Sha256Hash("image.png?thumbhash=true"), []byte(`{"width":2,"thumbhash":"hash"}`))
+	// the loader has no media, so only cached metadata can be served
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, ResponseCacheControl: "public, max-age=60", MetadataCacheControl: "public, max-age=3600", HashCacheControl: "no-store"}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), metadataCache, cache.NewNoopCache())
+	tests := []struct {
+		query    url.Values
+		expected string
+	}{
+		{url.Values{}, "public, max-age=3600"},
+		{url.Values{"thumbhash": {"true"}}, "no-store"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "metadata", "image.png", test.query), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("metadata request with %v returned status %d, expected %d", test.query, rec.Code, http.StatusOK)
+		}
+		if value := rec.Header().Get("Cache-Control"); value != test.expected {
+			t.Errorf("metadata request with %v returned Cache-Control %q, expected %q", test.query, value, test.expected)
+		}
+	}
+}
+
+func TestResultContentType(t *testing.T) {
+	stored := resultContentType(&mediaprocessor.TransformResult{ContentType: "image/webp", Width: 300, Height: 200})
+	if contentType, width, height := parseResultContentType(stored); contentType != "image/webp" || width != 300 || height != 200 {
+		t.Errorf("parseResultContentType(%q) = %q, %d, %d, expected %q, 300, 200", stored, contentType, width, height, "image/webp")
+	}
+	// results cached without their size, and passed through media
+	for _, stored := range []string{"image/png", "text/plain; charset=utf-8"} {
+		if contentType, width, height := parseResultContentType(stored); contentType != stored || width != 0 || height != 0 {
+			t.Errorf("parseResultContentType(%q) = %q, %d, %d, expected the content type without a size", stored, contentType, width, height)
+		}
+	}
+}
+
+func TestHandleTransformRequestDimensionHeaders(t *testing.T) {
+	resultCache := cache.NewMemoryCache(1000)
+	resultCache.Put(cache.Sha256Hash("image.png?resize.width=300"+sourceOutputFormatsKey), concatenateContentTypeAndData("image/png; height=200; width=300", []byte("cached")))
+	resultCache.Put(cache.Sha256Hash("image.png?resize.width=100"+sourceOutputFormatsKey), concatenateContentTypeAndData("image/png", []byte("cached")))
+	tests := []struct {
+		dimensionHeaders bool
+		query            url.Values
+		expected         [3]string // width, height, format
+	}{
+		{true, url.Values{"resize.width": {"300"}}, [3]string{"300", "200", "png"}},
+		{false, url.Values{"resize.width": {"300"}}, [3]string{"", "", ""}},
+		// cached before the size was stored with the results
+		{true, url.Values{"resize.width": {"100"}}, [3]string{"", "", "png"}},
+	}
+	for _, test := range tests {
+		// the loader has no media, so only cached results can be served
+		s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, DimensionHeaders: test.dimensionHeaders}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), resultCache)
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", "image.png", test.query), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request with %v returned status %d, expected %d", test.query, rec.Code, http.StatusOK)
+		}
+		if contentType := rec.Header().Get("Content-Type"); contentType != "image/png" {
+			t.Errorf("request with %v returned Content-Type %q, expected %q", test.query, contentType, "image/png")
+		}
+		headers := [3]string{rec.Header().Get("X-Image-Width"), rec.Header().Get("X-Image-Height"), rec.Header().Get("X-Image-Format")}
+		if headers != test.expected {
+			t.Errorf("request with %v and dimension headers %v returned headers %q, expected %q", test.query, test.dimensionHeaders, headers, test.expected)
+		}
+	}
+}
+
+func TestHandleTransformRequestVaryAccept(t *testing.T) {
+	resultCache := cache.NewMemoryCache(1000)
+	for _, query := range []string{sourceOutputFormatsKey, "outputFormat=png", "outputFormat=auto#autoFormats="} {
+		resultCache.Put(cache.Sha256Hash("image.png?"+query), concatenateContentTypeAndData("image/png", []byte("cached")))
+	}
+	tests := []struct {
+		query    url.Values
+		expected string
+	}{
+		{url.Values{}, "Accept"},
+		{url.Values{"outputFormat": {"auto"}}, "Accept"},
+		{url.Values{"outputFormat": {"png"}}, ""},
+	}
+	// the loader has no media, so only cached results can be served
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), resultCache)
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", "image.png", test.query), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request with %v returned status %d, expected %d", test.query, rec.Code, http.StatusOK)
+		}
+		if vary := rec.Header().Get("Vary"); vary != test.expected {
+			t.Errorf("request with %v returned Vary %q, expected %q", test.query, vary, test.expected)
+		}
+	}
+}
+
+func TestHandleTransformRequestCachesNegotiatedFormats(t *testing.T) {
+	resultCache := cache.NewMemoryCache(1000)
+	resultCache.Put(cache.Sha256Hash("image.png?"+sourceOutputFormatsKey), concatenateContentTypeAndData("image/png", []byte("png")))
+	resultCache.Put(cache.Sha256Hash("image.png?#outputFormats=avif,avif,avif,avif,avif"), concatenateContentTypeAndData("image/avif", []byte("avif")))
+	// the loader has no media, so only cached results can be served
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, AutoAvif: true}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), resultCache)
+	tests := []struct {
+		accept              string
+		expectedContentType string
+	}{
+		{"image/avif,image/*", "image/avif"},
+		{"image/*", "image/png"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", "image.png", url.Values{}), nil)
+		r.Header.Set("Accept", test.accept)
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request with Accept %q returned status %d, expected %d", test.accept, rec.Code, http.StatusOK)
+		}
+		if contentType := rec.Header().Get("Content-Type"); contentType != test.expectedContentType {
+			t.Errorf("request with Accept %q returned Content-Type %q, expected %q", test.accept, contentType, test.expectedContentType)
+		}
+	}
+}
+
+func TestHandleTransformRequestCachesFormatsNegotiatedByQuality(t *testing.T) {
+	resultCache := cache.NewMemoryCache(1000)
+	resultCache.Put(cache.Sha256Hash("image.png?#outputFormats=webp,webp,webp,png,webp"), concatenateContentTypeAndData("image/png", []byte("png")))
+	resultCache.Put(cache.Sha256Hash("image.png?#outputFormats=webp,webp,webp,webp,webp"), concatenateContentTypeAndData("image/webp", []byte("webp")))
+	// the loader has no media, so only cached results can be served
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, AutoWebp: true}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), resultCache)
+	tests := []struct {
+		accept              string
+		expectedContentType string
+	}{
+		// the same types with different q-values
+		{"image/webp;q=0.8,image/png", "image/png"},
+		{"image/webp,image/png;q=0.8", "image/webp"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", "image.png", url.Values{}), nil)
+		r.Header.Set("Accept", test.accept)
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request with Accept %q returned status %d, expected %d", test.accept, rec.Code, http.StatusOK)
+		}
+		if contentType := rec.Header().Get("Content-Type"); contentType != test.expectedContentType {
+			t.Errorf("request with Accept %q returned Content-Type %q, expected %q", test.accept, contentType, test.expectedContentType)
+		}
+	}
+}
+
+// pngFixture encodes a white PNG image of the given size
+func pngFixture(t *testing.T, width int, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode fixture: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleTransformRequestFallbackImage(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "broken.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, FallbackImage: pngFixture(t, 8, 8), FallbackImageStatus: http.StatusNotFound}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(root), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	for _, mediaPath := range []string{
+		"missing.png", // the upstream responds with a 404
+		"broken.png",  // the media can't be processed
+	} {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", mediaPath, url.Values{"resize.width": {"4"}, "outputFormat": {"png"}}), nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: request returned status %d, expected the fallback status %d", mediaPath, rec.Code, http.StatusNotFound)
+		}
+		if cacheControl := rec.Header().Get("Cache-Control"); cacheControl != "no-store" {
+			t.Errorf("%s: fallback image has Cache-Control %q, expected %q", mediaPath, cacheControl, "no-store")
+		}
+		if contentType := rec.Header().Get("Content-Type"); contentType != "image/png" {
+			t.Errorf("%s: fallback image has Content-Type %q, expected %q", mediaPath, contentType, "image/png")
+		}
+		// the fallback image is transformed like the media
+		img, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: failed to decode fallback image: %v", mediaPath, err)
+		}
+		if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 4 {
+			t.Errorf("%s: fallback image is %v, expected it resized to 4x4", mediaPath, img.Bounds())
+		}
+	}
+}
+
+// slowPutCache is a cache whose puts take a while, and that signals when the first is done
+type slowPutCache struct {
+	cache.Cache
+	delay time.Duration
+	done  chan struct{}
+}
+
+func (c *slowPutCache) Put(key string, data []byte) error {
+	defer close(c.done)
+	time.Sleep(c.delay)
+	return c.Cache.Put(key, data)
+}
+
+func TestHandleTransformRequestTimeoutFallbackImage(t *testing.T) {
+	// logging synchronizes the goroutines, which would hide races from the race detector
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	root := t.TempDir()
+	// passed through, as it can't be decoded
+	if err := os.WriteFile(filepath.Join(root, "broken.gif"), []byte("GIF89a broken"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	// the request times out while the fetch caches its result
+	resultCache := &slowPutCache{Cache: cache.NewNoopCache(), delay: 400 * time.Millisecond, done: make(chan struct{})}
+	s := NewServer(ServerConfig{Secret: "secret", Concurrency: 1, RequestTimeout: 200 * time.Millisecond, PassthroughUnsupported: true, FallbackImage: pngFixture(t, 8, 8), FallbackImageStatus: http.StatusNotFound}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(root), cache.NewNoopCache(), cache.NewNoopCache(), resultCache)
+	// the output format is negotiated by both the fetch and the fallback image
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signature.SignPath("secret", "media", "broken.gif", url.Values{}), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("request returned status %d, expected the fallback status %d", rec.Code, http.StatusNotFound)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("fallback image has Content-Type %q, expected %q", contentType, "image/png")
+	}
+	// the fetch goes on after the request timed out
+	select {
+	case <-resultCache.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the result wasn't cached after the request timed out")
+	}
+}
+
+func TestVersionedCacheKey(t *testing.T) {
+	if key := versionedCacheKey("", "image.jpg?"); key != "image.jpg?" {
+		t.Errorf("versionedCacheKey without a version = %q, expected the unversioned key", key)
+	}
+	if versionedCacheKey("1", "image.jpg?") == versionedCacheKey("2", "image.jpg?") {
+		t.Errorf("versionedCacheKey returned the same key for different versions")
+	}
+}
+
+// expiredCache is a cache whose entries are always expired
+type expiredCache struct {
+	cache.Cache
+}
+
+func (c expiredCache) Get(key string) ([]byte, error) {
+	return nil, nil
+}
+
+func (c expiredCache) GetStale(key string) ([]byte, error) {
+	return c.Cache.Get(key)
+}
+
+func TestGetOriginalImageRevalidatesExpiredMedia(t *testing.T) {
+	var fullResponses, notModifiedResponses int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModifiedResponses++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses++
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("data"))
+	}))
+	defer upstream.Close()
+	l, err := loader.NewHTTPLoader(loader.HTTPLoaderConfig{BaseURL: upstream.URL + "/", AllowPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+	s := &server{loader: l, loaderCache: expiredCache{cache.NewMemoryCache(1000)}}
+
+	for i := 0; i < 2; i++ {
+		media, err := s.getOriginalImage(context.Background(), "image.png", nil)
+		if err != nil {
+			t.Fatalf("getOriginalImage returned error: %v", err)
+		}
+		if string(media.Data) != "data" || media.ContentType != "image/png" || media.ETag != `"v1"` {
+			t.Errorf("getOriginalImage returned %q (%s, ETag %s), expected %q (%s, ETag %s)", media.Data, media.ContentType, media.ETag, "data", "image/png", `"v1"`)
+		}
+	}
+	if fullResponses != 1 || notModifiedResponses != 1 {
+		t.Errorf("upstream sent %d full and %d not modified responses, expected 1 and 1", fullResponses, notModifiedResponses)
+	}
+}
+
+func TestGetOriginalImageIgnoresClientConditionalHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("data"))
+	}))
+	defer upstream.Close()
+	l, err := loader.NewHTTPLoader(loader.HTTPLoaderConfig{BaseURL: upstream.URL + "/", AllowPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewHTTPLoader returned error: %v", err)
+	}
+	s := &server{loader: l, loaderCache: cache.NewNoopCache()}
+
+	// as forwarded with ForwardHeaders
+	media, err := s.getOriginalImage(context.Background(), "image.png", http.Header{"If-None-Match": {`"v1"`}})
+	if err != nil {
+		t.Fatalf("getOriginalImage returned error: %v", err)
+	}
+	if string(media.Data) != "data" {
+		t.Errorf("getOriginalImage returned %q, expected %q", media.Data, "data")
+	}
+}
+
+// slowLoader returns when the request context is done
+type slowLoader struct {
+	loader.Loader
+}
+
+func (l slowLoader) GetMedia(ctx context.Context, mediaPath string, header http.Header) (*loader.Media, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := NewServer(ServerConfig{EnableUnsafe: true, Concurrency: 1, RequestTimeout: 50 * time.Millisecond}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), slowLoader{}, cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	for _, path := range []string{"/_/media/image.jpg", "/_/metadata/image.jpg"} {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("request to %q returned status %d, expected %d", path, rec.Code, http.StatusGatewayTimeout)
+		}
+	}
+}
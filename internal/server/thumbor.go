@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	thumborCropRegexp    = regexp.MustCompile(`^(\d+)x(\d+):(\d+)x(\d+)$`)
+	thumborSizeRegexp    = regexp.MustCompile(`^(-?)(\d*|orig)x(-?)(\d*|orig)$`)
+	thumborFiltersRegexp = regexp.MustCompile(`^filters:(?:\w+\([^)]*\)(?::|$))+$`)
+	thumborFilterRegexp  = regexp.MustCompile(`(\w+)\(([^)]*)\)`)
+)
+
+// thumborGravities maps the thumbor vertical and horizontal alignments to resize gravities
+var thumborGravities = map[string]string{
+	"top/left":      "northwest",
+	"top/center":    "north",
+	"top/right":     "northeast",
+	"middle/left":   "west",
+	"middle/center": "center",
+	"middle/right":  "east",
+	"bottom/left":   "southwest",
+	"bottom/center": "south",
+	"bottom/right":  "southeast",
+}
+
+// thumborFormats maps the formats of the thumbor format filter to output formats
+var thumborFormats = map[string]string{
+	"jpeg": "jpeg",
+	"jpg":  "jpeg",
+	"png":  "png",
+	"webp": "webp",
+	"avif": "avif",
+	"gif":  "gif",
+}
+
+// handleThumborRequest handles thumbor URLs, like
+// /{signature}/fit-in/300x200/smart/filters:quality(80)/image.jpg
+func (s *server) handleThumborRequest(w http.ResponseWriter, r *http.Request) {
+	signature, path, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if !s.config.EnableUnsafe && !validThumborSignature(s.config.ThumborKey, signature, path) {
+		writeError(w, NewHTTPError(http.StatusForbidden, "Invalid signature", nil))
+		return
+	}
+	mediaPath, params, err := parseThumborPath(path)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse thumbor path")
+		writeError(w, NewHTTPError(http.StatusBadRequest, "Failed to parse thumbor options", err))
+		return
+	}
+	s.transform(w, r, &RequestInfo[mediaprocessor.TransformOptions]{
+		Signature:        signature,
+		MediaPath:        mediaPath,
+		RequestParams:    params,
+		RequestParamsRaw: url.Values{"thumbor": {path}},
+		UpstreamHeader:   s.forwardedHeaders(r),
+	})
+}
+
+// validThumborSignature validates the signature of a thumbor URL path: the
+// base64url encoded HMAC-SHA1 of the path
+func validThumborSignature(key string, signature string, path string) bool {
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(path))
+	expected := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// parseThumborPath parses the options and image of a thumbor URL path (without
+// the signature) into the media path and transform options. The supported
+// options are trim, manual crop (AxB:CxD), fit-in, the size (with negative
+// sizes flipping the image), the horizontal and vertical alignment, smart and
+// these filters:
+//   - quality(quality)
+//   - format(jpeg|png|webp|avif|gif)
+//   - blur(radius[,sigma])
+//   - rotate(angle)
+//   - brightness(amount) and contrast(amount), from -100 to 100
+//   - background_color(hex color)
+//   - strip_exif()
+//   - upscale() and no_upscale()
+//
+// Other options and filters are an error.
+func parseThumborPath(path string) (string, *mediaprocessor.TransformOptions, error) {
+	opts := mediaprocessor.NewTransformOptions()
+	segments := strings.Split(path, "/")
+	next := func(matches func(segment string) bool) (string, bool) {
+		if len(segments) > 1 && matches(segments[0]) {
+			segment := segments[0]
+			segments = segments[1:]
+			return segment, true
+		}
+		return "", false
+	}
+	equals := func(values ...string) func(string) bool {
+		return func(segment string) bool {
+			for _, value := range values {
+				if segment == value {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	if _, ok := next(equals("meta", "adaptive-fit-in", "full-fit-in")); ok {
+		return "", nil, fmt.Errorf("%w: unsupported thumbor option in %q", mediaprocessor.ErrInvalidOption, path)
+	}
+	if _, ok := next(equals("trim")); ok {
+		opts.Trim = &mediaprocessor.TransformOptionsTrim{Enabled: true}
+	}
+	if crop, ok := next(thumborCropRegexp.MatchString); ok {
+		match := thumborCropRegexp.FindStringSubmatch(crop)
+		left, _ := strconv.Atoi(match[1])
+		top, _ := strconv.Atoi(match[2])
+		right, _ := strconv.Atoi(match[3])
+		bottom, _ := strconv.Atoi(match[4])
+		if right <= left || bottom <= top {
+			return "", nil, fmt.Errorf("%w: invalid thumbor crop %q", mediaprocessor.ErrInvalidOption, crop)
+		}
+		opts.CropRegion = &mediaprocessor.TransformOptionsCropRegion{Left: left, Top: top, Width: right - left, Height: bottom - top}
+	}
+	_, fitIn := next(equals("fit-in"))
+	var width, height int
+	if size, ok := next(thumborSizeRegexp.MatchString); ok {
+		match := thumborSizeRegexp.FindStringSubmatch(size)
+		opts.FlipH, opts.FlipV = match[1] == "-", match[3] == "-"
+		// orig keeps the original size, like 0
+		width, _ = strconv.Atoi(match[2])
+		height, _ = strconv.Atoi(match[4])
+	}
+	halign, ok := next(equals("left", "center", "right"))
+	if !ok {
+		halign = "center"
+	}
+	valign, ok := next(equals("top", "middle", "bottom"))
+	if !ok {
+		valign = "middle"
+	}
+	_, smart := next(equals("smart"))
+	upscale := !fitIn
+	if filters, ok := next(thumborFiltersRegexp.MatchString); ok {
+		for _, match := range thumborFilterRegexp.FindAllStringSubmatch(filters, -1) {
+			var err error
+			upscale, err = applyThumborFilter(opts, match[1], match[2], upscale)
+			if err != nil {
+				return "", nil, fmt.Errorf("%w: invalid thumbor filter %q: %v", mediaprocessor.ErrInvalidOption, match[0], err)
+			}
+		}
+	}
+
+	mediaPath, err := url.PathUnescape(strings.Join(segments, "/"))
+	if err != nil || mediaPath == "" {
+		return "", nil, fmt.Errorf("%w: invalid thumbor image %q", mediaprocessor.ErrInvalidOption, strings.Join(segments, "/"))
+	}
+
+	if width > 0 || height > 0 {
+		resize := &mediaprocessor.TransformOptionsResize{Width: width, Height: height, Size: "down"}
+		if upscale {
+			resize.Size = "both"
+		}
+		switch {
+		case fitIn:
+		case smart:
+			resize.Crop = "attention"
+		default:
+			resize.Gravity = thumborGravities[valign+"/"+halign]
+		}
+		opts.Resize = resize
+	}
+	return mediaPath, opts, nil
+}
+
+// applyThumborFilter applies a thumbor filter to the transform options. It
+// returns whether images may be upscaled, which is changed by the upscale filters.
+func applyThumborFilter(opts *mediaprocessor.TransformOptions, name string, args string, upscale bool) (bool, error) {
+	var err error
+	switch name {
+	case "quality":
+		opts.Quality, err = strconv.Atoi(args)
+	case "format":
+		if opts.OutputFormat = thumborFormats[args]; opts.OutputFormat == "" {
+			err = fmt.Errorf("unsupported format %q", args)
+		}
+	case "blur":
+		// the sigma defaults to the radius
+		radius, sigma, _ := strings.Cut(args, ",")
+		if sigma == "" {
+			sigma = radius
+		}
+		opts.Blur, err = strconv.ParseFloat(sigma, 64)
+	case "rotate":
+		opts.Rotate, err = strconv.Atoi(args)
+		opts.Rotate = ((opts.Rotate % 360) + 360) % 360
+	case "brightness", "contrast":
+		var amount float64
+		if amount, err = strconv.ParseFloat(args, 64); err == nil && (amount < -100 || amount > 100) {
+			err = errors.New("must be between -100 and 100")
+		}
+		if name == "brightness" {
+			opts.Brightness = 1 + amount/100
+		} else {
+			opts.Contrast = 1 + amount/100
+		}
+	case "background_color":
+		opts.Background = args
+	case "strip_exif":
+		opts.StripMetadata = true
+	case "upscale":
+		upscale = true
+	case "no_upscale":
+		upscale = false
+	default:
+		err = errors.New("unsupported filter")
+	}
+	return upscale, err
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blesswinsamuel/media-proxy/internal/cache"
+	"github.com/blesswinsamuel/media-proxy/internal/loader"
+	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
+)
+
+func TestValidThumborSignature(t *testing.T) {
+	// echo -n "300x200/smart/image.jpg" | openssl dgst -sha1 -hmac secret -binary | base64 | tr '+/' '-_'
+	signature := "uxmK3EbB92i7xywtMwE8gh8VLEU="
+	if !validThumborSignature("secret", signature, "300x200/smart/image.jpg") {
+		t.Errorf("validThumborSignature rejected a valid signature")
+	}
+	if validThumborSignature("secret", signature, "300x300/smart/image.jpg") {
+		t.Errorf("validThumborSignature accepted a signature for another path")
+	}
+	if validThumborSignature("other", signature, "300x200/smart/image.jpg") {
+		t.Errorf("validThumborSignature accepted a signature with another key")
+	}
+}
+
+func TestParseThumborPath(t *testing.T) {
+	withDefaults := func(modify func(opts *mediaprocessor.TransformOptions)) *mediaprocessor.TransformOptions {
+		opts := mediaprocessor.NewTransformOptions()
+		modify(opts)
+		return opts
+	}
+	tests := []struct {
+		path              string
+		expectedMediaPath string
+		expectedOpts      *mediaprocessor.TransformOptions
+	}{
+		{"image.jpg", "image.jpg", mediaprocessor.NewTransformOptions()},
+		{"300x200/smart/image.jpg", "image.jpg", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Width: 300, Height: 200, Size: "both", Crop: "attention"}
+		})},
+		{"fit-in/300x0/filters:quality(80):format(webp)/dir%2Fimage.jpg", "dir/image.jpg", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Width: 300, Size: "down"}
+			opts.Quality = 80
+			opts.OutputFormat = "webp"
+		})},
+		{"10x20:110x220/-300x-200/left/top/filters:blur(5,2):no_upscale()/http://example.com/image.png", "http://example.com/image.png", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.CropRegion = &mediaprocessor.TransformOptionsCropRegion{Left: 10, Top: 20, Width: 100, Height: 200}
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Width: 300, Height: 200, Size: "down", Gravity: "northwest"}
+			opts.FlipH = true
+			opts.FlipV = true
+			opts.Blur = 2
+		})},
+		{"trim/origx100/filters:rotate(-90):brightness(50):contrast(-50):background_color(ff0000):strip_exif()/image.jpg", "image.jpg", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Trim = &mediaprocessor.TransformOptionsTrim{Enabled: true}
+			opts.Resize = &mediaprocessor.TransformOptionsResize{Height: 100, Size: "both", Gravity: "center"}
+			opts.Rotate = 270
+			opts.Brightness = 1.5
+			opts.Contrast = 0.5
+			opts.Background = "ff0000"
+			opts.StripMetadata = true
+		})},
+		{"filters:brightness(-100):contrast(-100):format(png)/image.png", "image.png", withDefaults(func(opts *mediaprocessor.TransformOptions) {
+			opts.Brightness = 0
+			opts.Contrast = 0
+			opts.OutputFormat = "png"
+		})},
+	}
+	for _, test := range tests {
+		mediaPath, opts, err := parseThumborPath(test.path)
+		if err != nil {
+			t.Errorf("parseThumborPath(%q) returned error: %v", test.path, err)
+			continue
+		}
+		if mediaPath != test.expectedMediaPath {
+			t.Errorf("parseThumborPath(%q) returned media path %q, expected %q", test.path, mediaPath, test.expectedMediaPath)
+		}
+		if !reflect.DeepEqual(opts, test.expectedOpts) {
+			t.Errorf("parseThumborPath(%q) returned options %+v, expected %+v", test.path, opts, test.expectedOpts)
+		}
+	}
+
+	for _, path := range []string{
+		"meta/300x200/image.jpg",
+		"300x200/filters:watermark(logo.png,0,0,50)/image.jpg",
+		"300x200/filters:format(tiff)/image.jpg",
+		"300x200/filters:quality(high)/image.jpg",
+		"300x200/filters:brightness(200)/image.jpg",
+		"110x220:10x20/image.jpg",
+		"300x200/",
+	} {
+		if _, _, err := parseThumborPath(path); !errors.Is(err, mediaprocessor.ErrInvalidOption) {
+			t.Errorf("parseThumborPath(%q) returned error %v, expected %v", path, err, mediaprocessor.ErrInvalidOption)
+		}
+	}
+}
+
+func TestHandleThumborRequestErrors(t *testing.T) {
+	s := NewServer(ServerConfig{Concurrency: 1, Secret: "secret", CompatMode: "thumbor", ThumborKey: "secret"}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	tests := []struct {
+		path         string
+		expectedCode int
+	}{
+		{"/uxmK3EbB92i7xywtMwE8gh8VLEU=/300x200/smart/image.jpg", http.StatusNotFound},
+		{"/uxmK3EbB92i7xywtMwE8gh8VLEU=/300x300/smart/image.jpg", http.StatusForbidden},
+		{"/unsafe/300x200/smart/image.jpg", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != test.expectedCode {
+			t.Errorf("request to %q returned status %d, expected %d", test.path, rec.Code, test.expectedCode)
+		}
+	}
+
+	s = NewServer(ServerConfig{Concurrency: 1, EnableUnsafe: true, CompatMode: "thumbor"}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(t.TempDir()), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/unsafe/300x200/filters:watermark(logo.png,0,0,50)/image.jpg", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("request with an unsupported filter returned status %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleThumborRequestBrightnessContrast(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "image.png"), pngFixture(t, 8, 8), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	s := NewServer(ServerConfig{Concurrency: 1, EnableUnsafe: true, CompatMode: "thumbor"}, mediaprocessor.NewMediaProcessor(mediaprocessor.MediaProcessorConfig{}), loader.NewFileLoader(root), cache.NewNoopCache(), cache.NewNoopCache(), cache.NewNoopCache())
+	tests := []struct {
+		filter   string
+		expected uint8 // the gray of the white fixture
+	}{
+		{"brightness(-100)", 0},
+		{"contrast(-100)", 128},
+		{"brightness(-50)", 127},
+	}
+	for _, test := range tests {
+		path := "/unsafe/filters:" + test.filter + ":format(png)/image.png"
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request to %q returned status %d: %s", path, rec.Code, rec.Body.String())
+		}
+		img, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("failed to decode the response to %q: %v", path, err)
+		}
+		c := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+		if diff := int(c.R) - int(test.expected); diff < -1 || diff > 1 || c.G != c.R || c.B != c.R {
+			t.Errorf("request to %q returned pixel %v, expected a gray of %d", path, c, test.expected)
+		}
+	}
+}
@@ -1,90 +1,474 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blesswinsamuel/media-proxy/internal/cache"
 	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
-	"github.com/gorilla/schema"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (s *server) handleTransformRequest(w http.ResponseWriter, r *http.Request) {
-	info, err := getRequestInfo(s, r, "media", parseTransformQuery)
+	// validate=true only validates the options, without fetching the media.
+	// It isn't a transform option, and doesn't vary the cache key.
+	var validate bool
+	info, err := getRequestInfo(s, r, "media", func(query url.Values) (*mediaprocessor.TransformOptions, error) {
+		if value := query.Get("validate"); value != "" {
+			var err error
+			if validate, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("%w: invalid validate parameter: %q", mediaprocessor.ErrInvalidOption, value)
+			}
+			query.Del("validate")
+		}
+		return parseTransformQuery(query)
+	})
+	var httpErr *HTTPError
+	if validate && errors.As(err, &httpErr) && httpErr.Code == http.StatusBadRequest {
+		writeValidation(w, nil, httpErr.OrigError)
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get request info")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	if validate {
+		writeValidation(w, info.RequestParams, s.mediaProcessor.ValidateTransformOptions(info.RequestParams))
 		return
 	}
+	s.transform(w, r, info)
+}
+
+// validationResponse is the response of validate=true, with the normalized
+// options when they are valid, or the error
+type validationResponse struct {
+	Valid   bool                             `json:"valid"`
+	Error   string                           `json:"error,omitempty"`
+	Options *mediaprocessor.TransformOptions `json:"options,omitempty"`
+}
+
+// writeValidation responds with the result of validating the transform
+// options: 200 when err is nil, or 400
+func writeValidation(w http.ResponseWriter, params *mediaprocessor.TransformOptions, err error) {
+	response, status := validationResponse{Valid: true, Options: params}, http.StatusOK
+	if err != nil {
+		response, status = validationResponse{Error: err.Error()}, http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// transform responds with the media of the request transformed with its options
+func (s *server) transform(w http.ResponseWriter, r *http.Request, info *RequestInfo[mediaprocessor.TransformOptions]) {
 	logger := log.With().Str("method", r.Method).Stringer("url", r.URL).Logger()
-	ctx := logger.WithContext(r.Context())
+	ctx := logger.WithContext(requestContext(r))
 	logger.Debug().Interface("opts", info.RequestParams).Msg("Incoming Request")
+	ctx, span := tracer.Start(ctx, "handleTransformRequest", trace.WithAttributes(attribute.String("media.path", info.MediaPath)))
+	defer span.End()
 
 	params := info.RequestParams
+	if params.Raw {
+		s.streamOriginalImage(ctx, w, r, info)
+		return
+	}
 
-	out, err := cache.GetCachedOrFetch(s.resultCache, info.MediaPath+"?"+r.URL.Query().Encode(), func() ([]byte, error) {
-		imageBytes, err := s.getOriginalImage(ctx, info.MediaPath)
+	// the default resize depends on the config, so it's part of the key
+	cacheKey := versionedCacheKey(s.config.CacheVersion, info.CacheKey())
+	if maxDimension := s.mediaProcessor.DefaultMaxDimension(params); maxDimension > 0 {
+		cacheKey += fmt.Sprintf("#maxDimension=%d", maxDimension)
+	}
+	// the output format is negotiated with the Accept header when it isn't set,
+	// and outputFormat=auto depends on the formats the client accepts
+	var negotiation outputFormatNegotiation
+	if params.OutputFormat == "" {
+		negotiation = s.negotiateOutputFormats(r.Header.Get("Accept"))
+		cacheKey += negotiation.cacheKey()
+	}
+	if params.OutputFormat == "auto" {
+		params.AutoFormats = autoFormats(r.Header.Get("Accept"))
+		cacheKey += "#autoFormats=" + strings.Join(params.AutoFormats, ",")
+	}
+	// how the output format was chosen and whether the result was cached are
+	// logged, to tell why a client got a format
+	formatSource := "explicit"
+	switch params.OutputFormat {
+	case "":
+		formatSource = "accept"
+	case "auto":
+		formatSource = "auto"
+	}
+	// shared caches must not serve a format negotiated for another client
+	if formatSource != "explicit" {
+		w.Header().Add("Vary", "Accept")
+	}
+	// undecodable media can only be passed through when no option changes it
+	passthrough := s.config.PassthroughUnsupported && !params.RequiresTransform()
+	// the shared fetch can outlive the request (see cache.GetCachedOrFetch), so
+	// it sets the output format on its own copy of the options
+	fetchParams := *params
+	out, resultCache, err := cache.GetCachedOrFetch(ctx, s.resultCache, "result", cacheKey, func(ctx context.Context) ([]byte, error) {
+		media, err := s.getOriginalImage(ctx, info.MediaPath, info.UpstreamHeader)
 		if err != nil {
 			return nil, err
 		}
 
-		if params.OutputFormat == "" {
-			contentType := http.DetectContentType(imageBytes)
-			acceptedContentTypes := strings.Split(r.Header.Get("Accept"), ",")
-			if len(acceptedContentTypes) > 0 {
-				for _, acceptedContentType := range acceptedContentTypes {
-					if acceptedContentType == "image/avif" {
-						continue
-					}
-					if strings.HasPrefix(acceptedContentType, "image/") {
-						contentType = strings.TrimSpace(acceptedContentType)
-						break
-					}
-				}
-			}
-			switch contentType {
-			case "image/webp":
-				params.OutputFormat = "webp"
-			case "image/jpeg":
-				params.OutputFormat = "jpeg"
-			case "image/png":
-				params.OutputFormat = "png"
-			case "image/avif":
-				params.OutputFormat = "avif"
-			case "image/apng":
-				params.OutputFormat = "apng"
-			default:
-				params.OutputFormat = "png"
-			}
+		if fetchParams.OutputFormat == "" {
+			fetchParams.OutputFormat = negotiation.format(media.Data)
 		}
 
-		out, contentType, err := s.mediaProcessor.ProcessTransformRequest(imageBytes, params)
+		result, err := s.mediaProcessor.ProcessTransform(ctx, media.Data, &fetchParams)
+		if contentType := http.DetectContentType(media.Data); passthrough && errors.Is(err, mediaprocessor.ErrUndecodableImage) && passthroughContentType(contentType) {
+			logger.Debug().Err(err).Msg("Passing through undecodable media")
+			return concatenateContentTypeAndData(contentType, media.Data), nil
+		}
 		if err != nil {
 			return nil, err
 		}
-		return concatenateContentTypeAndData(contentType, out), nil
+		outputSize.WithLabelValues(result.ContentType).Observe(float64(len(result.Data)))
+		return concatenateContentTypeAndData(resultContentType(result), result.Data), nil
 	})
-	contentType, out := getContentTypeAndData(out)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to process metadata request")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Error().Err(err).Msg("Failed to process transform request")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to process transform request")
+		if len(s.config.FallbackImage) > 0 && s.serveFallbackImage(ctx, w, r, params) {
+			return
+		}
+		writeError(w, err)
+		return
+	}
+	storedContentType, out := getContentTypeAndData(out)
+	contentType, width, height := parseResultContentType(storedContentType)
+	span.SetAttributes(attribute.String("output.content_type", contentType))
+	logger.Debug().Str("contentType", contentType).Str("formatSource", formatSource).Str("accept", r.Header.Get("Accept")).Str("resultCache", string(resultCache)).Msg("Responding with transformed media")
+	w.Header().Set("Content-Type", contentType)
+	s.setCacheControl(w, s.config.ResponseCacheControl, info.Expiry)
+	// the size isn't always below targetBytes, which is reported to the client
+	if params.TargetBytes > 0 {
+		w.Header().Set("X-Achieved-Bytes", strconv.Itoa(len(out)))
+	}
+	if s.config.DimensionHeaders {
+		setDimensionHeaders(w, contentType, width, height)
+	}
+	if checkNotModified(w, r, etag(cacheKey, contentType)) {
 		return
 	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Write(out)
+}
+
+// passthroughContentType reports whether undecodable media of the content type
+// (sniffed from untrusted bytes) can be passed through. Text types like HTML
+// aren't, as browsers would render them from the proxy's origin.
+func passthroughContentType(contentType string) bool {
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resultContentType returns the content type a transformed image is cached
+// with, with its size as the width and height parameters
+func resultContentType(result *mediaprocessor.TransformResult) string {
+	if result.Width <= 0 || result.Height <= 0 {
+		return result.ContentType
+	}
+	return mime.FormatMediaType(result.ContentType, map[string]string{"width": strconv.Itoa(result.Width), "height": strconv.Itoa(result.Height)})
+}
+
+// parseResultContentType returns the content type and the size of a cached
+// transformed image. The size is 0 when unknown, like for the results cached
+// before it was, or passed through.
+func parseResultContentType(value string) (contentType string, width int, height int) {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil || params["width"] == "" || params["height"] == "" {
+		return value, 0, 0
+	}
+	width, widthErr := strconv.Atoi(params["width"])
+	height, heightErr := strconv.Atoi(params["height"])
+	if widthErr != nil || heightErr != nil {
+		return value, 0, 0
+	}
+	delete(params, "width")
+	delete(params, "height")
+	return mime.FormatMediaType(mediaType, params), width, height
+}
+
+// setDimensionHeaders sets the X-Image-Width, X-Image-Height and X-Image-Format
+// headers of a transformed image, when they are known
+func setDimensionHeaders(w http.ResponseWriter, contentType string, width int, height int) {
+	if width > 0 && height > 0 {
+		w.Header().Set("X-Image-Width", strconv.Itoa(width))
+		w.Header().Set("X-Image-Height", strconv.Itoa(height))
+	}
+	if format, ok := outputFormats[contentType]; ok {
+		w.Header().Set("X-Image-Format", format)
+	}
+}
+
+// negotiateOutputFormat returns the output format of the media for the
+// request's Accept header
+func (s *server) negotiateOutputFormat(r *http.Request, data []byte) string {
+	return s.negotiateSourceOutputFormat(r.Header.Get("Accept"), http.DetectContentType(data))
+}
+
+// negotiateSourceOutputFormat returns the output format of a source content
+// type for the Accept header. When the allowed output formats exclude the
+// source format (or the png fallback), the first allowed format is used instead.
+func (s *server) negotiateSourceOutputFormat(accept string, sourceContentType string) string {
+	format := negotiateOutputFormat(accept, sourceContentType, s.config.AutoAvif && s.mediaProcessor.OutputFormatAllowed("avif"), s.config.AutoWebp && s.mediaProcessor.OutputFormatAllowed("webp"))
+	if allowed := s.mediaProcessor.AllowedOutputFormats(); len(allowed) > 0 && !s.mediaProcessor.OutputFormatAllowed(format) {
+		return allowed[0]
+	}
+	return format
+}
+
+// outputFormatNegotiation maps the source content types of outputFormats to
+// the output format negotiated for them. The result cache key must vary with
+// the negotiated format, but the source isn't known before fetching it, so
+// the format is negotiated for every source upfront.
+type outputFormatNegotiation map[string]string
+
+func (s *server) negotiateOutputFormats(accept string) outputFormatNegotiation {
+	negotiation := outputFormatNegotiation{}
+	for contentType := range outputFormats {
+		negotiation[contentType] = s.negotiateSourceOutputFormat(accept, contentType)
+	}
+	return negotiation
+}
+
+// format returns the output format negotiated for the media. Sources that
+// can't be output are negotiated like PNG, their fallback format.
+func (n outputFormatNegotiation) format(data []byte) string {
+	if format, ok := n[http.DetectContentType(data)]; ok {
+		return format
+	}
+	return n["image/png"]
+}
+
+// cacheKey returns a cache key suffix for the negotiated formats
+func (n outputFormatNegotiation) cacheKey() string {
+	contentTypes := make([]string, 0, len(n))
+	for contentType := range n {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Strings(contentTypes)
+	formats := make([]string, len(contentTypes))
+	for i, contentType := range contentTypes {
+		formats[i] = n[contentType]
+	}
+	return "#outputFormats=" + strings.Join(formats, ",")
+}
+
+// fallbackImageTimeout limits the time spent processing the fallback image
+const fallbackImageTimeout = 10 * time.Second
+
+// serveFallbackImage responds with the fallback image, transformed with the
+// request's options. It returns false when the fallback image can't be processed.
+func (s *server) serveFallbackImage(ctx context.Context, w http.ResponseWriter, r *http.Request, params *mediaprocessor.TransformOptions) bool {
+	// the request may have failed because ctx expired, so the fallback image
+	// is processed with a context of its own
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fallbackImageTimeout)
+	defer cancel()
+	if params.OutputFormat == "" {
+		params.OutputFormat = s.negotiateOutputFormat(r, s.config.FallbackImage)
+	}
+	out, contentType, err := s.mediaProcessor.ProcessTransformRequest(ctx, s.config.FallbackImage, params)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to process fallback image")
+		return false
+	}
+	status := s.config.FallbackImageStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	// the failure may be temporary, so the fallback image shouldn't be cached in place of the media
+	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(status)
 	w.Write(out)
+	return true
+}
+
+// streamOriginalImage copies the original media from the loader to the
+// response, without buffering or caching it
+func (s *server) streamOriginalImage(ctx context.Context, w http.ResponseWriter, r *http.Request, info *RequestInfo[mediaprocessor.TransformOptions]) {
+	stream, err := s.loader.StreamMedia(ctx, info.MediaPath, info.UpstreamHeader)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to stream original media")
+		writeError(w, err)
+		return
+	}
+	defer stream.Body.Close()
+	contentType := stream.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	s.setCacheControl(w, s.config.ResponseCacheControl, info.Expiry)
+	if checkNotModified(w, r, etag(info.CacheKey(), contentType)) {
+		return
+	}
+	if stream.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(stream.ContentLength, 10))
+	}
+	if _, err := io.Copy(w, stream.Body); err != nil {
+		log.Error().Err(err).Msg("Failed to stream original media")
+	}
+}
+
+// outputFormats maps the content types that can be output to their output format
+var outputFormats = map[string]string{
+	"image/avif": "avif",
+	"image/webp": "webp",
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// negotiateOutputFormat picks the output format for the Accept header. AVIF and
+// WebP are chosen when enabled and the client lists them with a higher or
+// equal q-value than the source format, which is kept otherwise (also when
+// nothing matches). Sources that can't be output (like SVG) fall back to PNG,
+// and are negotiated like PNG.
+func negotiateOutputFormat(accept string, sourceContentType string, autoAvif bool, autoWebp bool) string {
+	sourceFormat, ok := outputFormats[sourceContentType]
+	if !ok {
+		sourceFormat, sourceContentType = "png", "image/png"
+	}
+	ranges := parseAccept(accept)
+
+	// AVIF and WebP must be listed explicitly, as clients accepting image/*
+	// don't necessarily support them
+	format, bestQ := sourceFormat, 0.0
+	if autoAvif {
+		if q := explicitAcceptQuality(ranges, "image/avif"); q > bestQ {
+			format, bestQ = "avif", q
+		}
+	}
+	if autoWebp {
+		if q := explicitAcceptQuality(ranges, "image/webp"); q > bestQ {
+			format, bestQ = "webp", q
+		}
+	}
+	if q := acceptQuality(ranges, sourceContentType); q > bestQ {
+		format = sourceFormat
+	}
+	return format
+}
+
+// autoFormats returns the output formats besides jpeg and png the Accept
+// header lists explicitly, which outputFormat=auto can pick from
+func autoFormats(accept string) []string {
+	ranges := parseAccept(accept)
+	var formats []string
+	for _, format := range []string{"avif", "webp"} {
+		if explicitAcceptQuality(ranges, "image/"+format) > 0 {
+			formats = append(formats, format)
+		}
+	}
+	return formats
 }
 
 func parseTransformQuery(query url.Values) (*mediaprocessor.TransformOptions, error) {
-	transformOpts := &mediaprocessor.TransformOptions{}
-	var decoder = schema.NewDecoder()
-	decoder.SetAliasTag("query")
-	if err := decoder.Decode(transformOpts, query); err != nil {
+	transformOpts := mediaprocessor.NewTransformOptions()
+	// resize.width and resize.height also accept a percentage of the image
+	// size (like 50%), which is parsed separately from the pixel sizes
+	percentages := map[string]float64{}
+	for _, key := range []string{"resize.width", "resize.height"} {
+		value := query.Get(key)
+		if !strings.HasSuffix(value, "%") {
+			continue
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 {
+			return nil, fmt.Errorf("%w: invalid %s parameter: %q (percentage must be positive)", mediaprocessor.ErrInvalidOption, key, value)
+		}
+		percentages[key] = percent
+	}
+	// size is a shorthand of resize.width and resize.height (300x200, 300x or
+	// x200). The explicit params win when both are set.
+	var sizeWidth, sizeHeight int
+	if query.Has("size") {
+		var err error
+		if sizeWidth, sizeHeight, err = parseSize(query.Get("size")); err != nil {
+			return nil, err
+		}
+		if query.Has("resize.width") {
+			sizeWidth = 0
+		}
+		if query.Has("resize.height") {
+			sizeHeight = 0
+		}
+	}
+	if len(percentages) > 0 || query.Has("size") {
+		rest := url.Values{}
+		for key, values := range query {
+			if _, ok := percentages[key]; !ok && key != "size" {
+				rest[key] = values
+			}
+		}
+		query = rest
+	}
+	if err := decodeQuery(transformOpts, query, "trim"); err != nil {
 		return nil, err
 	}
+	if len(percentages) > 0 || sizeWidth > 0 || sizeHeight > 0 {
+		if transformOpts.Resize == nil {
+			transformOpts.Resize = &mediaprocessor.TransformOptionsResize{}
+		}
+		transformOpts.Resize.WidthPercent = percentages["resize.width"]
+		transformOpts.Resize.HeightPercent = percentages["resize.height"]
+		if sizeWidth > 0 {
+			transformOpts.Resize.Width = sizeWidth
+		}
+		if sizeHeight > 0 {
+			transformOpts.Resize.Height = sizeHeight
+		}
+	}
+	// invalid resize enums (like resize.crop) are rejected before fetching the
+	// media, and checked again when processing
+	if transformOpts.Resize != nil {
+		if err := transformOpts.Resize.Validate(); err != nil {
+			return nil, err
+		}
+	}
 	return transformOpts, nil
 }
+
+// parseSize parses the size shorthand WIDTHxHEIGHT, where either side can be
+// omitted (0 is returned for it)
+func parseSize(size string) (width int, height int, err error) {
+	parseSide := func(value string) (int, bool) {
+		if value == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(value)
+		return n, err == nil && n > 0
+	}
+	widthStr, heightStr, found := strings.Cut(size, "x")
+	width, widthOk := parseSide(widthStr)
+	height, heightOk := parseSide(heightStr)
+	if found && widthOk && heightOk && (width > 0 || height > 0) {
+		return width, height, nil
+	}
+	return 0, 0, fmt.Errorf("%w: invalid size parameter: %q (must be like 300x200, 300x or x200)", mediaprocessor.ErrInvalidOption, size)
+}
@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Setup configures the global tracer provider to export spans with OTLP over
+// HTTP to the endpoint (like http://localhost:4318), and the W3C trace context
+// propagator. The returned function flushes the remaining spans and stops the
+// exporter.
+func Setup(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %q", endpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpointURL.Host)}
+	if endpointURL.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if endpointURL.Path != "" && endpointURL.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(endpointURL.Path))
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "media-proxy")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"path"
 	"syscall"
 
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/blesswinsamuel/media-proxy/internal/cache"
 	"github.com/blesswinsamuel/media-proxy/internal/config"
 	"github.com/blesswinsamuel/media-proxy/internal/loader"
 	"github.com/blesswinsamuel/media-proxy/internal/mediaprocessor"
 	"github.com/blesswinsamuel/media-proxy/internal/server"
+	"github.com/blesswinsamuel/media-proxy/internal/tracing"
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
@@ -40,6 +44,15 @@ func main() {
 	// Perform config validation
 	config.Validate()
 
+	// Set up tracing
+	shutdownTracing := func(context.Context) error { return nil }
+	if config.OtelEndpoint != "" {
+		shutdownTracing, err = tracing.Setup(context.Background(), config.OtelEndpoint)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to set up tracing")
+		}
+	}
+
 	// Set up libvips concurrency level
 	vips.LoggingSettings(func(messageDomain string, messageLevel vips.LogLevel, message string) {
 		var messageLevelDescription string
@@ -61,13 +74,13 @@ func main() {
 	}, vips.LogLevelWarning)
 	vips.Startup(&vips.Config{
 		// https://www.libvips.org/API/current/VipsOperation.html#vips-concurrency-set
-		ConcurrencyLevel: 4,
+		ConcurrencyLevel: config.VipsConcurrency,
 		// https://www.libvips.org/API/current/VipsOperation.html#vips-cache-set-max-files
-		MaxCacheFiles: 0,
+		MaxCacheFiles: config.VipsMaxCacheFiles,
 		// https://www.libvips.org/API/current/VipsOperation.html#vips-cache-set-max-mem
-		MaxCacheMem: 50 * 1024 * 1024,
+		MaxCacheMem: config.VipsMaxCacheMem,
 		// https://www.libvips.org/API/current/VipsOperation.html#vips-cache-set-max
-		MaxCacheSize: 100,
+		MaxCacheSize: config.VipsMaxCacheSize,
 		// https://www.libvips.org/API/current/libvips-vips.html#vips-leak-set
 		ReportLeaks: true,
 		// https://www.libvips.org/API/current/VipsOperation.html#vips-cache-set-trace
@@ -78,6 +91,12 @@ func main() {
 
 	prometheus.MustRegister(mediaprocessor.NewVipsPrometheusCollector())
 
+	capabilities, err := mediaprocessor.ProbeCapabilities()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to probe libvips capabilities")
+	}
+	log.Info().Interface("capabilities", capabilities).Msg("Probed libvips capabilities")
+
 	// go func() {
 	// 	for {
 	// 		// runtimeStats := vips.RuntimeStats{}
@@ -93,40 +112,176 @@ func main() {
 	// 		vips.PrintObjectReport("main")
 	// 	}
 	// }()
+	newS3Client := func(region string) *s3.Client {
+		awsConfig, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(region))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load AWS config")
+		}
+		return s3.NewFromConfig(awsConfig)
+	}
+
+	var s3Client *s3.Client
+	if config.S3Bucket != "" {
+		s3Client = newS3Client(config.S3Region)
+	}
+	newCache := func(name string) cache.Cache {
+		if s3Client != nil {
+			return cache.NewS3Cache(s3Client, config.S3Bucket, path.Join(config.S3Prefix, name))
+		}
+		return cache.NewFsCacheWithLimits(path.Join(config.CacheDir, name), config.CacheTTL, config.CacheMaxBytes)
+	}
+
 	var loaderCache, metadataCache, resultCache cache.Cache
 	if config.EnableLoaderCache.Value {
-		loaderCache = cache.NewFsCache(path.Join(config.CacheDir, "original"))
+		loaderCache = newCache("original")
 	} else {
 		loaderCache = cache.NewNoopCache()
 	}
 	if config.EnableResultCache.Value {
-		metadataCache = cache.NewFsCache(path.Join(config.CacheDir, "metadata"))
-		resultCache = cache.NewFsCache(path.Join(config.CacheDir, "result"))
+		metadataCache = newCache("metadata")
+		resultCache = newCache("result")
+		if config.MemoryCacheSize > 0 {
+			resultCache = cache.NewTieredCache(cache.NewMemoryCacheWithTTL(config.MemoryCacheSize, config.CacheTTL), resultCache)
+		}
 	} else {
 		metadataCache = cache.NewNoopCache()
 		resultCache = cache.NewNoopCache()
 	}
 
-	mediaProcessor := mediaprocessor.NewMediaProcessor()
-	loader := loader.NewHTTPLoader(config.BaseURL)
+	mediaProcessor := mediaprocessor.NewMediaProcessor(newMediaProcessorConfig(config))
+	var mediaLoader loader.Loader
+	switch config.Loader {
+	case "file":
+		mediaLoader = loader.NewFileLoader(config.FileRoot)
+	case "s3":
+		mediaLoader = loader.NewS3Loader(newS3Client(config.S3LoaderRegion), config.S3LoaderBucket, config.S3LoaderPrefix)
+	default:
+		// the first of the base URLs is the base URL, and the rest are its mirrors
+		var mirrorBaseURLs []string
+		if len(config.BaseURLs) > 1 {
+			mirrorBaseURLs = config.BaseURLs[1:]
+		}
+		authType := config.UpstreamAuthType
+		if authType == "none" {
+			authType = ""
+		}
+		mediaLoader, err = loader.NewHTTPLoader(loader.HTTPLoaderConfig{
+			BaseURL:              config.BaseURL,
+			MirrorBaseURLs:       mirrorBaseURLs,
+			MaxRetries:           config.LoaderMaxRetries,
+			AllowedHosts:         config.AllowedUpstreamHosts,
+			AllowPrivateNetworks: config.AllowPrivateNetworks.Value,
+			UserAgent:            config.UpstreamUserAgent,
+			Headers:              config.UpstreamHeaders,
+			AuthType:             authType,
+			Username:             config.UpstreamUsername,
+			Password:             config.UpstreamPassword,
+			Token:                config.UpstreamToken,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create HTTP loader")
+		}
+	}
+	if config.DataURIMaxSize > 0 {
+		mediaLoader = loader.NewDataURILoader(mediaLoader, config.DataURIMaxSize)
+	}
+
+	var fallbackImage []byte
+	if config.FallbackImage != "" {
+		fallbackImage, err = os.ReadFile(config.FallbackImage)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read fallback image")
+		}
+	}
 
 	server := server.NewServer(server.ServerConfig{
-		Port:         config.Port,
-		MetricsPort:  config.MetricsPort,
-		Secret:       config.Secret,
-		EnableUnsafe: bool(config.EnableUnsafe.Value),
-		AutoAvif:     true,
-		AutoWebp:     true,
-		Concurrency:  config.Concurrency,
-	}, mediaProcessor, loader, loaderCache, metadataCache, resultCache)
+		Port:                   config.Port,
+		MetricsPort:            config.MetricsPort,
+		TLSCertFile:            config.TLSCert,
+		TLSKeyFile:             config.TLSKey,
+		Secret:                 config.Secret,
+		SignatureAlgorithm:     config.SignatureAlgorithm,
+		EnableUnsafe:           bool(config.EnableUnsafe.Value),
+		AutoAvif:               bool(config.AutoAvif.Value),
+		AutoWebp:               bool(config.AutoWebp.Value),
+		Concurrency:            config.Concurrency,
+		ForwardHeaders:         config.ForwardHeaders,
+		CORSAllowedOrigins:     config.CORSAllowedOrigins,
+		RequireSignatureExpiry: bool(config.RequireSignatureExpiry.Value),
+		FallbackImage:          fallbackImage,
+		FallbackImageStatus:    config.FallbackImageStatus,
+		PassthroughUnsupported: bool(config.PassthroughUnsupported.Value),
+		DimensionHeaders:       bool(config.DimensionHeaders.Value),
+		Capabilities:           capabilities,
+		RequestTimeout:         config.RequestTimeout,
+		NegativeCacheTTL:       config.NegativeCacheTTL,
+		CacheVersion:           config.CacheVersion,
+		LoaderCacheVersion:     config.LoaderCacheVersion,
+		CacheKeyIgnoreParams:   config.CacheKeyIgnoreParams,
+		ResponseCacheControl:   config.ResponseCacheControl,
+		MetadataCacheControl:   config.MetadataCacheControl,
+		HashCacheControl:       config.HashCacheControl,
+		MaxUploadSize:          config.MaxUploadSize,
+		CompatMode:             config.CompatMode,
+		ImgproxyKey:            config.ImgproxyKey,
+		ImgproxySalt:           config.ImgproxySalt,
+		ThumborKey:             config.ThumborKey,
+	}, mediaProcessor, mediaLoader, loaderCache, metadataCache, resultCache)
 
 	// Start the server
 	server.Start()
 
-	// graceful shutdown
+	// reload the config on SIGHUP, and shut down gracefully on SIGINT and SIGTERM
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	<-stop
+	for running := true; running; {
+		select {
+		case <-reload:
+			updated, err := reloadConfig()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to reload config, keeping the current config")
+				continue
+			}
+			if changed := config.NonReloadableChanges(updated); len(changed) > 0 {
+				log.Warn().Strs("flags", changed).Msg("Changed config needs a restart to be applied")
+			}
+			server.UpdateSignatureConfig(updated.Secret, updated.SignatureAlgorithm)
+			mediaProcessor.UpdateConfig(newMediaProcessorConfig(updated))
+			log.Info().Msg("Reloaded config")
+		case <-stop:
+			running = false
+		}
+	}
 	log.Info().Msg("Shutting down...")
 	server.Stop()
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Error().Err(err).Msg("failed to shut down tracing")
+	}
+}
+
+func newMediaProcessorConfig(c *config.Config) mediaprocessor.MediaProcessorConfig {
+	return mediaprocessor.MediaProcessorConfig{
+		MaxOutputWidth:       c.MaxOutputWidth,
+		MaxOutputHeight:      c.MaxOutputHeight,
+		MaxDpi:               c.MaxDpi,
+		DefaultColorProfile:  c.DefaultColorProfile,
+		AllowedOutputFormats: c.AllowedOutputFormats,
+		DefaultQuality: map[string]int{
+			"jpeg": c.DefaultJpegQuality,
+			"webp": c.DefaultWebpQuality,
+			"avif": c.DefaultAvifQuality,
+		},
+		DefaultMaxDimension: c.DefaultMaxDimension,
+		AllowedInputFormats: c.AllowedInputFormats,
+		AutoFormatMaxColors: c.AutoFormatMaxColors,
+		MaxMegapixels:       c.MaxMegapixels,
+		EncodeConcurrency:   c.EncodeConcurrency,
+	}
+}
+
+// reloadConfig parses the config again from the flags, environment and config file
+func reloadConfig() (*config.Config, error) {
+	return config.ParseConfig(nil)
 }
@@ -0,0 +1,46 @@
+// Package signature signs media proxy request paths. Requests are signed with
+// an HMAC of "<requestType>/<mediaPath>?<query>", encoded as URL-safe base64,
+// and the signature is the first segment of the request path.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"net/url"
+	"strings"
+)
+
+// hashFunc returns the hash function of the algorithm (sha1 or sha256), defaulting to sha1
+func hashFunc(algorithm string) func() hash.Hash {
+	if algorithm == "sha256" {
+		return sha256.New
+	}
+	return sha1.New
+}
+
+// Sign returns the signature of the path (like "media/image.jpg?rotate=90")
+// using the algorithm (sha1 or sha256, sha1 when empty)
+func Sign(algorithm string, secret string, path string) string {
+	mac := hmac.New(hashFunc(algorithm), []byte(secret))
+	mac.Write([]byte(path))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignPath returns the signed request path of the media path and query using
+// HMAC-SHA1, like "/<signature>/media/image.jpg?rotate=90". requestType is
+// "media" or "metadata".
+func SignPath(secret string, requestType string, mediaPath string, query url.Values) string {
+	return SignPathWithAlgorithm("sha1", secret, requestType, mediaPath, query)
+}
+
+// SignPathWithAlgorithm is like SignPath, using the given algorithm (sha1 or sha256)
+func SignPathWithAlgorithm(algorithm string, secret string, requestType string, mediaPath string, query url.Values) string {
+	path := requestType + "/" + strings.TrimPrefix(mediaPath, "/")
+	if encoded := query.Encode(); encoded != "" {
+		path = path + "?" + encoded
+	}
+	return "/" + Sign(algorithm, secret, path) + "/" + path
+}
@@ -0,0 +1,49 @@
+package signature
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		// echo -n "media/image.jpg?rotate=90" | openssl dgst -sha1 -hmac secret -binary | base64 | tr '+/' '-_'
+		{"", "YuYRt0tocVmtzJomQKJCA_Wa-u4="},
+		{"sha1", "YuYRt0tocVmtzJomQKJCA_Wa-u4="},
+		// echo -n "media/image.jpg?rotate=90" | openssl dgst -sha256 -hmac secret -binary | base64 | tr '+/' '-_'
+		{"sha256", "Owru0cRFyqTfKatpgKdBk7j0Kx0Ks3fSlOOkbl5doCI="},
+	}
+	for _, test := range tests {
+		if signature := Sign(test.algorithm, "secret", "media/image.jpg?rotate=90"); signature != test.expected {
+			t.Errorf("Sign(%q) = %q, expected %q", test.algorithm, signature, test.expected)
+		}
+	}
+}
+
+func TestSignPath(t *testing.T) {
+	tests := []struct {
+		requestType string
+		mediaPath   string
+		query       url.Values
+		signedPath  string
+	}{
+		{"media", "image.jpg", nil, "media/image.jpg"},
+		{"media", "/image.jpg", url.Values{}, "media/image.jpg"},
+		{"media", "image.jpg", url.Values{"rotate": {"90"}}, "media/image.jpg?rotate=90"},
+		{"metadata", "dir/image.jpg", url.Values{"thumbhash": {"true"}, "blurhash": {"true"}}, "metadata/dir/image.jpg?blurhash=true&thumbhash=true"},
+		{"media", "dir/", url.Values{"resize.width": {"100"}}, "media/dir/?resize.width=100"},
+	}
+	for _, test := range tests {
+		expected := "/" + Sign("sha1", "secret", test.signedPath) + "/" + test.signedPath
+		if path := SignPath("secret", test.requestType, test.mediaPath, test.query); path != expected {
+			t.Errorf("SignPath(%q, %q, %v) = %q, expected %q", test.requestType, test.mediaPath, test.query, path, expected)
+		}
+	}
+	expected := "/" + Sign("sha256", "secret", "media/image.jpg") + "/media/image.jpg"
+	if path := SignPathWithAlgorithm("sha256", "secret", "media", "image.jpg", nil); path != expected {
+		t.Errorf("SignPathWithAlgorithm(sha256) = %q, expected %q", path, expected)
+	}
+}